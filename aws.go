@@ -2,6 +2,8 @@ package awslib
 
 import (
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"time"
 
@@ -12,34 +14,60 @@ import (
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 )
 
-// AWSSession is a global variable holding an
-// AWS session.Session. Call InitAWS to set
-var AWSSession *session.Session
+var (
+	// AWSSession is a global variable holding an
+	// AWS session.Session. Call InitAWS to set
+	AWSSession *session.Session
+
+	// RegionLookupDeadline is the maximum amount of time InitAWS and InitAWSE
+	// will spend retrying EC2 metadata calls to determine the region
+	RegionLookupDeadline = 30 * time.Second
+
+	// DebugOut is a log.Logger for debug messages
+	DebugOut = log.New(io.Discard, "", 0)
+)
 
 // InitAWS optionally takes a region, accesskey and secret key,
 // setting AWSSession to the resulting session. If values aren't
 // provided, the well-known environment variables (WKE) are
 // consulted. If they're not available, and running in an EC2
-// instance, then it will use the local IAM role
-func InitAWS(awsRegion, awsAccessKey, awsSecretKey string) {
+// instance, then it will use the local IAM role, blocking for up to
+// RegionLookupDeadline while EC2 metadata lookups are retried. If
+// that fails, the error is logged to DebugOut and returned, and
+// AWSSession is left as it was.
+// DEPRECATED: Use InitAWSE, which returns the session too.
+func InitAWS(awsRegion, awsAccessKey, awsSecretKey string) error {
+	_, err := InitAWSE(awsRegion, awsAccessKey, awsSecretKey)
+	if err != nil {
+		DebugOut.Printf("InitAWS failed: '%v'\n", err)
+	}
+	return err
+}
+
+// InitAWSE optionally takes a region, accesskey and secret key,
+// setting AWSSession to the resulting session, and returning it or an error.
+// If values aren't provided, the well-known environment variables (WKE) are
+// consulted. If they're not available, and running in an EC2
+// instance, then it will use the local IAM role. EC2 metadata lookups
+// are retried with backoff until RegionLookupDeadline has passed.
+func InitAWSE(awsRegion, awsAccessKey, awsSecretKey string) (*session.Session, error) {
 
-	AWSSession = session.New()
+	config := aws.NewConfig()
 
 	// Region
 	if awsRegion != "" {
 		// CLI trumps
-		AWSSession.Config.Region = aws.String(awsRegion)
+		config.Region = aws.String(awsRegion)
 	} else if os.Getenv("AWS_DEFAULT_REGION") != "" {
 		// Env is good, too
-		AWSSession.Config.Region = aws.String(os.Getenv("AWS_DEFAULT_REGION"))
+		config.Region = aws.String(os.Getenv("AWS_DEFAULT_REGION"))
 	} else {
 		// Grab it from this EC2 instance, maybe
-		region, err := getAwsRegionE()
+		region, err := getAwsRegionRetry(RegionLookupDeadline)
 		if err != nil {
-			fmt.Printf("Cannot set AWS region: '%v'\n", err)
-			os.Exit(1)
+			return nil, fmt.Errorf("cannot set AWS region: '%w'", err)
 		}
-		AWSSession.Config.Region = aws.String(region)
+		config.Region = aws.String(region)
 	}
 
 	// Creds
@@ -49,16 +77,50 @@ func InitAWS(awsRegion, awsAccessKey, awsSecretKey string) {
 			awsAccessKey,
 			awsSecretKey,
 			"")
-		AWSSession.Config.Credentials = creds
+		config.Credentials = creds
 	} else if os.Getenv("AWS_ACCESS_KEY_ID") != "" {
 		// Env is good, too
 		creds := credentials.NewStaticCredentials(
 			os.Getenv("AWS_ACCESS_KEY_ID"),
 			os.Getenv("AWS_SECRET_ACCESS_KEY"),
 			"")
-		AWSSession.Config.Credentials = creds
+		config.Credentials = creds
 	}
 
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	AWSSession = sess
+	return sess, nil
+}
+
+// getAwsRegionRetry calls getAwsRegionE until it succeeds or the deadline
+// has passed, backing off exponentially between attempts
+func getAwsRegionRetry(deadline time.Duration) (region string, err error) {
+
+	var (
+		backoff = 250 * time.Millisecond
+		until   = time.Now().Add(deadline)
+	)
+
+	for {
+		region, err = getAwsRegionE()
+		if err == nil {
+			return
+		}
+
+		if time.Now().Add(backoff).After(until) {
+			// Out of time
+			return "", fmt.Errorf("region lookup failed after %s: %w", deadline, err)
+		}
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
 }
 
 // getAwsRegion returns the region as a string,
@@ -151,13 +213,3 @@ func getMetrics(dimensionName, dimensionValue, namespace, metric, stat, unit str
 
 	return
 }
-
-// nameToResourceType ...
-func nameToResourceType(name string) (resourceType string) {
-	// EC2 i-
-	// RDS .rds.amazonaws.com
-	// ELB
-	// EBS vol-
-	// EIP eipalloc-
-	return
-}
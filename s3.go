@@ -148,8 +148,9 @@ func FileToBucket(filename, bucket string) (size int64, err error) {
 }
 
 // Calculate_etag reads the specified filename in chunkSizeMB blocks, and returns
-// the S3 multipart-upload etag/md5sum-of-sums or an error. The read capped and
-// buffered to prevent heap allocations.
+// the S3 multipart-upload etag/md5sum-of-sums, or the plain MD5 if the file fits in
+// one block, as S3 gives it, or an error. The read capped and buffered to prevent
+// heap allocations.
 func Calculate_etag(filename string, chunkSizeMB int64) (etag string, err error) {
 
 	var (
@@ -166,13 +167,11 @@ func Calculate_etag(filename string, chunkSizeMB int64) (etag string, err error)
 
 	for {
 		var size = -1
-		size, err = file.Read(readBuffer)
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return
-			}
+		size, err = io.ReadFull(file, readBuffer)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return
 		}
 
 		sum := md5.Sum(readBuffer[:size])
@@ -185,7 +184,16 @@ func Calculate_etag(filename string, chunkSizeMB int64) (etag string, err error)
 		}
 	}
 
-	etag = fmt.Sprintf("%x-%d", md5.Sum([]byte(subtag)), count)
+	switch count {
+	case 0:
+		// An empty file
+		etag = fmt.Sprintf("%x", md5.Sum(nil))
+	case 1:
+		// A single block's ETag is its MD5
+		etag = fmt.Sprintf("%x", subtag)
+	default:
+		etag = fmt.Sprintf("%x-%d", md5.Sum([]byte(subtag)), count)
+	}
 	err = nil
 	return
 }
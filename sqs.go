@@ -25,12 +25,10 @@ func SQS_GetQueueUrl(queue string) (qurl string, err error) {
 	return
 }
 
-// SQS_Attributes returns an SqsInfo struct for the specified queue
+// SQS_Attributes returns an SqsInfo struct for the specified queue, as NewSqsInfo.
 // Assumes InitAWS has been called.
 func SQS_Attributes(queue string) (sInfo *SqsInfo, err error) {
-	sInfo, err = NewSqsInfo(queue)
-	sInfo.sqs = nil // we want to kill that reference
-	return
+	return NewSqsInfo(queue)
 }
 
 // SqsInfo ...
@@ -44,16 +42,19 @@ type SqsInfo struct {
 	lasterr           error
 }
 
-// NewSqsInfo ...
+// NewSqsInfo returns an SqsInfo struct or an error for the specified queue.
+// Assumes InitAWS has been called.
 func NewSqsInfo(queue string) (s *SqsInfo, err error) {
-	s.sqs = sqs.New(AWSSession)
+	s = &SqsInfo{
+		sqs: sqs.New(AWSSession),
+	}
 
 	params := &sqs.GetQueueUrlInput{
 		QueueName: aws.String(queue),
 	}
 	resp, err := s.sqs.GetQueueUrl(params)
 	if err != nil {
-		return
+		return nil, err
 	}
 	s.qurl = *resp.QueueUrl
 
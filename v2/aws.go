@@ -1,13 +1,14 @@
 package aws
 
 import (
+	"context"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/cognusion/go-timings"
 
 	"fmt"
@@ -16,6 +17,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 var (
@@ -29,14 +31,26 @@ var (
 type Session struct {
 	// AWS is the raw, hopefully initialized AWS Session
 	AWS *session.Session
-	Me  *ec2metadata.EC2InstanceIdentityDocument
+	// Me is the EC2 instance identity document, if available. It is only populated
+	// by NewSession, if WithEagerIdentity is used, and never changed after. Otherwise
+	// use Identity, which looks it up on first use.
+	Me *ec2metadata.EC2InstanceIdentityDocument
+
+	identOnce sync.Once
+	ident     *Identity
+	identErr  error
 }
 
-// NewSession returns a Session or an error
-func NewSession(awsRegion, awsAccessKey, awsSecretKey string) (*Session, error) {
+// NewSession returns a Session or an error. With no Options, the region and
+// credentials are sourced from the well-known environment variables (WKE),
+// the shared config and credentials files, or the EC2 instance, in that order.
+// If WithEagerIdentity is used, Me is populated if the EC2 instance identity
+// document is available, but its absence is not an error.
+func NewSession(opts ...Option) (*Session, error) {
 
+	o := newSessionOptions(opts...)
 	s := Session{}
-	awsSession, err := InitAWS(awsRegion, awsAccessKey, awsSecretKey)
+	awsSession, err := newAWSSession(o)
 
 	if err != nil {
 		// Error initing session
@@ -44,88 +58,120 @@ func NewSession(awsRegion, awsAccessKey, awsSecretKey string) (*Session, error)
 	}
 	s.AWS = awsSession
 
-	idd, err := s.getMe()
-	if err != nil {
-		// Error getting ec2metadata
-		return nil, err
+	if o.eagerIdentity {
+		idd, err := s.GetMe()
+		if err != nil {
+			// Not on EC2, or metadata is unavailable. Either way, not fatal.
+			DebugOut.Printf("EC2 Me: %s\n", err)
+		} else {
+			s.Me = idd
+			DebugOut.Printf("EC2 Me: %+v\n", *idd)
+		}
 	}
-	s.Me = &idd
-	DebugOut.Printf("EC2 Me: %+v\n", idd)
 	return &s, nil
 }
 
 // InitAWS optionally takes a region, accesskey and secret key,
-// setting AWSSession to the resulting session. If values aren't
+// returning the resulting session. If values aren't
 // provided, the well-known environment variables (WKE) are
 // consulted. If they're not available, and running in an EC2
 // instance, then it will use the local IAM role
 func InitAWS(awsRegion, awsAccessKey, awsSecretKey string) (*session.Session, error) {
+	opts := []Option{WithCredentials(awsAccessKey, awsSecretKey)}
+	if awsRegion != "" {
+		opts = append(opts, WithRegion(awsRegion))
+	}
+	return newAWSSession(newSessionOptions(opts...))
+}
+
+// newAWSSession builds an AWS session from the collected options
+func newAWSSession(o *sessionOptions) (*session.Session, error) {
 
 	config := aws.NewConfig()
 
 	// Region
-	if awsRegion != "" {
-		// CLI trumps
-		config.Region = aws.String(awsRegion)
-	} else if os.Getenv("AWS_DEFAULT_REGION") != "" {
-		// Env is good, too
-		config.Region = aws.String(os.Getenv("AWS_DEFAULT_REGION"))
-	} else {
-		// Grab it from this EC2 instance, maybe
-		region, err := GetAwsRegionE()
-		if err != nil {
-			return nil, fmt.Errorf("cannot set AWS region: '%w'", err)
-		}
-		config.Region = aws.String(region)
+	if o.region != "" {
+		config.Region = aws.String(o.region)
 	}
 
 	// Creds
-	if awsAccessKey != "" && awsSecretKey != "" {
-		// CLI trumps
-		creds := credentials.NewStaticCredentials(
-			awsAccessKey,
-			awsSecretKey,
-			"")
-		config.Credentials = creds
-	} else if os.Getenv("AWS_ACCESS_KEY_ID") != "" {
-		// Env is good, too
-		creds := credentials.NewStaticCredentials(
+	if o.accessKey != "" && o.secretKey != "" {
+		// Options trump
+		config.Credentials = credentials.NewStaticCredentials(
+			o.accessKey,
+			o.secretKey,
+			o.sessionToken)
+	} else if o.profile == "" && os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		// Env is good, too, unless a profile was asked for
+		token := o.sessionToken
+		if token == "" {
+			token = os.Getenv("AWS_SESSION_TOKEN")
+		}
+		config.Credentials = credentials.NewStaticCredentials(
 			os.Getenv("AWS_ACCESS_KEY_ID"),
 			os.Getenv("AWS_SECRET_ACCESS_KEY"),
-			"")
-		config.Credentials = creds
+			token)
 	}
 
-	return session.NewSession(config)
-}
-
-// BucketToFile copies a file from an S3 bucket to a local file
-func (s *Session) BucketToFile(bucket, bucketPath, filename string) (size int64, err error) {
+	// Plumbing
+	if len(o.endpoints) > 0 {
+		config.EndpointResolver = o.endpointResolver()
+	}
+	if o.s3PathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	if o.httpClient != nil {
+		config.HTTPClient = o.httpClient
+	}
+	if o.maxRetries != nil {
+		config.MaxRetries = o.maxRetries
+	}
+	if o.logLevel != nil {
+		config.LogLevel = o.logLevel
+	}
 
-	// Open the file
-	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+	awsSession, err := session.NewSessionWithOptions(session.Options{
+		Config:                  *config,
+		Profile:                 o.profile,
+		SharedConfigState:       session.SharedConfigEnable,
+		AssumeRoleTokenProvider: o.mfaTokenFunc,
+	})
 	if err != nil {
-		return
+		return nil, err
+	}
+
+	if aws.StringValue(awsSession.Config.Region) == "" {
+		// Grab it from this EC2 instance, maybe
+		region, err := GetAwsRegionE()
+		if err != nil {
+			return nil, fmt.Errorf("cannot set AWS region: '%w'", err)
+		}
+		awsSession.Config.Region = aws.String(region)
 	}
-	defer file.Close()
 
-	downloader := s3manager.NewDownloader(s.AWS)
-	size, err = downloader.Download(file,
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(bucketPath),
+	if o.roleARN != "" {
+		// Swap in the assumed role
+		creds := stscreds.NewCredentials(awsSession, o.roleARN, func(p *stscreds.AssumeRoleProvider) {
+			if o.externalID != "" {
+				p.ExternalID = aws.String(o.externalID)
+			}
+			if o.mfaSerial != "" {
+				p.SerialNumber = aws.String(o.mfaSerial)
+				p.TokenProvider = o.mfaTokenFunc
+			}
 		})
+		awsSession = awsSession.Copy(&aws.Config{Credentials: creds})
+	}
 
-	return
+	return awsSession, nil
 }
 
-// getMe grabs the InstanceIdentityDocument for the running instance
-func (s *Session) getMe() (ec2metadata.EC2InstanceIdentityDocument, error) {
-	// {DevpayProductCodes:[] AvailabilityZone:us-east-1d PrivateIP:10.2.21.50 Version:2017-09-30
-	//  Region:us-east-1 InstanceID:i-032681bb83e1de5cf BillingProducts:[] InstanceType:t2.medium
-	//  AccountID:929091317894 PendingTime:2018-06-27 18:06:50 +0000 UTC ImageID:ami-55ef662f KernelID:
-	//  RamdiskID: Architecture:x86_64}
-	return ec2metadata.New(s.AWS).GetInstanceIdentityDocument()
+// BucketToFile copies a file from an S3 bucket to a local file. The download is atomic, replacing
+// the file only once complete, with the permissions DownloadFileMode. To write somewhere that can't
+// be replaced, such as os.Stdout, use S3Object.WriteTo.
+func (s *Session) BucketToFile(bucket, bucketPath, filename string) (size int64, err error) {
+
+	return s.bucketToFile(bucket, bucketPath, filename, "")
 }
 
 // GetInstanceAZByIP returns an Availability Zone or an error
@@ -224,14 +270,16 @@ func GetAwsRegion() (region string) {
 
 // GetAwsRegionE returns the region as a string and and error,
 // first consulting the well-known environment variables,
-// then falling back EC2 metadata calls
+// then falling back EC2 metadata calls, which give up after IdentityTimeout
 func GetAwsRegionE() (region string, err error) {
 
 	if os.Getenv("AWS_DEFAULT_REGION") != "" {
 		region = os.Getenv("AWS_DEFAULT_REGION")
 	} else {
 		// Grab it from this EC2 instace
-		region, err = ec2metadata.New(session.New()).Region()
+		ctx, cancel := context.WithTimeout(context.Background(), IdentityTimeout)
+		defer cancel()
+		region, err = ec2metadata.New(session.New()).RegionWithContext(ctx)
 	}
 	return
 }
@@ -0,0 +1,430 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+var (
+	// ErrNoDatapoints is returned when a metric query yields no datapoints
+	ErrNoDatapoints = errors.New("no datapoints returned")
+	// ErrNoStatistics is returned when a MetricQuery has neither Statistics nor ExtendedStatistics
+	ErrNoStatistics = errors.New("metric query has no statistics")
+	// ErrMetricData is returned (wrapped) when GetMetricData couldn't retrieve a statistic
+	ErrMetricData = errors.New("metric data unavailable")
+
+	// DefaultMetricPeriod is the Period used when a MetricQuery doesn't specify one
+	DefaultMetricPeriod = 60 * time.Second
+	// DefaultMetricWindow is how far back from End a MetricQuery looks if Start isn't specified
+	DefaultMetricWindow = 5 * time.Minute
+)
+
+// MaxMetricDataQueries is the most queries CloudWatch will accept in a single GetMetricData call
+const MaxMetricDataQueries = 500
+
+// MetricQuery describes a single CloudWatch metric, and the window and statistics
+// to retrieve for it
+type MetricQuery struct {
+	// Namespace is the metric namespace, e.g. "AWS/RDS". Required.
+	Namespace string
+	// MetricName is the name of the metric, e.g. "CPUUtilization". Required.
+	MetricName string
+	// Dimensions is a map of dimension names to values
+	Dimensions map[string]string
+	// Start is the beginning of the window. Defaults to End - DefaultMetricWindow.
+	Start time.Time
+	// End is the end of the window. Defaults to now.
+	End time.Time
+	// Period is the granularity of the returned datapoints. Defaults to DefaultMetricPeriod.
+	Period time.Duration
+	// Statistics are the standard statistics to retrieve, e.g. "Maximum", "Average"
+	Statistics []string
+	// ExtendedStatistics are the percentile statistics to retrieve, e.g. "p50", "p99"
+	ExtendedStatistics []string
+	// Unit optionally restricts the datapoints to the specified unit
+	Unit string
+}
+
+// MetricPoint is a single, typed, datapoint in a MetricSeries
+type MetricPoint struct {
+	Timestamp time.Time
+	Unit      string
+	// Values is a map of statistic names (standard or extended) to their values
+	Values map[string]float64
+}
+
+// MetricSeries is a list of MetricPoints, sorted by Timestamp, oldest first
+type MetricSeries []MetricPoint
+
+// Last returns the newest MetricPoint in the series, or nil if the series is empty
+func (m MetricSeries) Last() *MetricPoint {
+	if len(m) == 0 {
+		return nil
+	}
+	return &m[len(m)-1]
+}
+
+// dimensions returns the CloudWatch Dimensions for the query, sorted by name
+func (q *MetricQuery) dimensions() []*cloudwatch.Dimension {
+	return dimensionsFromMap(q.Dimensions)
+}
+
+// dimensionNames returns the names of the dimensions in the map, sorted
+func dimensionNames(dimensions map[string]string) []string {
+	names := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dimensionsFromMap returns CloudWatch Dimensions for the map of names to values, sorted by name
+func dimensionsFromMap(dimensions map[string]string) []*cloudwatch.Dimension {
+	names := dimensionNames(dimensions)
+
+	dims := make([]*cloudwatch.Dimension, 0, len(names))
+	for _, name := range names {
+		dims = append(dims, &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(dimensions[name]),
+		})
+	}
+	return dims
+}
+
+// window returns the start, end and period for the query, with defaults applied
+func (q *MetricQuery) window() (start, end time.Time, period time.Duration) {
+	return q.windowAt(time.Now())
+}
+
+// windowAt returns the start, end and period for the query, with defaults applied
+// relative to now
+func (q *MetricQuery) windowAt(now time.Time) (start, end time.Time, period time.Duration) {
+	end = q.End
+	if end.IsZero() {
+		end = now
+	}
+	start = q.Start
+	if start.IsZero() {
+		start = end.Add(-DefaultMetricWindow)
+	}
+	period = q.Period
+	if period <= 0 {
+		period = DefaultMetricPeriod
+	}
+	return
+}
+
+// QueryMetric retrieves the datapoints described by the MetricQuery, returning a
+// time-sorted MetricSeries or an error
+func (s *Session) QueryMetric(q *MetricQuery) (MetricSeries, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	svc := cloudwatch.New(s.AWS)
+
+	start, end, period := q.window()
+	params := &cloudwatch.GetMetricStatisticsInput{
+		EndTime:    aws.Time(end),
+		MetricName: aws.String(q.MetricName),
+		Namespace:  aws.String(q.Namespace),
+		Period:     aws.Int64(int64(period.Seconds())),
+		StartTime:  aws.Time(start),
+		Dimensions: q.dimensions(),
+	}
+	if len(q.Statistics) > 0 {
+		params.Statistics = aws.StringSlice(q.Statistics)
+	}
+	if len(q.ExtendedStatistics) > 0 {
+		params.ExtendedStatistics = aws.StringSlice(q.ExtendedStatistics)
+	}
+	if q.Unit != "" {
+		params.Unit = aws.String(q.Unit)
+	}
+
+	resp, err := svc.GetMetricStatistics(params)
+	if err != nil {
+		return nil, err
+	}
+
+	series := make(MetricSeries, 0, len(resp.Datapoints))
+	for _, d := range resp.Datapoints {
+		series = append(series, datapointToMetricPoint(d))
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].Timestamp.Before(series[j].Timestamp)
+	})
+
+	return series, nil
+}
+
+// datapointToMetricPoint converts a CloudWatch Datapoint into a MetricPoint
+func datapointToMetricPoint(d *cloudwatch.Datapoint) MetricPoint {
+	p := MetricPoint{
+		Timestamp: aws.TimeValue(d.Timestamp),
+		Unit:      aws.StringValue(d.Unit),
+		Values:    make(map[string]float64),
+	}
+
+	for stat, v := range map[string]*float64{
+		cloudwatch.StatisticAverage:     d.Average,
+		cloudwatch.StatisticMaximum:     d.Maximum,
+		cloudwatch.StatisticMinimum:     d.Minimum,
+		cloudwatch.StatisticSampleCount: d.SampleCount,
+		cloudwatch.StatisticSum:         d.Sum,
+	} {
+		if v != nil {
+			p.Values[stat] = *v
+		}
+	}
+	for stat, v := range d.ExtendedStatistics {
+		if v != nil {
+			p.Values[stat] = *v
+		}
+	}
+
+	return p
+}
+
+// Datapoint converts the MetricPoint back into a CloudWatch Datapoint
+func (p *MetricPoint) Datapoint() *cloudwatch.Datapoint {
+	d := cloudwatch.Datapoint{
+		Timestamp: aws.Time(p.Timestamp),
+		Unit:      aws.String(p.Unit),
+	}
+
+	for stat, v := range p.Values {
+		v := v
+		switch stat {
+		case cloudwatch.StatisticAverage:
+			d.Average = &v
+		case cloudwatch.StatisticMaximum:
+			d.Maximum = &v
+		case cloudwatch.StatisticMinimum:
+			d.Minimum = &v
+		case cloudwatch.StatisticSampleCount:
+			d.SampleCount = &v
+		case cloudwatch.StatisticSum:
+			d.Sum = &v
+		default:
+			if d.ExtendedStatistics == nil {
+				d.ExtendedStatistics = make(map[string]*float64)
+			}
+			d.ExtendedStatistics[stat] = &v
+		}
+	}
+
+	return &d
+}
+
+// QueryMetrics retrieves the datapoints for many MetricQuerys at once using as few
+// GetMetricData calls as possible, returning a MetricSeries for each query, in the same
+// order, or an error. Queries sharing a window (including the default window) are batched
+// together, up to MaxMetricDataQueries statistics per call. Statistics CloudWatch couldn't
+// retrieve, e.g. because access was denied, are returned as errors wrapping ErrMetricData.
+func (s *Session) QueryMetrics(queries []*MetricQuery) ([]MetricSeries, error) {
+	for _, q := range queries {
+		if err := q.validate(); err != nil {
+			return nil, err
+		}
+	}
+	svc := cloudwatch.New(s.AWS)
+
+	type statRef struct {
+		query int
+		stat  string
+	}
+	type window struct {
+		start, end time.Time
+	}
+
+	var (
+		now     = time.Now()
+		refs    = make(map[string]statRef)
+		batches = make(map[window][]*cloudwatch.MetricDataQuery)
+		order   []window
+		points  = make([]map[int64]*MetricPoint, len(queries))
+	)
+
+	// Explode each query into one MetricDataQuery per statistic,
+	// grouped by window
+	for i, q := range queries {
+		points[i] = make(map[int64]*MetricPoint)
+
+		start, end, period := q.windowAt(now)
+		w := window{start, end}
+		if _, ok := batches[w]; !ok {
+			order = append(order, w)
+			batches[w] = nil
+		}
+
+		for j, stat := range q.statistics() {
+			id := fmt.Sprintf("q%d_%d", i, j)
+			refs[id] = statRef{i, stat}
+
+			mstat := &cloudwatch.MetricStat{
+				Metric: &cloudwatch.Metric{
+					Namespace:  aws.String(q.Namespace),
+					MetricName: aws.String(q.MetricName),
+					Dimensions: q.dimensions(),
+				},
+				Period: aws.Int64(int64(period.Seconds())),
+				Stat:   aws.String(stat),
+			}
+			if q.Unit != "" {
+				mstat.Unit = aws.String(q.Unit)
+			}
+			batches[w] = append(batches[w], &cloudwatch.MetricDataQuery{
+				Id:         aws.String(id),
+				MetricStat: mstat,
+				ReturnData: aws.Bool(true),
+			})
+		}
+	}
+
+	for _, w := range order {
+		mdqs := batches[w]
+		for len(mdqs) > 0 {
+			n := min(len(mdqs), MaxMetricDataQueries)
+			chunk := mdqs[:n]
+			mdqs = mdqs[n:]
+
+			params := &cloudwatch.GetMetricDataInput{
+				StartTime:         aws.Time(w.start),
+				EndTime:           aws.Time(w.end),
+				MetricDataQueries: chunk,
+			}
+			var dataErr error
+			err := svc.GetMetricDataPages(params, func(page *cloudwatch.GetMetricDataOutput, lastPage bool) bool {
+				for _, r := range page.MetricDataResults {
+					ref, ok := refs[aws.StringValue(r.Id)]
+					if !ok {
+						continue
+					}
+					if dataErr = metricDataError(queries[ref.query], ref.stat, r); dataErr != nil {
+						return false
+					}
+					for k := range r.Timestamps {
+						if k >= len(r.Values) {
+							break
+						}
+						ts := aws.TimeValue(r.Timestamps[k])
+						p, ok := points[ref.query][ts.UnixNano()]
+						if !ok {
+							p = &MetricPoint{
+								Timestamp: ts,
+								Unit:      queries[ref.query].Unit,
+								Values:    make(map[string]float64),
+							}
+							points[ref.query][ts.UnixNano()] = p
+						}
+						p.Values[ref.stat] = aws.Float64Value(r.Values[k])
+					}
+				}
+				return true
+			})
+			if err == nil {
+				err = dataErr
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	results := make([]MetricSeries, len(queries))
+	for i := range queries {
+		series := make(MetricSeries, 0, len(points[i]))
+		for _, p := range points[i] {
+			series = append(series, *p)
+		}
+		sort.Slice(series, func(a, b int) bool {
+			return series[a].Timestamp.Before(series[b].Timestamp)
+		})
+		results[i] = series
+	}
+
+	return results, nil
+}
+
+// statistics returns all of the standard and extended statistics for the query
+func (q *MetricQuery) statistics() []string {
+	stats := make([]string, 0, len(q.Statistics)+len(q.ExtendedStatistics))
+	stats = append(stats, q.Statistics...)
+	return append(stats, q.ExtendedStatistics...)
+}
+
+// listMetrics ...
+func (s *Session) listMetrics(dimensionName, dimensionValue, namespace string) (resp *cloudwatch.ListMetricsOutput, err error) {
+	svc := cloudwatch.New(s.AWS)
+	params := &cloudwatch.ListMetricsInput{
+		Dimensions: []*cloudwatch.DimensionFilter{
+			{
+				Name:  aws.String(dimensionName), // Required
+				Value: aws.String(dimensionValue),
+			},
+		},
+		Namespace: aws.String(namespace),
+	}
+	resp, err = svc.ListMetrics(params)
+
+	return
+}
+
+// GetLastCloudWatchValue returns the most recent datapoint for the specified metric
+// over the last DefaultMetricWindow, or an error. If there are no datapoints,
+// point will be nil.
+func (s *Session) GetLastCloudWatchValue(dimensionName, dimensionValue, namespace, metric, stat, unit string) (point *cloudwatch.Datapoint, err error) {
+	return s.lastDatapoint(&MetricQuery{
+		Namespace:  namespace,
+		MetricName: metric,
+		Dimensions: map[string]string{dimensionName: dimensionValue},
+		Statistics: []string{stat},
+		Unit:       unit,
+	})
+}
+
+// lastDatapoint runs the query, and returns the newest result as a Datapoint,
+// or nil if there aren't any
+func (s *Session) lastDatapoint(q *MetricQuery) (point *cloudwatch.Datapoint, err error) {
+	series, err := s.QueryMetric(q)
+	if err != nil {
+		return
+	}
+	if last := series.Last(); last != nil {
+		point = last.Datapoint()
+	}
+	return
+}
+
+// validate returns ErrNoStatistics if the query has no statistics
+func (q *MetricQuery) validate() error {
+	if len(q.Statistics) == 0 && len(q.ExtendedStatistics) == 0 {
+		return fmt.Errorf("%w: %s/%s", ErrNoStatistics, q.Namespace, q.MetricName)
+	}
+	return nil
+}
+
+// metricDataError returns an error wrapping ErrMetricData if the result for the query's
+// statistic failed, or came with messages, or nil
+func metricDataError(q *MetricQuery, stat string, r *cloudwatch.MetricDataResult) error {
+	var messages []string
+	for _, m := range r.Messages {
+		messages = append(messages, fmt.Sprintf("%s: %s", aws.StringValue(m.Code), aws.StringValue(m.Value)))
+	}
+
+	switch status := aws.StringValue(r.StatusCode); {
+	case status == cloudwatch.StatusCodeForbidden, status == cloudwatch.StatusCodeInternalError:
+		messages = append([]string{status}, messages...)
+	case len(messages) == 0:
+		return nil
+	}
+	return fmt.Errorf("%w: %s/%s %s: %s", ErrMetricData, q.Namespace, q.MetricName, stat, strings.Join(messages, "; "))
+}
@@ -0,0 +1,230 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// fakeCloudWatch is a local stand-in for the CloudWatch and RDS query APIs. GetMetricData
+// returns a datapoint for each query with a value, keyed by metric name and first dimension
+// value, pageSize results to a page. PutMetricData records the datums, unless failPut, and
+// DescribeDBInstances describes the instances, filtered by db-instance-id.
+type fakeCloudWatch struct {
+	mu        sync.Mutex
+	values    map[string]float64
+	instances map[string]int64
+	pageSize  int
+	failPut   int
+	// calls counts the requests for each action, and queries the queries in each GetMetricData call
+	calls   map[string]int
+	queries []int
+	filters [][]string
+	put     []putDatum
+}
+
+// putDatum is a datum sent to fakeCloudWatch's PutMetricData, by name and dimension values
+type putDatum struct {
+	Namespace string
+	Name      string
+	Unit      string
+	Dims      string
+	Value     float64
+	Stats     string
+}
+
+// newFakeCloudWatch starts a fakeCloudWatch, returning it and a Session using it
+func newFakeCloudWatch(t *testing.T) (*fakeCloudWatch, *Session) {
+	t.Helper()
+	f := &fakeCloudWatch{
+		values:    make(map[string]float64),
+		instances: make(map[string]int64),
+		pageSize:  100,
+		calls:     make(map[string]int),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, newTestSession(t, WithEndpoint("*", srv.URL))
+}
+
+// members returns the values of the numbered form fields prefix.1<suffix>, prefix.2<suffix>, ...
+func members(r *http.Request, prefix, suffix string) (values []string) {
+	for i := 1; ; i++ {
+		v, ok := r.PostForm[fmt.Sprintf("%s.%d%s", prefix, i, suffix)]
+		if !ok {
+			return
+		}
+		values = append(values, v[0])
+	}
+}
+
+func (f *fakeCloudWatch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	action := r.PostForm.Get("Action")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[action]++
+
+	switch action {
+	case "GetMetricData":
+		const q = "MetricDataQueries.member"
+		var (
+			ids     = members(r, q, ".Id")
+			names   = members(r, q, ".MetricStat.Metric.MetricName")
+			ts      = time.Now().UTC().Truncate(time.Minute).Format(time.RFC3339)
+			results = make([]string, len(ids))
+		)
+		if r.PostForm.Get("NextToken") == "" {
+			f.queries = append(f.queries, len(ids))
+		}
+		for i, id := range ids {
+			dim := r.PostForm.Get(fmt.Sprintf("%s.%d.MetricStat.Metric.Dimensions.member.1.Value", q, i+1))
+			results[i] = fmt.Sprintf("<member><Id>%s</Id><StatusCode>Complete</StatusCode>", id)
+			if v, ok := f.values[names[i]+"/"+dim]; ok {
+				results[i] += fmt.Sprintf("<Timestamps><member>%s</member></Timestamps><Values><member>%g</member></Values>", ts, v)
+			}
+			results[i] += "</member>"
+		}
+
+		start, _ := strconv.Atoi(r.PostForm.Get("NextToken"))
+		end := min(start+f.pageSize, len(results))
+		fmt.Fprint(w, `<GetMetricDataResponse><GetMetricDataResult><MetricDataResults>`)
+		fmt.Fprint(w, strings.Join(results[start:end], ""))
+		fmt.Fprint(w, `</MetricDataResults>`)
+		if end < len(results) {
+			fmt.Fprintf(w, `<NextToken>%d</NextToken>`, end)
+		}
+		fmt.Fprint(w, `</GetMetricDataResult></GetMetricDataResponse>`)
+
+	case "PutMetricData":
+		if f.failPut > 0 {
+			f.failPut--
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<ErrorResponse><Error><Code>InvalidParameterValue</Code><Message>failing</Message></Error></ErrorResponse>`)
+			return
+		}
+		const m = "MetricData.member"
+		for i := range members(r, m, ".MetricName") {
+			get := func(field string) string {
+				return r.PostForm.Get(fmt.Sprintf("%s.%d.%s", m, i+1, field))
+			}
+			d := putDatum{
+				Namespace: r.PostForm.Get("Namespace"),
+				Name:      get("MetricName"),
+				Unit:      get("Unit"),
+				Dims:      strings.Join(members(r, fmt.Sprintf("%s.%d.Dimensions.member", m, i+1), ".Value"), ","),
+			}
+			if sum := get("StatisticValues.Sum"); sum != "" {
+				d.Stats = fmt.Sprintf("min=%s max=%s sum=%s n=%s", get("StatisticValues.Minimum"), get("StatisticValues.Maximum"), sum, get("StatisticValues.SampleCount"))
+			} else {
+				d.Value, _ = strconv.ParseFloat(get("Value"), 64)
+			}
+			f.put = append(f.put, d)
+		}
+		fmt.Fprint(w, `<PutMetricDataResponse></PutMetricDataResponse>`)
+
+	case "DescribeDBInstances":
+		var want []string
+		if id := r.PostForm.Get("DBInstanceIdentifier"); id != "" {
+			want = []string{id}
+		} else {
+			want = members(r, "Filters.Filter.1.Values.Value", "")
+			f.filters = append(f.filters, want)
+		}
+		fmt.Fprint(w, `<DescribeDBInstancesResponse><DescribeDBInstancesResult><DBInstances>`)
+		for _, id := range want {
+			if gb, ok := f.instances[id]; ok {
+				fmt.Fprintf(w, `<DBInstance><DBInstanceIdentifier>%s</DBInstanceIdentifier><AllocatedStorage>%d</AllocatedStorage></DBInstance>`, id, gb)
+			}
+		}
+		fmt.Fprint(w, `</DBInstances></DescribeDBInstancesResult></DescribeDBInstancesResponse>`)
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `<ErrorResponse><Error><Code>InvalidAction</Code><Message>%s</Message></Error></ErrorResponse>`, action)
+	}
+}
+
+func TestQueryMetricsBatching(t *testing.T) {
+	f, s := newFakeCloudWatch(t)
+	f.pageSize = 70
+
+	// Two statistics each, so more than one call's worth of queries
+	queries := make([]*MetricQuery, MaxMetricDataQueries/2+10)
+	for i := range queries {
+		id := fmt.Sprintf("i-%d", i)
+		queries[i] = &MetricQuery{
+			Namespace:  "AWS/EC2",
+			MetricName: "CPUUtilization",
+			Dimensions: map[string]string{"InstanceId": id},
+			Statistics: []string{cloudwatch.StatisticMaximum, cloudwatch.StatisticAverage},
+		}
+		if i%3 != 0 {
+			f.values["CPUUtilization/"+id] = float64(i)
+		}
+	}
+
+	results, err := s.QueryMetrics(queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(queries) {
+		t.Fatalf("got %d results, want %d", len(results), len(queries))
+	}
+	for i, series := range results {
+		last := series.Last()
+		if i%3 == 0 {
+			if last != nil {
+				t.Errorf("query %d got %v, want no datapoints", i, last)
+			}
+			continue
+		}
+		if last == nil {
+			t.Fatalf("query %d got no datapoints", i)
+		}
+		for _, stat := range []string{cloudwatch.StatisticMaximum, cloudwatch.StatisticAverage} {
+			if last.Values[stat] != float64(i) {
+				t.Errorf("query %d %s is %v, want %d", i, stat, last.Values[stat], i)
+			}
+		}
+	}
+
+	want := []int{MaxMetricDataQueries, 2*len(queries) - MaxMetricDataQueries}
+	if fmt.Sprint(f.queries) != fmt.Sprint(want) {
+		t.Errorf("GetMetricData called with %v queries, want %v", f.queries, want)
+	}
+	if pages := (MaxMetricDataQueries+69)/70 + (want[1]+69)/70; f.calls["GetMetricData"] != pages {
+		t.Errorf("GetMetricData called %d times, want %d pages", f.calls["GetMetricData"], pages)
+	}
+}
+
+func TestQueryMetricsWindows(t *testing.T) {
+	f, s := newFakeCloudWatch(t)
+	end := time.Now().Truncate(time.Minute)
+
+	queries := []*MetricQuery{
+		{Namespace: "AWS/EC2", MetricName: "A", Statistics: []string{cloudwatch.StatisticSum}},
+		{Namespace: "AWS/EC2", MetricName: "B", Statistics: []string{cloudwatch.StatisticSum}, End: end},
+		{Namespace: "AWS/EC2", MetricName: "C", Statistics: []string{cloudwatch.StatisticSum}},
+	}
+	if _, err := s.QueryMetrics(queries); err != nil {
+		t.Fatal(err)
+	}
+	// The default windows are batched together
+	if want := "[2 1]"; fmt.Sprint(f.queries) != want {
+		t.Errorf("GetMetricData called with %v queries, want %s", f.queries, want)
+	}
+
+	if _, err := s.QueryMetrics([]*MetricQuery{{Namespace: "AWS/EC2", MetricName: "A"}}); !errors.Is(err, ErrNoStatistics) {
+		t.Errorf("got error %v, want %v", err, ErrNoStatistics)
+	}
+}
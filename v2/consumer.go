@@ -0,0 +1,374 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// Message is a received SQS message
+type Message struct {
+	ID                string
+	Body              string
+	ReceiptHandle     string
+	Attributes        map[string]string
+	MessageAttributes map[string]*sqs.MessageAttributeValue
+	// Raw is the message as received
+	Raw *sqs.Message
+}
+
+// Handler processes a Message. If it returns nil, the message is deleted from the queue.
+// Otherwise the message becomes visible again once its visibility timeout expires.
+type Handler func(ctx context.Context, m *Message) error
+
+// Consumer long-polls an SQS queue, handing messages to a pool of workers. Messages
+// are kept invisible while being handled, and deleted in batches once handled successfully.
+// Messages from the same FIFO message group are handled one at a time, in order, and once
+// one fails the group's later messages in the batch are left to be received again.
+// Change the exported fields, if desired, before calling Run.
+type Consumer struct {
+	// Workers is the number of concurrent Handler calls. Default 1.
+	Workers int
+	// WaitTime is the long-polling wait. Default (and maximum) 20s.
+	WaitTime time.Duration
+	// VisibilityTimeout is how long received messages are hidden, and is re-upped
+	// every HeartbeatInterval while a Handler is running. Default 30s.
+	VisibilityTimeout time.Duration
+	// HeartbeatInterval is how often the visibility timeout is extended. Default VisibilityTimeout/2.
+	HeartbeatInterval time.Duration
+	// DeleteInterval is the longest a handled message waits to be batch-deleted. Default 1s.
+	DeleteInterval time.Duration
+	// KeepPayloads leaves the S3 payloads of pointer messages (see Producer) in place once the
+	// messages are deleted. By default they're deleted too, as the SQS extended clients do.
+	KeepPayloads bool
+
+	handler Handler
+	session *Session
+	sqs     sqsiface.SQSAPI
+	qurl    string
+	mu      sync.Mutex
+	lasterr error
+}
+
+// NewConsumer returns a Consumer for the specified queue, or an error if the queue URL
+// can't be resolved
+func (s *Session) NewConsumer(queue string, handler Handler) (*Consumer, error) {
+	qurl, err := s.SQS_GetQueueUrl(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.NewConsumerWithClient(sqs.New(s.AWS), qurl, handler), nil
+}
+
+// NewConsumerWithClient returns a Consumer for the specified queue URL, using the SQS client,
+// such as a stand-in for testing. The Session is still used for the S3 payloads of pointer messages.
+func (s *Session) NewConsumerWithClient(client sqsiface.SQSAPI, queueURL string, handler Handler) *Consumer {
+	return &Consumer{
+		Workers:           1,
+		WaitTime:          20 * time.Second,
+		VisibilityTimeout: 30 * time.Second,
+		DeleteInterval:    time.Second,
+		handler:           handler,
+		session:           s,
+		sqs:               client,
+		qurl:              queueURL,
+	}
+}
+
+// Run consumes messages until the context is cancelled, or receiving fails with an error
+// that isn't retryable, then waits for in-flight Handlers to finish and their messages to be
+// deleted before returning that error, or the context's. Messages are only received when
+// there are idle workers to handle them, and each FIFO message group in a batch is handed
+// to a single worker. Handlers are passed a context that carries the
+// values of, but is not cancelled with, ctx.
+func (c *Consumer) Run(ctx context.Context) error {
+	if c.Workers < 1 {
+		c.Workers = 1
+	}
+	if c.WaitTime <= 0 || c.WaitTime > 20*time.Second {
+		c.WaitTime = 20 * time.Second
+	}
+	if c.VisibilityTimeout <= 0 {
+		c.VisibilityTimeout = 30 * time.Second
+	}
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = c.VisibilityTimeout / 2
+	}
+	if c.DeleteInterval <= 0 {
+		c.DeleteInterval = time.Second
+	}
+
+	var (
+		jobs      = make(chan []*Message, c.Workers)
+		idle      = make(chan struct{}, c.Workers)
+		deletes   = make(chan *Message, c.Workers)
+		workers   sync.WaitGroup
+		deleterWG sync.WaitGroup
+		hctx      = context.WithoutCancel(ctx)
+	)
+
+	deleterWG.Add(1)
+	go func() {
+		defer deleterWG.Done()
+		c.deleter(deletes)
+	}()
+
+	for i := 0; i < c.Workers; i++ {
+		idle <- struct{}{}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for group := range jobs {
+				c.handleGroup(hctx, group, deletes)
+				idle <- struct{}{}
+			}
+		}()
+	}
+
+	err := c.receive(ctx, jobs, idle)
+
+	close(jobs)
+	workers.Wait()
+	close(deletes)
+	deleterWG.Wait()
+
+	return err
+}
+
+// LastError returns the last error encountered while consuming
+func (c *Consumer) LastError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lasterr
+}
+
+// setError records and logs an error
+func (c *Consumer) setError(err error) {
+	DebugOut.Printf("Consumer %s: %s\n", c.qurl, err)
+	c.mu.Lock()
+	c.lasterr = err
+	c.mu.Unlock()
+}
+
+// receive long-polls the queue for as many messages as there are idle workers, feeding jobs
+// until the context is cancelled or a receive fails with an error that isn't retryable
+func (c *Consumer) receive(ctx context.Context, jobs chan<- []*Message, idle chan struct{}) error {
+	for {
+		// Wait for an idle worker, then claim any others, up to the SQS maximum
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		batch := 1
+		for ; batch < 10 && len(idle) > 0; batch++ {
+			<-idle
+		}
+		unclaim := func(n int) {
+			for ; n > 0; n-- {
+				idle <- struct{}{}
+			}
+		}
+
+		resp, err := c.sqs.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(c.qurl),
+			MaxNumberOfMessages:   aws.Int64(int64(batch)),
+			WaitTimeSeconds:       aws.Int64(int64(c.WaitTime.Seconds())),
+			VisibilityTimeout:     aws.Int64(int64(c.VisibilityTimeout.Seconds())),
+			AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+			MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		})
+		if err != nil {
+			unclaim(batch)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			c.setError(err)
+			if !request.IsErrorRetryable(err) && !request.IsErrorThrottle(err) {
+				return err
+			}
+			// Don't hammer a failing endpoint
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		// Each group has a claimed worker, so this never blocks
+		groups := groupMessages(resp.Messages)
+		for _, group := range groups {
+			jobs <- group
+		}
+		unclaim(batch - len(groups))
+	}
+}
+
+// groupMessages returns the messages in received order, each on its own unless it's from
+// a FIFO message group, when it's with the rest of the group's messages
+func groupMessages(messages []*sqs.Message) (groups [][]*Message) {
+	byGroup := make(map[string]int)
+	for _, raw := range messages {
+		m := newMessage(raw)
+		id, ok := m.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]
+		if !ok {
+			groups = append(groups, []*Message{m})
+			continue
+		}
+		if i, ok := byGroup[id]; ok {
+			groups[i] = append(groups[i], m)
+			continue
+		}
+		byGroup[id] = len(groups)
+		groups = append(groups, []*Message{m})
+	}
+	return
+}
+
+// handleGroup handles the messages in order, heartbeating the visibility of those waiting
+// their turn too. Once one fails, the rest are left alone, to be received again in order
+// once their visibility timeouts expire.
+func (c *Consumer) handleGroup(ctx context.Context, group []*Message, deletes chan<- *Message) {
+	done := make([]chan struct{}, len(group))
+	for i, m := range group {
+		done[i] = make(chan struct{})
+		go c.heartbeat(m.ReceiptHandle, done[i])
+	}
+
+	failed := false
+	for i, m := range group {
+		if failed {
+			DebugOut.Printf("Consumer %s: skipping message %s after an earlier failure in its group\n", c.qurl, m.ID)
+		} else {
+			failed = !c.handle(ctx, m, deletes)
+		}
+		close(done[i])
+	}
+}
+
+// handle runs the Handler for the Message, and queues it for deletion on success, returning
+// whether it succeeded. Pointers to offloaded payloads are resolved first.
+func (c *Consumer) handle(ctx context.Context, m *Message, deletes chan<- *Message) bool {
+	err := c.session.ResolveMessage(m)
+	if err == nil {
+		err = c.handler(ctx, m)
+	}
+
+	if err != nil {
+		c.setError(fmt.Errorf("handler error on message %s: %w", m.ID, err))
+		return false
+	}
+	deletes <- m
+	return true
+}
+
+// heartbeat extends the visibility timeout of the receipt handle every HeartbeatInterval, until done is closed
+func (c *Consumer) heartbeat(receiptHandle string, done <-chan struct{}) {
+	ticker := time.NewTicker(c.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			_, err := c.sqs.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          aws.String(c.qurl),
+				ReceiptHandle:     aws.String(receiptHandle),
+				VisibilityTimeout: aws.Int64(int64(c.VisibilityTimeout.Seconds())),
+			})
+			if err != nil {
+				c.setError(err)
+			}
+		}
+	}
+}
+
+// deleter batch-deletes messages, every DeleteInterval or when there are 10, until deletes is closed
+func (c *Consumer) deleter(deletes <-chan *Message) {
+	var (
+		batch  []*Message
+		ticker = time.NewTicker(c.DeleteInterval)
+	)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case m, ok := <-deletes:
+			if !ok {
+				c.deleteBatch(batch)
+				return
+			}
+			batch = append(batch, m)
+			if len(batch) < 10 {
+				continue
+			}
+		case <-ticker.C:
+		}
+		c.deleteBatch(batch)
+		batch = nil
+	}
+}
+
+// deleteBatch deletes up to 10 messages, then the payloads of any pointer messages, unless KeepPayloads
+func (c *Consumer) deleteBatch(batch []*Message) {
+	if len(batch) == 0 {
+		return
+	}
+
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(batch))
+	for i, m := range batch {
+		entries[i] = &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(fmt.Sprintf("m%d", i)),
+			ReceiptHandle: aws.String(m.ReceiptHandle),
+		}
+	}
+
+	resp, err := c.sqs.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(c.qurl),
+		Entries:  entries,
+	})
+	if err != nil {
+		c.setError(err)
+		return
+	}
+	for _, f := range resp.Failed {
+		c.setError(fmt.Errorf("delete failed: %s %s", aws.StringValue(f.Code), aws.StringValue(f.Message)))
+	}
+
+	if c.KeepPayloads {
+		return
+	}
+	byID := make(map[string]*Message, len(batch))
+	for i, e := range entries {
+		byID[aws.StringValue(e.Id)] = batch[i]
+	}
+	for _, s := range resp.Successful {
+		if m, ok := byID[aws.StringValue(s.Id)]; ok {
+			if err := c.session.DeletePayload(m); err != nil {
+				c.setError(fmt.Errorf("deleting payload of message %s: %w", m.ID, err))
+			}
+		}
+	}
+}
+
+// newMessage returns a Message from an sqs.Message
+func newMessage(m *sqs.Message) *Message {
+	msg := Message{
+		ID:                aws.StringValue(m.MessageId),
+		Body:              aws.StringValue(m.Body),
+		ReceiptHandle:     aws.StringValue(m.ReceiptHandle),
+		Attributes:        aws.StringValueMap(m.Attributes),
+		MessageAttributes: m.MessageAttributes,
+		Raw:               m,
+	}
+	return &msg
+}
@@ -0,0 +1,427 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// fakeSQS is an in-memory stand-in for an SQS queue. Received messages are hidden until
+// their visibility timeout expires, and for a FIFO queue, messages of a group aren't received
+// while an earlier one is in flight. Sending a message whose body is in fail fails, that many
+// times, and sending one whose body starts with "invalid", or that has an "invalid" message
+// attribute, always fails, as the sender's fault.
+// FIFO messages need a group and deduplication ID, and duplicates are accepted but dropped.
+// Messages sent to the URL of one of others go to it instead, and others' queue URLs can be
+// looked up by name. Unimplemented calls panic.
+type fakeSQS struct {
+	sqsiface.SQSAPI
+
+	mu       sync.Mutex
+	fifo     bool
+	messages []*fakeMessage
+	seq      int
+	fail     map[string]int
+	dedup    map[string]bool
+	others   map[string]*fakeSQS
+	// sources are the queue URLs ListDeadLetterSourceQueues returns
+	sources []string
+	// deleted lists the bodies of deleted messages, in order, and visibility counts visibility changes
+	deleted    []string
+	visibility int
+	// batches and singles count the SendMessageBatch and SendMessage calls
+	batches int
+	singles int
+}
+
+// fakeMessage is a message in a fakeSQS queue
+type fakeMessage struct {
+	msg     *sqs.Message
+	group   string
+	hidden  time.Time
+	receipt string
+}
+
+// newFakeSQS returns an empty fakeSQS
+func newFakeSQS(fifo bool) *fakeSQS {
+	return &fakeSQS{fifo: fifo, fail: make(map[string]int), dedup: make(map[string]bool), others: make(map[string]*fakeSQS)}
+}
+
+// add queues a message with the body, in the group if it isn't empty, returning it so its
+// attributes can be set
+func (f *fakeSQS) add(body, group string) *sqs.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	m := &fakeMessage{
+		msg: &sqs.Message{
+			MessageId:  aws.String(fmt.Sprintf("id-%d", f.seq)),
+			Body:       aws.String(body),
+			Attributes: map[string]*string{},
+		},
+		group: group,
+	}
+	if group != "" {
+		m.msg.Attributes[sqs.MessageSystemAttributeNameMessageGroupId] = aws.String(group)
+	}
+	f.messages = append(f.messages, m)
+	return m.msg
+}
+
+// send queues a sent message, returning its ID, or the error code and whether it was the sender's fault
+func (f *fakeSQS) send(body, group, dedup *string, attrs map[string]*sqs.MessageAttributeValue) (id, code string, senderFault bool) {
+	if _, ok := attrs["invalid"]; ok || strings.HasPrefix(aws.StringValue(body), "invalid") {
+		return "", "InvalidParameterValue", true
+	}
+	if f.fail[aws.StringValue(body)] > 0 {
+		f.fail[aws.StringValue(body)]--
+		return "", "InternalError", false
+	}
+	if f.fifo && (group == nil || dedup == nil) {
+		return "", "MissingParameter", true
+	}
+
+	f.seq++
+	id = fmt.Sprintf("id-%d", f.seq)
+	if f.fifo && f.dedup[aws.StringValue(dedup)] {
+		return
+	}
+	m := &fakeMessage{
+		msg: &sqs.Message{
+			MessageId:         aws.String(id),
+			Body:              body,
+			Attributes:        map[string]*string{},
+			MessageAttributes: attrs,
+		},
+		group: aws.StringValue(group),
+	}
+	if f.fifo {
+		f.dedup[aws.StringValue(dedup)] = true
+		m.msg.Attributes[sqs.MessageSystemAttributeNameMessageGroupId] = group
+		m.msg.Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId] = dedup
+	}
+	f.messages = append(f.messages, m)
+	return
+}
+
+// queued returns the messages in the queue
+func (f *fakeSQS) queued() (messages []*sqs.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, m := range f.messages {
+		messages = append(messages, m.msg)
+	}
+	return
+}
+
+// deletedBodies returns the bodies of the deleted messages
+func (f *fakeSQS) deletedBodies() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.deleted...)
+}
+
+// find returns the message with the receipt handle, or nil
+func (f *fakeSQS) find(receipt string) *fakeMessage {
+	for _, m := range f.messages {
+		if m.receipt != "" && m.receipt == receipt {
+			return m
+		}
+	}
+	return nil
+}
+
+func (f *fakeSQS) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, _ ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	f.mu.Lock()
+	var (
+		out      sqs.ReceiveMessageOutput
+		now      = time.Now()
+		inflight = make(map[string]bool)
+	)
+	for _, m := range f.messages {
+		if len(out.Messages) == int(aws.Int64Value(in.MaxNumberOfMessages)) {
+			break
+		}
+		if m.hidden.After(now) {
+			inflight[m.group] = true
+			continue
+		}
+		if f.fifo && m.group != "" && inflight[m.group] {
+			continue
+		}
+		f.seq++
+		m.receipt = fmt.Sprintf("receipt-%d", f.seq)
+		m.hidden = now.Add(time.Duration(aws.Int64Value(in.VisibilityTimeout)) * time.Second)
+		out.Messages = append(out.Messages, &sqs.Message{
+			MessageId:         m.msg.MessageId,
+			Body:              m.msg.Body,
+			Attributes:        m.msg.Attributes,
+			MessageAttributes: m.msg.MessageAttributes,
+			ReceiptHandle:     aws.String(m.receipt),
+		})
+	}
+	f.mu.Unlock()
+
+	if len(out.Messages) == 0 {
+		// A short long-poll
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return &out, nil
+}
+
+func (f *fakeSQS) SendMessageBatch(in *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batches++
+	if len(in.Entries) > MaxSQSBatch {
+		return nil, errors.New("TooManyEntriesInBatchRequest")
+	}
+	var out sqs.SendMessageBatchOutput
+	for _, e := range in.Entries {
+		id, code, senderFault := f.send(e.MessageBody, e.MessageGroupId, e.MessageDeduplicationId, e.MessageAttributes)
+		if code != "" {
+			out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{Id: e.Id, Code: aws.String(code), Message: aws.String(code), SenderFault: aws.Bool(senderFault)})
+			continue
+		}
+		out.Successful = append(out.Successful, &sqs.SendMessageBatchResultEntry{Id: e.Id, MessageId: aws.String(id)})
+	}
+	return &out, nil
+}
+
+func (f *fakeSQS) ReceiveMessage(in *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	return f.ReceiveMessageWithContext(context.Background(), in)
+}
+
+func (f *fakeSQS) SendMessage(in *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	if other, ok := f.others[aws.StringValue(in.QueueUrl)]; ok {
+		return other.SendMessage(in)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.singles++
+	id, code, _ := f.send(in.MessageBody, in.MessageGroupId, in.MessageDeduplicationId, in.MessageAttributes)
+	if code != "" {
+		return nil, errors.New(code)
+	}
+	return &sqs.SendMessageOutput{MessageId: aws.String(id)}, nil
+}
+
+func (f *fakeSQS) ChangeMessageVisibility(in *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := f.find(aws.StringValue(in.ReceiptHandle))
+	if m == nil {
+		return nil, errors.New("ReceiptHandleIsInvalid")
+	}
+	m.hidden = time.Now().Add(time.Duration(aws.Int64Value(in.VisibilityTimeout)) * time.Second)
+	f.visibility++
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (f *fakeSQS) DeleteMessageBatch(in *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out sqs.DeleteMessageBatchOutput
+	for _, e := range in.Entries {
+		m := f.find(aws.StringValue(e.ReceiptHandle))
+		if m == nil {
+			out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{Id: e.Id, Code: aws.String("ReceiptHandleIsInvalid")})
+			continue
+		}
+		for i := range f.messages {
+			if f.messages[i] == m {
+				f.messages = append(f.messages[:i], f.messages[i+1:]...)
+				break
+			}
+		}
+		f.deleted = append(f.deleted, aws.StringValue(m.msg.Body))
+		out.Successful = append(out.Successful, &sqs.DeleteMessageBatchResultEntry{Id: e.Id})
+	}
+	return &out, nil
+}
+
+func (f *fakeSQS) DeleteMessage(in *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	resp, err := f.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+		QueueUrl: in.QueueUrl,
+		Entries:  []*sqs.DeleteMessageBatchRequestEntry{{Id: aws.String("0"), ReceiptHandle: in.ReceiptHandle}},
+	})
+	if err == nil && len(resp.Failed) > 0 {
+		err = errors.New(aws.StringValue(resp.Failed[0].Code))
+	}
+	return &sqs.DeleteMessageOutput{}, err
+}
+
+func (f *fakeSQS) GetQueueUrl(in *sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput, error) {
+	for qurl := range f.others {
+		if strings.HasSuffix(qurl, "/"+aws.StringValue(in.QueueName)) {
+			return &sqs.GetQueueUrlOutput{QueueUrl: aws.String(qurl)}, nil
+		}
+	}
+	return nil, errors.New(sqs.ErrCodeQueueDoesNotExist)
+}
+
+func (f *fakeSQS) ListDeadLetterSourceQueuesPages(in *sqs.ListDeadLetterSourceQueuesInput, fn func(*sqs.ListDeadLetterSourceQueuesOutput, bool) bool) error {
+	fn(&sqs.ListDeadLetterSourceQueuesOutput{QueueUrls: aws.StringSlice(f.sources)}, true)
+	return nil
+}
+
+// runConsumer runs the Consumer until the fake has deleted want messages, or a deadline passes,
+// then cancels it and checks it stopped with the context's error
+func runConsumer(t *testing.T, c *Consumer, f *fakeSQS, want int) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(f.deletedBodies()) < want && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Give any further deletes a chance to happen
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run returned %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestConsumer(t *testing.T) {
+	f := newFakeSQS(false)
+	for i := 0; i < 25; i++ {
+		f.add(fmt.Sprintf("m%02d", i), "")
+	}
+
+	var (
+		mu      sync.Mutex
+		handled []string
+	)
+	c := newTestSession(t).NewConsumerWithClient(f, "https://sqs.us-east-1.amazonaws.com/123456789012/q", func(ctx context.Context, m *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, m.Body)
+		if m.Body == "m13" {
+			return errors.New("nope")
+		}
+		return nil
+	})
+	c.Workers = 4
+	c.DeleteInterval = 10 * time.Millisecond
+
+	runConsumer(t, c, f, 24)
+
+	deleted := f.deletedBodies()
+	sort.Strings(deleted)
+	sort.Strings(handled)
+	if len(handled) != 25 {
+		t.Errorf("handled %d messages, want 25", len(handled))
+	}
+	if len(deleted) != 24 {
+		t.Fatalf("deleted %d messages, want 24", len(deleted))
+	}
+	for _, body := range deleted {
+		if body == "m13" {
+			t.Error("deleted the message that failed")
+		}
+	}
+	if err := c.LastError(); err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("LastError is %v, want the handler error", err)
+	}
+}
+
+func TestConsumerGroups(t *testing.T) {
+	f := newFakeSQS(true)
+	for _, m := range [][2]string{
+		{"a1", "a"}, {"b1", "b"}, {"a2", "a"}, {"c1", "c"}, {"b2", "b"},
+		{"a3", "a"}, {"b3", "b"}, {"c2", "c"}, {"a4", "a"}, {"c3", "c"},
+	} {
+		f.add(m[0], m[1])
+	}
+
+	var (
+		mu       sync.Mutex
+		handled  = make(map[string][]string)
+		inflight = make(map[string]bool)
+	)
+	c := newTestSession(t).NewConsumerWithClient(f, "https://sqs.us-east-1.amazonaws.com/123456789012/q.fifo", func(ctx context.Context, m *Message) error {
+		group := m.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]
+		mu.Lock()
+		if inflight[group] {
+			t.Errorf("message %s handled while another from group %s was in flight", m.Body, group)
+		}
+		inflight[group] = true
+		handled[group] = append(handled[group], m.Body)
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		inflight[group] = false
+		mu.Unlock()
+		if m.Body == "b2" {
+			return errors.New("nope")
+		}
+		return nil
+	})
+	c.Workers = 10
+	c.DeleteInterval = 10 * time.Millisecond
+
+	// b3 is skipped once b2 fails, and neither is received again until their visibility expires
+	runConsumer(t, c, f, 8)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for group, want := range map[string]string{"a": "a1 a2 a3 a4", "b": "b1 b2", "c": "c1 c2 c3"} {
+		if got := strings.Join(handled[group], " "); got != want {
+			t.Errorf("group %s handled %s, want %s", group, got, want)
+		}
+	}
+
+	deleted := f.deletedBodies()
+	if len(deleted) != 8 {
+		t.Errorf("deleted %v, want 8 messages", deleted)
+	}
+	for _, body := range deleted {
+		if body == "b2" || body == "b3" {
+			t.Errorf("deleted %s, after its group failed", body)
+		}
+	}
+}
+
+func TestGroupMessages(t *testing.T) {
+	var messages []*sqs.Message
+	for _, m := range [][2]string{{"a1", "a"}, {"x", ""}, {"b1", "b"}, {"a2", "a"}, {"y", ""}, {"b2", "b"}} {
+		msg := &sqs.Message{Body: aws.String(m[0]), Attributes: map[string]*string{}}
+		if m[1] != "" {
+			msg.Attributes[sqs.MessageSystemAttributeNameMessageGroupId] = aws.String(m[1])
+		}
+		messages = append(messages, msg)
+	}
+
+	var got []string
+	for _, group := range groupMessages(messages) {
+		var bodies []string
+		for _, m := range group {
+			bodies = append(bodies, m.Body)
+		}
+		got = append(got, strings.Join(bodies, ","))
+	}
+	if want := "a1,a2 x b1,b2 y"; strings.Join(got, " ") != want {
+		t.Errorf("got groups %q, want %q", strings.Join(got, " "), want)
+	}
+}
@@ -0,0 +1,385 @@
+package aws
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// deadLetterQueueSourceArnAttribute is the system attribute SQS sets on messages moved to a DLQ
+const deadLetterQueueSourceArnAttribute = "DeadLetterQueueSourceArn"
+
+// ErrAmbiguousSource is returned when a dead-letter queue has more than one source queue,
+// and the messages don't say which they came from
+var ErrAmbiguousSource = errors.New("dead-letter queue has multiple source queues")
+
+// MessageFilter selects messages by regular expressions over their bodies and attributes.
+// A nil MessageFilter, or one with no expressions, matches everything.
+type MessageFilter struct {
+	// Body, if set, must match the message body
+	Body *regexp.Regexp
+	// Attributes are matched against the string values of the named system or message
+	// attributes. All must match, and a missing attribute doesn't.
+	Attributes map[string]*regexp.Regexp
+}
+
+// Match returns true if the Message passes the filter
+func (f *MessageFilter) Match(m *Message) bool {
+	if f == nil {
+		return true
+	}
+	if f.Body != nil && !f.Body.MatchString(m.Body) {
+		return false
+	}
+	for name, re := range f.Attributes {
+		v, ok := m.Attributes[name]
+		if !ok {
+			mav, mok := m.MessageAttributes[name]
+			if !mok || mav.StringValue == nil {
+				return false
+			}
+			v = *mav.StringValue
+		}
+		if !re.MatchString(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// RedriveOptions controls DLQ.Redrive
+type RedriveOptions struct {
+	// Filter selects which messages to redrive. nil redrives everything.
+	Filter *MessageFilter
+	// Max is the most messages to redrive. 0 is unlimited.
+	Max int
+	// PerSecond limits the redrive rate. 0 is unlimited.
+	PerSecond float64
+	// DryRun reports what would be redriven, without sending or deleting anything
+	DryRun bool
+	// TargetQueueURL overrides the source queue determined from the redrive policy
+	TargetQueueURL string
+}
+
+// RedriveResult is the outcome of redriving one message
+type RedriveResult struct {
+	MessageID string
+	Target    string
+	Err       error
+}
+
+// RedriveReport summarizes a DLQ.Redrive
+type RedriveReport struct {
+	Redriven int
+	Skipped  int
+	Failed   int
+	Results  []RedriveResult
+}
+
+// DLQ is a helper for inspecting and redriving a dead-letter queue
+type DLQ struct {
+	// VisibilityTimeout is how long messages are hidden while being inspected. Default 30s.
+	VisibilityTimeout time.Duration
+
+	sqs  sqsiface.SQSAPI
+	qurl string
+}
+
+// dlqExport is the JSON form of an exported message
+type dlqExport struct {
+	MessageID         string                                `json:"messageId"`
+	Body              string                                `json:"body"`
+	Attributes        map[string]string                     `json:"attributes,omitempty"`
+	MessageAttributes map[string]*sqs.MessageAttributeValue `json:"messageAttributes,omitempty"`
+}
+
+// NewDLQ returns a DLQ for the specified queue, or an error if the queue URL can't be resolved
+func (s *Session) NewDLQ(queue string) (*DLQ, error) {
+	qurl, err := s.SQS_GetQueueUrl(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDLQWithClient(sqs.New(s.AWS), qurl), nil
+}
+
+// NewDLQWithClient returns a DLQ for the specified queue URL, using the SQS client, such as a stand-in for testing
+func NewDLQWithClient(client sqsiface.SQSAPI, queueURL string) *DLQ {
+	return &DLQ{
+		VisibilityTimeout: 30 * time.Second,
+		sqs:               client,
+		qurl:              queueURL,
+	}
+}
+
+// Peek returns up to limit (0 is unlimited) messages matching the filter, without deleting them.
+// The messages are made visible again before Peek returns, but their receive counts are incremented.
+func (d *DLQ) Peek(filter *MessageFilter, limit int) ([]*Message, error) {
+	var matched []*Message
+	err := d.scan(10, func(m *Message) (bool, error) {
+		if filter.Match(m) {
+			matched = append(matched, m)
+		}
+		return limit > 0 && len(matched) >= limit, nil
+	})
+	return matched, err
+}
+
+// Export writes up to limit (0 is unlimited) messages matching the filter to w, as JSON lines,
+// without deleting them, returning the number written
+func (d *DLQ) Export(w io.Writer, filter *MessageFilter, limit int) (count int, err error) {
+	enc := json.NewEncoder(w)
+	err = d.scan(10, func(m *Message) (bool, error) {
+		if !filter.Match(m) {
+			return false, nil
+		}
+		if err := enc.Encode(dlqExport{
+			MessageID:         m.ID,
+			Body:              m.Body,
+			Attributes:        m.Attributes,
+			MessageAttributes: m.MessageAttributes,
+		}); err != nil {
+			return true, err
+		}
+		count++
+		return limit > 0 && count >= limit, nil
+	})
+	return
+}
+
+// ExportFile is Export to the named file, which is created or truncated
+func (d *DLQ) ExportFile(filename string, filter *MessageFilter, limit int) (count int, err error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	return d.Export(file, filter, limit)
+}
+
+// Redrive sends messages matching the filter back to their source queue, and deletes them from
+// the dead-letter queue. The source queue is taken from each message's DeadLetterQueueSourceArn
+// attribute, or else the one queue whose redrive policy targets this dead-letter queue.
+// Messages that are skipped or fail are made visible again. When paced, fewer messages are
+// received at a time, so they're redriven before their visibility timeout expires.
+func (d *DLQ) Redrive(opts RedriveOptions) (*RedriveReport, error) {
+	var (
+		report   RedriveReport
+		fallback string
+		pace     <-chan time.Time
+		interval time.Duration
+		batch    int64 = 10
+	)
+
+	if opts.TargetQueueURL == "" {
+		sources, err := d.sourceQueues()
+		if err != nil {
+			return nil, err
+		}
+		if len(sources) == 1 {
+			fallback = sources[0]
+		}
+	}
+
+	if opts.PerSecond > 0 {
+		interval = time.Duration(float64(time.Second) / opts.PerSecond)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		pace = ticker.C
+
+		// Only receive what can be redriven in half the visibility timeout
+		batch = min(10, max(1, int64(d.visibility()/2/interval)))
+	}
+
+	err := d.scan(batch, func(m *Message) (bool, error) {
+		if !opts.Filter.Match(m) {
+			report.Skipped++
+			return false, nil
+		}
+
+		target, err := d.target(m, opts.TargetQueueURL, fallback)
+		result := RedriveResult{MessageID: m.ID, Target: target, Err: err}
+		if err == nil && !opts.DryRun {
+			if pace != nil {
+				if interval > d.visibility()/2 {
+					// Even alone, it would expire while waiting
+					d.extend(m, interval+d.visibility())
+				}
+				<-pace
+			}
+			result.Err = d.redrive(m, target)
+		}
+		report.Results = append(report.Results, result)
+
+		if result.Err != nil {
+			report.Failed++
+		} else {
+			report.Redriven++
+		}
+		return opts.Max > 0 && report.Redriven >= opts.Max, nil
+	})
+
+	return &report, err
+}
+
+// redrive sends the message to the target queue, and deletes it from the DLQ
+func (d *DLQ) redrive(m *Message, target string) error {
+	input := sqs.SendMessageInput{
+		QueueUrl:          aws.String(target),
+		MessageBody:       aws.String(m.Body),
+		MessageAttributes: m.MessageAttributes,
+	}
+	if gid, ok := m.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]; ok {
+		input.MessageGroupId = aws.String(gid)
+	}
+	if did, ok := m.Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId]; ok {
+		input.MessageDeduplicationId = aws.String(did)
+	}
+
+	if _, err := d.sqs.SendMessage(&input); err != nil {
+		return err
+	}
+
+	_, err := d.sqs.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(d.qurl),
+		ReceiptHandle: aws.String(m.ReceiptHandle),
+	})
+	if err == nil {
+		// Gone, so don't release it
+		m.ReceiptHandle = ""
+	}
+	return err
+}
+
+// target returns the queue URL the message should be redriven to
+func (d *DLQ) target(m *Message, override, fallback string) (string, error) {
+	if override != "" {
+		return override, nil
+	}
+
+	if sarn, ok := m.Attributes[deadLetterQueueSourceArnAttribute]; ok {
+		a, err := arn.Parse(sarn)
+		if err != nil {
+			return "", err
+		}
+		resp, err := d.sqs.GetQueueUrl(&sqs.GetQueueUrlInput{
+			QueueName:              aws.String(a.Resource),
+			QueueOwnerAWSAccountId: aws.String(a.AccountID),
+		})
+		if err != nil {
+			return "", err
+		}
+		return aws.StringValue(resp.QueueUrl), nil
+	}
+
+	if fallback == "" {
+		return "", ErrAmbiguousSource
+	}
+	return fallback, nil
+}
+
+// sourceQueues returns the URLs of the queues whose redrive policy targets this DLQ
+func (d *DLQ) sourceQueues() (sources []string, err error) {
+	err = d.sqs.ListDeadLetterSourceQueuesPages(&sqs.ListDeadLetterSourceQueuesInput{
+		QueueUrl: aws.String(d.qurl),
+	}, func(page *sqs.ListDeadLetterSourceQueuesOutput, lastPage bool) bool {
+		sources = append(sources, aws.StringValueSlice(page.QueueUrls)...)
+		return true
+	})
+	return
+}
+
+// visibility returns the VisibilityTimeout, defaulting it if unset
+func (d *DLQ) visibility() time.Duration {
+	if d.VisibilityTimeout <= 0 {
+		d.VisibilityTimeout = 30 * time.Second
+	}
+	return d.VisibilityTimeout
+}
+
+// extend hides the message for timeout, up to the SQS maximum of 12 hours, from now.
+// Failure is logged, as the message will merely be redriven late, or twice.
+func (d *DLQ) extend(m *Message, timeout time.Duration) {
+	_, err := d.sqs.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(d.qurl),
+		ReceiptHandle:     aws.String(m.ReceiptHandle),
+		VisibilityTimeout: aws.Int64(int64(min(timeout, 12*time.Hour).Seconds())),
+	})
+	if err != nil {
+		DebugOut.Printf("DLQ %s: extending visibility of message %s: %s\n", d.qurl, m.ID, err)
+	}
+}
+
+// scan receives every available message once, batch (up to 10) at a time, calling f for each
+// until it returns true or an error, then makes everything not deleted visible again. Messages
+// are kept invisible during the scan, so they aren't seen twice.
+func (d *DLQ) scan(batch int64, f func(m *Message) (bool, error)) error {
+	var (
+		seen    = make(map[string]bool)
+		release []*sqs.Message
+		ferr    error
+	)
+	d.visibility()
+
+	defer func() {
+		for _, m := range release {
+			d.sqs.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          aws.String(d.qurl),
+				ReceiptHandle:     m.ReceiptHandle,
+				VisibilityTimeout: aws.Int64(0),
+			})
+		}
+	}()
+
+	for {
+		resp, err := d.sqs.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(d.qurl),
+			MaxNumberOfMessages:   aws.Int64(batch),
+			WaitTimeSeconds:       aws.Int64(1),
+			VisibilityTimeout:     aws.Int64(int64(d.VisibilityTimeout.Seconds())),
+			AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+			MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.Messages) == 0 {
+			// Drained, as far as we can tell
+			return nil
+		}
+
+		for i, sm := range resp.Messages {
+			m := newMessage(sm)
+			if seen[m.ID] {
+				release = append(release, sm)
+				continue
+			}
+			seen[m.ID] = true
+
+			var stop bool
+			stop, ferr = f(m)
+			if !d.deleted(m) {
+				release = append(release, sm)
+			}
+			if stop || ferr != nil {
+				release = append(release, resp.Messages[i+1:]...)
+				return ferr
+			}
+		}
+	}
+}
+
+// deleted returns true if the message was deleted by a redrive. Only Redrive deletes,
+// and it marks the Message by clearing the receipt handle.
+func (d *DLQ) deleted(m *Message) bool {
+	return m.ReceiptHandle == ""
+}
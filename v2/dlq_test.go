@@ -0,0 +1,243 @@
+package aws
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	testDLQ     = "https://sqs.us-east-1.amazonaws.com/123456789012/dlq"
+	testSourceA = "https://sqs.us-east-1.amazonaws.com/123456789012/source-a"
+	testSourceB = "https://sqs.us-east-1.amazonaws.com/123456789012/source-b"
+)
+
+// newTestDLQ returns a DLQ of the bodies, and the fake it uses
+func newTestDLQ(bodies ...string) (*DLQ, *fakeSQS) {
+	f := newFakeSQS(false)
+	for _, body := range bodies {
+		f.add(body, "")
+	}
+	return NewDLQWithClient(f, testDLQ), f
+}
+
+// bodies returns the bodies of the messages
+func bodies(messages []*sqs.Message) string {
+	var b []string
+	for _, m := range messages {
+		b = append(b, aws.StringValue(m.Body))
+	}
+	return strings.Join(b, " ")
+}
+
+func TestDLQPeek(t *testing.T) {
+	var all []string
+	for i := 0; i < 25; i++ {
+		all = append(all, fmt.Sprintf("m%02d", i))
+	}
+	d, f := newTestDLQ(all...)
+	f.messages[3].msg.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+		"type": {DataType: aws.String("String"), StringValue: aws.String("order")},
+	}
+
+	tests := []struct {
+		name   string
+		filter *MessageFilter
+		limit  int
+		want   string
+	}{
+		{"all", nil, 0, strings.Join(all, " ")},
+		{"limit", nil, 12, strings.Join(all[:12], " ")},
+		{"body", &MessageFilter{Body: regexp.MustCompile(`^m1`)}, 0, strings.Join(all[10:20], " ")},
+		{"body limit", &MessageFilter{Body: regexp.MustCompile(`^m1`)}, 3, "m10 m11 m12"},
+		{"attribute", &MessageFilter{Attributes: map[string]*regexp.Regexp{"type": regexp.MustCompile(`^order$`)}}, 0, "m03"},
+		{"missing attribute", &MessageFilter{Attributes: map[string]*regexp.Regexp{"nope": regexp.MustCompile(`.*`)}}, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, err := d.Peek(tt.filter, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, m := range messages {
+				got = append(got, m.Body)
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("got %s, want %s", strings.Join(got, " "), tt.want)
+			}
+
+			// Nothing is deleted, and everything is visible again
+			if queued := f.queued(); len(queued) != len(all) {
+				t.Errorf("%d messages left, want %d", len(queued), len(all))
+			}
+			resp, _ := f.ReceiveMessage(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(100), VisibilityTimeout: aws.Int64(0)})
+			if len(resp.Messages) != len(all) {
+				t.Errorf("%d messages visible after Peek, want %d", len(resp.Messages), len(all))
+			}
+		})
+	}
+}
+
+func TestDLQExport(t *testing.T) {
+	d, _ := newTestDLQ("one", "two", "three")
+
+	var buf bytes.Buffer
+	count, err := d.Export(&buf, &MessageFilter{Body: regexp.MustCompile(`^t`)}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("exported %d, want 2", count)
+	}
+
+	var got []string
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var e dlqExport
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("bad line %s: %s", scanner.Text(), err)
+		}
+		if e.MessageID == "" {
+			t.Errorf("no message ID in %s", scanner.Text())
+		}
+		got = append(got, e.Body)
+	}
+	if strings.Join(got, " ") != "two three" {
+		t.Errorf("exported %s, want two three", strings.Join(got, " "))
+	}
+
+	filename := filepath.Join(t.TempDir(), "dlq.jsonl")
+	if err := os.WriteFile(filename, []byte(strings.Repeat("old\n", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	count, err = d.ExportFile(filename, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || bytes.Count(data, []byte("\n")) != 1 || !bytes.Contains(data, []byte(`"body":"one"`)) {
+		t.Errorf("exported %d to the file: %s", count, data)
+	}
+}
+
+func TestDLQRedrive(t *testing.T) {
+	setup := func(sources ...string) (*DLQ, *fakeSQS, map[string]*fakeSQS) {
+		d, f := newTestDLQ()
+		f.sources = sources
+		targets := make(map[string]*fakeSQS)
+		for _, qurl := range []string{testSourceA, testSourceB} {
+			targets[qurl] = newFakeSQS(false)
+			f.others[qurl] = targets[qurl]
+		}
+		f.add("a1", "")
+		f.add("b1", "").Attributes[deadLetterQueueSourceArnAttribute] = aws.String("arn:aws:sqs:us-east-1:123456789012:source-b")
+		f.add("a2", "")
+		f.add("skip", "")
+		return d, f, targets
+	}
+	filter := &MessageFilter{Body: regexp.MustCompile(`^[ab]`)}
+
+	t.Run("single source", func(t *testing.T) {
+		d, f, targets := setup(testSourceA)
+		report, err := d.Redrive(RedriveOptions{Filter: filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Redriven != 3 || report.Skipped != 1 || report.Failed != 0 {
+			t.Errorf("got report %+v", report)
+		}
+		if got := bodies(targets[testSourceA].queued()); got != "a1 a2" {
+			t.Errorf("%s got %s, want a1 a2", testSourceA, got)
+		}
+		if got := bodies(targets[testSourceB].queued()); got != "b1" {
+			t.Errorf("%s got %s, want b1", testSourceB, got)
+		}
+		if got := bodies(f.queued()); got != "skip" {
+			t.Errorf("left %s, want skip", got)
+		}
+	})
+
+	t.Run("ambiguous", func(t *testing.T) {
+		d, f, targets := setup(testSourceA, testSourceB)
+		report, err := d.Redrive(RedriveOptions{Filter: filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Redriven != 1 || report.Failed != 2 {
+			t.Errorf("got report %+v", report)
+		}
+		for _, r := range report.Results {
+			if r.Err != nil && !errors.Is(r.Err, ErrAmbiguousSource) {
+				t.Errorf("message %s failed with %v, want %v", r.MessageID, r.Err, ErrAmbiguousSource)
+			}
+		}
+		if got := bodies(targets[testSourceB].queued()); got != "b1" {
+			t.Errorf("%s got %s, want b1", testSourceB, got)
+		}
+		if got := bodies(f.queued()); got != "a1 a2 skip" {
+			t.Errorf("left %s, want a1 a2 skip", got)
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		d, f, targets := setup(testSourceA)
+		report, err := d.Redrive(RedriveOptions{DryRun: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Redriven != 4 || len(targets[testSourceA].queued())+len(targets[testSourceB].queued()) != 0 || len(f.queued()) != 4 {
+			t.Errorf("got report %+v, and redrove messages", report)
+		}
+	})
+
+	t.Run("override and max", func(t *testing.T) {
+		d, f, targets := setup()
+		report, err := d.Redrive(RedriveOptions{TargetQueueURL: testSourceB, Max: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Redriven != 2 {
+			t.Errorf("got report %+v", report)
+		}
+		if got := bodies(targets[testSourceB].queued()); got != "a1 b1" {
+			t.Errorf("%s got %s, want a1 b1", testSourceB, got)
+		}
+		if got := bodies(f.queued()); got != "a2 skip" {
+			t.Errorf("left %s, want a2 skip", got)
+		}
+	})
+}
+
+func TestDLQRedriveFIFO(t *testing.T) {
+	f := newFakeSQS(true)
+	target := newFakeSQS(true)
+	f.others[testSourceA+".fifo"] = target
+	f.add("a1", "a").Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId] = aws.String("d1")
+	d := NewDLQWithClient(f, testDLQ+".fifo")
+
+	if _, err := d.Redrive(RedriveOptions{TargetQueueURL: testSourceA + ".fifo"}); err != nil {
+		t.Fatal(err)
+	}
+	queued := target.queued()
+	if len(queued) != 1 {
+		t.Fatalf("redrove %d messages, want 1", len(queued))
+	}
+	if g, dd := aws.StringValue(queued[0].Attributes[sqs.MessageSystemAttributeNameMessageGroupId]), aws.StringValue(queued[0].Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId]); g != "a" || dd != "d1" {
+		t.Errorf("redriven with group %q and deduplication ID %q, want a and d1", g, dd)
+	}
+}
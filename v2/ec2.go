@@ -1,18 +1,37 @@
 package aws
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/elasticbeanstalk"
 )
 
-// Ec2Info is a helper structure ...
+// ErrInstanceNotFound is returned when an EC2 instance does not exist
+var ErrInstanceNotFound = errors.New("EC2 instance not found")
+
+// Ec2Info is a helper structure describing an EC2 instance
 type Ec2Info struct {
-	State string
-	Class string
-	Arch  string
-	Ltime string
-	Az    string
+	ID             string
+	State          string
+	Class          string
+	Arch           string
+	Ltime          string
+	Az             string
+	PrivateIP      string
+	PublicIP       string
+	VpcID          string
+	SubnetID       string
+	SecurityGroups []string
+	IAMProfile     string
+	Platform       string
+	Tags           map[string]string
 }
 
 //EbInfo is a helper structure...
@@ -30,6 +49,82 @@ type EbInfo struct {
 	Warning  int64
 }
 
+// NewEc2Info returns an Ec2Info struct or an error from an instance ID.
+// If the instance does not exist, the error wraps ErrInstanceNotFound.
+func (s *Session) NewEc2Info(instance string) (iInfo *Ec2Info, err error) {
+
+	svc := ec2.New(s.AWS)
+	params := &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{
+			aws.String(instance),
+		},
+	}
+	resp, err := svc.DescribeInstances(params)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidInstanceID.NotFound" {
+			err = fmt.Errorf("%w: %s", ErrInstanceNotFound, instance)
+		}
+		return
+	}
+	for _, res := range resp.Reservations {
+		for _, inst := range res.Instances {
+			return newEc2InfoFromInstance(inst), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrInstanceNotFound, instance)
+}
+
+// newEc2InfoFromInstance returns an Ec2Info struct populated from the Instance
+func newEc2InfoFromInstance(inst *ec2.Instance) *Ec2Info {
+	iInfo := Ec2Info{
+		ID:        aws.StringValue(inst.InstanceId),
+		Class:     aws.StringValue(inst.InstanceType),
+		Arch:      aws.StringValue(inst.Architecture),
+		PrivateIP: aws.StringValue(inst.PrivateIpAddress),
+		PublicIP:  aws.StringValue(inst.PublicIpAddress),
+		VpcID:     aws.StringValue(inst.VpcId),
+		SubnetID:  aws.StringValue(inst.SubnetId),
+		Platform:  aws.StringValue(inst.Platform),
+		Tags:      make(map[string]string),
+	}
+	if iInfo.Platform == "" {
+		// Platform is only set for Windows, so fall back to the details
+		iInfo.Platform = aws.StringValue(inst.PlatformDetails)
+	}
+	if inst.State != nil {
+		iInfo.State = aws.StringValue(inst.State.Name)
+	}
+	if inst.LaunchTime != nil {
+		iInfo.Ltime = inst.LaunchTime.Format(time.RFC3339)
+	}
+	if inst.Placement != nil {
+		iInfo.Az = aws.StringValue(inst.Placement.AvailabilityZone)
+	}
+	if inst.IamInstanceProfile != nil {
+		iInfo.IAMProfile = aws.StringValue(inst.IamInstanceProfile.Arn)
+	}
+	for _, sg := range inst.SecurityGroups {
+		iInfo.SecurityGroups = append(iInfo.SecurityGroups, aws.StringValue(sg.GroupId))
+	}
+	for _, t := range inst.Tags {
+		iInfo.Tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+
+	return &iInfo
+}
+
+// ELB_HostCounts returns the last healthy and unhealthy -hostcounts.
+func (s *Session) ELB_HostCounts(instance string) (healthyPoint, unhealthyPoint *cloudwatch.Datapoint, err error) {
+
+	unhealthyPoint, err = s.GetLastCloudWatchValue("LoadBalancerName", instance, "AWS/ELB", "UnHealthyHostCount", cloudwatch.StatisticMaximum, "Count")
+	if err != nil {
+		return
+	}
+	healthyPoint, err = s.GetLastCloudWatchValue("LoadBalancerName", instance, "AWS/ELB", "HealthyHostCount", cloudwatch.StatisticMaximum, "Count")
+	return
+}
+
 // NewEbInfo returns an EbInfo struct or an error for the specified EB environment
 func NewEbInfo(ebenv string, session *session.Session) (ebInfo *EbInfo, err error) {
 	svc := elasticbeanstalk.New(session)
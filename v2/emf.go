@@ -0,0 +1,130 @@
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// EMFMetric is a single metric value to emit via an EMFWriter
+type EMFMetric struct {
+	Name string
+	// Unit is a CloudWatch standard unit, e.g. "Count", "Bytes", "Percent"
+	Unit  string
+	Value float64
+}
+
+// EMFWriter writes CloudWatch Embedded Metric Format (EMF) JSON lines to an io.Writer,
+// typically os.Stdout in Lambda or ECS, where CloudWatch Logs extracts them as metrics.
+// Metrics written with a given namespace, name, unit and dimension set can be read back
+// with GetLastCloudWatchValue or QueryMetric using the identical values.
+type EMFWriter struct {
+	w          io.Writer
+	namespace  string
+	dimensions map[string]string
+	mu         sync.Mutex
+}
+
+// emfDirective is the "_aws" metadata of an EMF line
+type emfDirective struct {
+	Timestamp         int64                `json:"Timestamp"`
+	CloudWatchMetrics []emfMetricDirective `json:"CloudWatchMetrics"`
+}
+
+// emfMetricDirective describes the metrics in an EMF line
+type emfMetricDirective struct {
+	Namespace  string            `json:"Namespace"`
+	Dimensions [][]string        `json:"Dimensions"`
+	Metrics    []emfMetricDefine `json:"Metrics"`
+}
+
+// emfMetricDefine names a metric in an EMF line
+type emfMetricDefine struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit,omitempty"`
+}
+
+// NewEMFWriter returns an EMFWriter writing to w, for the specified namespace. The
+// dimensions, which may be nil, are added to every line written.
+func NewEMFWriter(w io.Writer, namespace string, dimensions map[string]string) *EMFWriter {
+	return &EMFWriter{
+		w:          w,
+		namespace:  namespace,
+		dimensions: copyDimensions(dimensions),
+	}
+}
+
+// Put writes a single metric value with the specified dimensions, in addition to the
+// EMFWriter's dimensions
+func (e *EMFWriter) Put(name string, value float64, unit string, dimensions map[string]string) error {
+	return e.Emit([]EMFMetric{{Name: name, Unit: unit, Value: value}}, dimensions, nil)
+}
+
+// Emit writes one EMF line containing all of the metrics, with the specified dimensions
+// in addition to the EMFWriter's dimensions. properties, which may be nil, are included
+// in the log line but are not metrics.
+func (e *EMFWriter) Emit(metrics []EMFMetric, dimensions map[string]string, properties map[string]interface{}) error {
+	dims := e.mergeDimensions(dimensions)
+
+	line := make(map[string]interface{}, len(properties)+len(dims)+len(metrics)+1)
+	for k, v := range properties {
+		line[k] = v
+	}
+	for k, v := range dims {
+		line[k] = v
+	}
+
+	defines := make([]emfMetricDefine, 0, len(metrics))
+	for _, m := range metrics {
+		if _, ok := dims[m.Name]; ok {
+			return fmt.Errorf("metric name %q collides with a dimension name", m.Name)
+		}
+		line[m.Name] = m.Value
+		defines = append(defines, emfMetricDefine{Name: m.Name, Unit: m.Unit})
+	}
+
+	line["_aws"] = emfDirective{
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		CloudWatchMetrics: []emfMetricDirective{
+			{
+				Namespace:  e.namespace,
+				Dimensions: [][]string{dimensionNames(dims)},
+				Metrics:    defines,
+			},
+		},
+	}
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(b)
+	return err
+}
+
+// MetricQuery returns a MetricQuery that will read back the named metric as written
+// with the specified dimensions, for the specified statistics
+func (e *EMFWriter) MetricQuery(name, unit string, dimensions map[string]string, statistics ...string) *MetricQuery {
+	return &MetricQuery{
+		Namespace:  e.namespace,
+		MetricName: name,
+		Dimensions: e.mergeDimensions(dimensions),
+		Statistics: statistics,
+		Unit:       unit,
+	}
+}
+
+// mergeDimensions returns the EMFWriter's dimensions overlaid with the specified ones
+func (e *EMFWriter) mergeDimensions(dimensions map[string]string) map[string]string {
+	dims := copyDimensions(e.dimensions)
+	for k, v := range dimensions {
+		dims[k] = v
+	}
+	return dims
+}
@@ -0,0 +1,133 @@
+package aws
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// emfTimestamp matches the _aws Timestamp, which the golden lines have as 0
+var emfTimestamp = regexp.MustCompile(`"Timestamp":(\d+)`)
+
+// emfLines returns the EMF lines written, with their timestamps checked and zeroed
+func emfLines(t *testing.T, buf *bytes.Buffer, before time.Time) string {
+	t.Helper()
+	for _, m := range emfTimestamp.FindAllStringSubmatch(buf.String(), -1) {
+		ms, _ := strconv.ParseInt(m[1], 10, 64)
+		if ts := time.UnixMilli(ms); ts.Before(before.Truncate(time.Millisecond)) || ts.After(time.Now()) {
+			t.Errorf("timestamp %s isn't now", ts)
+		}
+	}
+	return emfTimestamp.ReplaceAllString(buf.String(), `"Timestamp":0`)
+}
+
+func TestEMFWriterGolden(t *testing.T) {
+	tests := []struct {
+		name       string
+		dimensions map[string]string
+		emit       func(e *EMFWriter) error
+		want       string
+	}{
+		{
+			"put",
+			map[string]string{"Service": "web"},
+			func(e *EMFWriter) error { return e.Put("Requests", 1, "Count", nil) },
+			`{"Requests":1,"Service":"web","_aws":{"Timestamp":0,"CloudWatchMetrics":[{"Namespace":"Test","Dimensions":[["Service"]],"Metrics":[{"Name":"Requests","Unit":"Count"}]}]}}` + "\n",
+		},
+		{
+			"no dimensions or unit",
+			nil,
+			func(e *EMFWriter) error { return e.Put("Requests", 1, "", nil) },
+			`{"Requests":1,"_aws":{"Timestamp":0,"CloudWatchMetrics":[{"Namespace":"Test","Dimensions":[[]],"Metrics":[{"Name":"Requests"}]}]}}` + "\n",
+		},
+		{
+			"dimension sets are merged and sorted",
+			map[string]string{"Service": "web", "Stage": "prod"},
+			func(e *EMFWriter) error {
+				return e.Put("Latency", 12.5, "Milliseconds", map[string]string{"Stage": "test", "Az": "a"})
+			},
+			`{"Az":"a","Latency":12.5,"Service":"web","Stage":"test","_aws":{"Timestamp":0,"CloudWatchMetrics":[{"Namespace":"Test","Dimensions":[["Az","Service","Stage"]],"Metrics":[{"Name":"Latency","Unit":"Milliseconds"}]}]}}` + "\n",
+		},
+		{
+			"value types",
+			nil,
+			func(e *EMFWriter) error {
+				return e.Emit([]EMFMetric{
+					{Name: "Zero", Unit: "Count", Value: 0},
+					{Name: "Negative", Unit: "None", Value: -3},
+					{Name: "Fraction", Unit: "Percent", Value: 0.125},
+					{Name: "Huge", Unit: "Bytes", Value: 1e21},
+				}, nil, nil)
+			},
+			`{"Fraction":0.125,"Huge":1e+21,"Negative":-3,"Zero":0,"_aws":{"Timestamp":0,"CloudWatchMetrics":[{"Namespace":"Test","Dimensions":[[]],"Metrics":[{"Name":"Zero","Unit":"Count"},{"Name":"Negative","Unit":"None"},{"Name":"Fraction","Unit":"Percent"},{"Name":"Huge","Unit":"Bytes"}]}]}}` + "\n",
+		},
+		{
+			"properties",
+			map[string]string{"Service": "web"},
+			func(e *EMFWriter) error {
+				return e.Emit([]EMFMetric{{Name: "Requests", Unit: "Count", Value: 2}}, nil, map[string]interface{}{
+					"RequestId": "abc",
+					"Retried":   true,
+					"Attempts":  3,
+					"Tags":      []string{"a", "b"},
+				})
+			},
+			`{"Attempts":3,"RequestId":"abc","Requests":2,"Retried":true,"Service":"web","Tags":["a","b"],"_aws":{"Timestamp":0,"CloudWatchMetrics":[{"Namespace":"Test","Dimensions":[["Service"]],"Metrics":[{"Name":"Requests","Unit":"Count"}]}]}}` + "\n",
+		},
+		{
+			"a line each",
+			nil,
+			func(e *EMFWriter) error {
+				if err := e.Put("A", 1, "Count", nil); err != nil {
+					return err
+				}
+				return e.Put("B", 2, "Count", nil)
+			},
+			`{"A":1,"_aws":{"Timestamp":0,"CloudWatchMetrics":[{"Namespace":"Test","Dimensions":[[]],"Metrics":[{"Name":"A","Unit":"Count"}]}]}}` + "\n" +
+				`{"B":2,"_aws":{"Timestamp":0,"CloudWatchMetrics":[{"Namespace":"Test","Dimensions":[[]],"Metrics":[{"Name":"B","Unit":"Count"}]}]}}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			before := time.Now()
+			if err := tt.emit(NewEMFWriter(&buf, "Test", tt.dimensions)); err != nil {
+				t.Fatal(err)
+			}
+			if got := emfLines(t, &buf, before); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEMFWriterErrors(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEMFWriter(&buf, "Test", map[string]string{"Service": "web"})
+
+	if err := e.Put("Service", 1, "Count", nil); err == nil {
+		t.Error("metric named for a dimension didn't fail")
+	}
+	if err := e.Put("NaN", math.NaN(), "Count", nil); err == nil {
+		t.Error("NaN didn't fail")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("failures wrote %q", buf.String())
+	}
+}
+
+func TestEMFWriterMetricQuery(t *testing.T) {
+	e := NewEMFWriter(nil, "Test", map[string]string{"Service": "web", "Stage": "prod"})
+	q := e.MetricQuery("Latency", "Milliseconds", map[string]string{"Stage": "test"}, "Maximum")
+
+	if q.Namespace != "Test" || q.MetricName != "Latency" || q.Unit != "Milliseconds" || len(q.Statistics) != 1 {
+		t.Errorf("got %+v", *q)
+	}
+	// The same dimensions as Put would write
+	if len(q.Dimensions) != 2 || q.Dimensions["Service"] != "web" || q.Dimensions["Stage"] != "test" {
+		t.Errorf("got dimensions %v", q.Dimensions)
+	}
+}
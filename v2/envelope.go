@@ -0,0 +1,486 @@
+package aws
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// Envelope ciphertexts start with a self-describing header:
+//
+//	magic "AWLE" | version (1 byte) | wrapped key length (uint16) | wrapped key |
+//	chunk size (uint32) | salt (32 bytes) | nonce prefix (7 bytes)
+//
+// followed by chunks, each a uint32 length and an AES-256-GCM sealed chunk. Each stream is
+// sealed with its own key, derived from the data key and the salt with HKDF-SHA256, so a
+// cached data key can be used for any number of streams. Each chunk's nonce is the prefix,
+// a uint32 counter, and a final-chunk flag, so chunks can't be reordered or truncated, and
+// the whole header is authenticated with every chunk.
+const (
+	envelopeMagic         = "AWLE"
+	envelopeVersion       = 1
+	envelopeSalt          = 32
+	envelopeNoncePre      = 7
+	envelopeChunkBytes    = 64 * 1024
+	envelopeMaxChunkBytes = 16 * 1024 * 1024
+	envelopeKeyInfo       = "awslib envelope v1"
+)
+
+var (
+	// ErrBadEnvelope is returned when an envelope ciphertext is malformed, or fails authentication
+	ErrBadEnvelope = errors.New("bad envelope ciphertext")
+
+	// DataKeyCacheSize is the most unwrapped data keys a data key cache holds for decryption.
+	// The least recently used is evicted to make room.
+	DataKeyCacheSize = 1000
+)
+
+// dataKey is a plaintext data key and its KMS-wrapped form
+type dataKey struct {
+	plaintext []byte
+	wrapped   []byte
+	created   time.Time
+	used      time.Time
+	uses      int
+}
+
+// dataKeyCache caches data keys to reduce KMS calls. Keys for encryption are cached by KMS key
+// and encryption context, and unwrapped keys by wrapped key and encryption context, so a key is
+// only ever used with the context KMS bound it to.
+type dataKeyCache struct {
+	maxAge  time.Duration
+	maxUses int
+
+	mu        sync.Mutex
+	encrypt   map[string]*dataKey
+	unwrapped map[string]*dataKey
+}
+
+// EnableDataKeyCache caches data keys, for up to maxAge and maxUses (0 is unlimited) each,
+// to reduce the number of KMS calls made by envelope encryption and decryption. Each
+// envelope is sealed with a key derived from the data key, so reuse is safe, but limits
+// how much a single leaked data key exposes. At most DataKeyCacheSize keys are kept for
+// decryption.
+func (k *KMSSession) EnableDataKeyCache(maxAge time.Duration, maxUses int) {
+	k.cache = &dataKeyCache{
+		maxAge:    maxAge,
+		maxUses:   maxUses,
+		encrypt:   make(map[string]*dataKey),
+		unwrapped: make(map[string]*dataKey),
+	}
+}
+
+// get returns a live cached key from the map, or nil, counting the use
+func (c *dataKeyCache) get(m map[string]*dataKey, id string) *dataKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dk, ok := m[id]
+	if !ok {
+		return nil
+	}
+	if (c.maxAge > 0 && time.Since(dk.created) > c.maxAge) || (c.maxUses > 0 && dk.uses >= c.maxUses) {
+		delete(m, id)
+		return nil
+	}
+	dk.uses++
+	dk.used = time.Now()
+	return dk
+}
+
+// addUnwrapped caches an unwrapped data key by id, evicting the least recently used if full
+func (c *dataKeyCache) addUnwrapped(id string, dk *dataKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.unwrapped[id]; !ok && len(c.unwrapped) >= max(DataKeyCacheSize, 1) {
+		var (
+			lru  string
+			last time.Time
+		)
+		for id, cached := range c.unwrapped {
+			if lru == "" || cached.used.Before(last) {
+				lru, last = id, cached.used
+			}
+		}
+		delete(c.unwrapped, lru)
+	}
+	c.unwrapped[id] = dk
+}
+
+// cacheID returns the cache ID for a key ID or wrapped key, and an encryption context
+func cacheID(id string, context map[string]string) string {
+	if len(context) == 0 {
+		return id
+	}
+	// Map keys are sorted, so this is canonical
+	b, _ := json.Marshal(context)
+	return id + "\x00" + string(b)
+}
+
+// EnvelopeEncrypt encrypts plaintext of any size locally with a KMS data key,
+// returning a self-describing ciphertext that includes the wrapped key
+func (k *KMSSession) EnvelopeEncrypt(plaintext []byte) ([]byte, error) {
+	return k.EnvelopeEncryptWithContext(plaintext, nil)
+}
+
+// EnvelopeEncryptWithContext is EnvelopeEncrypt, with the data key bound to the encryption context,
+// which must be provided again to decrypt it. The context is not stored in the ciphertext.
+func (k *KMSSession) EnvelopeEncryptWithContext(plaintext []byte, context map[string]string) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := k.EncryptWriterWithContext(&buf, context)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EnvelopeDecrypt decrypts a ciphertext produced by EnvelopeEncrypt or EncryptWriter
+func (k *KMSSession) EnvelopeDecrypt(ciphertext []byte) ([]byte, error) {
+	return k.EnvelopeDecryptWithContext(ciphertext, nil)
+}
+
+// EnvelopeDecryptWithContext decrypts a ciphertext produced with the same encryption context by
+// EnvelopeEncryptWithContext or EncryptWriterWithContext
+func (k *KMSSession) EnvelopeDecryptWithContext(ciphertext []byte, context map[string]string) ([]byte, error) {
+	r, err := k.DecryptReaderWithContext(bytes.NewReader(ciphertext), context)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// EncryptWriter returns an io.WriteCloser that envelope-encrypts everything written to it
+// onto w. Close must be called to write the final chunk; it does not close w.
+func (k *KMSSession) EncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	return k.EncryptWriterWithContext(w, nil)
+}
+
+// EncryptWriterWithContext is EncryptWriter, with the data key bound to the encryption context,
+// which must be provided again to decrypt it
+func (k *KMSSession) EncryptWriterWithContext(w io.Writer, context map[string]string) (io.WriteCloser, error) {
+	dk, err := k.encryptionKey(context)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, envelopeSalt+envelopeNoncePre)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	salt, prefix := salt[:envelopeSalt], salt[envelopeSalt:]
+
+	aead, err := newGCM(streamKey(dk.plaintext, salt))
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(envelopeMagic)+1+2+len(dk.wrapped)+4+envelopeSalt+envelopeNoncePre)
+	header = append(header, envelopeMagic...)
+	header = append(header, envelopeVersion)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(dk.wrapped)))
+	header = append(header, dk.wrapped...)
+	header = binary.BigEndian.AppendUint32(header, envelopeChunkBytes)
+	header = append(header, salt...)
+	header = append(header, prefix...)
+
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &envelopeWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		prefix: prefix,
+		buf:    make([]byte, 0, envelopeChunkBytes),
+	}, nil
+}
+
+// DecryptReader returns an io.Reader that decrypts the envelope ciphertext read from r
+func (k *KMSSession) DecryptReader(r io.Reader) (io.Reader, error) {
+	return k.DecryptReaderWithContext(r, nil)
+}
+
+// DecryptReaderWithContext returns an io.Reader that decrypts the envelope ciphertext read from r,
+// which must have been encrypted with the same encryption context
+func (k *KMSSession) DecryptReaderWithContext(r io.Reader, context map[string]string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	fixed := make([]byte, len(envelopeMagic)+1+2)
+	if _, err := io.ReadFull(br, fixed); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadEnvelope, err)
+	}
+	if string(fixed[:len(envelopeMagic)]) != envelopeMagic {
+		return nil, fmt.Errorf("%w: not an envelope", ErrBadEnvelope)
+	}
+	if fixed[len(envelopeMagic)] != envelopeVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadEnvelope, fixed[len(envelopeMagic)])
+	}
+
+	wrapped := make([]byte, binary.BigEndian.Uint16(fixed[len(envelopeMagic)+1:]))
+	if _, err := io.ReadFull(br, wrapped); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadEnvelope, err)
+	}
+	rest := make([]byte, 4+envelopeSalt+envelopeNoncePre)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadEnvelope, err)
+	}
+	chunkSize := binary.BigEndian.Uint32(rest)
+	if chunkSize == 0 || chunkSize > envelopeMaxChunkBytes {
+		return nil, fmt.Errorf("%w: chunk size %d out of range", ErrBadEnvelope, chunkSize)
+	}
+
+	key, err := k.decryptionKey(wrapped, context)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(streamKey(key, rest[4:4+envelopeSalt]))
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(fixed)+len(wrapped)+len(rest))
+	header = append(header, fixed...)
+	header = append(header, wrapped...)
+	header = append(header, rest...)
+
+	return &envelopeReader{
+		r:         br,
+		aead:      aead,
+		header:    header,
+		prefix:    rest[4+envelopeSalt:],
+		chunkSize: int(chunkSize),
+	}, nil
+}
+
+// encryptionKey returns a data key bound to the encryption context, from the cache if possible
+func (k *KMSSession) encryptionKey(context map[string]string) (*dataKey, error) {
+	id := cacheID(k.keyId, context)
+	if k.cache != nil {
+		if dk := k.cache.get(k.cache.encrypt, id); dk != nil {
+			return dk, nil
+		}
+	}
+
+	resp, err := k.client.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:             aws.String(k.keyId),
+		KeySpec:           aws.String(kms.DataKeySpecAes256),
+		EncryptionContext: contextMap(context),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dk := dataKey{
+		plaintext: resp.Plaintext,
+		wrapped:   resp.CiphertextBlob,
+		created:   time.Now(),
+		uses:      1,
+	}
+	if k.cache != nil {
+		k.cache.mu.Lock()
+		k.cache.encrypt[id] = &dk
+		k.cache.mu.Unlock()
+	}
+	return &dk, nil
+}
+
+// decryptionKey unwraps a data key bound to the encryption context, from the cache if possible
+func (k *KMSSession) decryptionKey(wrapped []byte, context map[string]string) ([]byte, error) {
+	id := cacheID(string(wrapped), context)
+	if k.cache != nil {
+		if dk := k.cache.get(k.cache.unwrapped, id); dk != nil {
+			return dk.plaintext, nil
+		}
+	}
+
+	resp, err := k.client.Decrypt(&kms.DecryptInput{
+		CiphertextBlob:    wrapped,
+		EncryptionContext: contextMap(context),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = k.verifyKey(aws.StringValue(resp.KeyId)); err != nil {
+		return nil, err
+	}
+
+	if k.cache != nil {
+		now := time.Now()
+		k.cache.addUnwrapped(id, &dataKey{
+			plaintext: resp.Plaintext,
+			wrapped:   wrapped,
+			created:   now,
+			used:      now,
+			uses:      1,
+		})
+	}
+	return resp.Plaintext, nil
+}
+
+// streamKey derives the key for one stream from the data key and the stream's salt, using
+// HKDF-SHA256 (RFC 5869). A single block of output is all an AES-256 key needs.
+func streamKey(dataKey, salt []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(dataKey)
+
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(envelopeKeyInfo))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// newGCM returns an AES-GCM AEAD for the key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce for chunk number n
+func chunkNonce(prefix []byte, n uint32, final bool) []byte {
+	nonce := make([]byte, 0, envelopeNoncePre+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, n)
+	if final {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// envelopeWriter is the io.WriteCloser returned by EncryptWriter
+type envelopeWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+	buf    []byte
+	n      uint32
+	closed bool
+}
+
+// Write buffers p, sealing and writing every full chunk
+func (e *envelopeWriter) Write(p []byte) (written int, err error) {
+	if e.closed {
+		return 0, errors.New("write to closed EncryptWriter")
+	}
+
+	for len(p) > 0 {
+		if len(e.buf) == envelopeChunkBytes {
+			// Only seal a full chunk once we know it isn't the last
+			if err = e.seal(false); err != nil {
+				return
+			}
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return
+}
+
+// Close seals and writes the final chunk
+func (e *envelopeWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+// seal encrypts and writes the buffered chunk
+func (e *envelopeWriter) seal(final bool) error {
+	if e.n == ^uint32(0) {
+		return errors.New("envelope too large")
+	}
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.n, final), e.buf, e.header)
+	e.n++
+	e.buf = e.buf[:0]
+
+	if _, err := e.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(sealed)))); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// envelopeReader is the io.Reader returned by DecryptReader
+type envelopeReader struct {
+	r         *bufio.Reader
+	aead      cipher.AEAD
+	header    []byte
+	prefix    []byte
+	chunkSize int
+	plain     []byte
+	n         uint32
+	done      bool
+}
+
+// Read returns decrypted plaintext, reading and opening chunks as needed
+func (e *envelopeReader) Read(p []byte) (int, error) {
+	for len(e.plain) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, e.plain)
+	e.plain = e.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk
+func (e *envelopeReader) open() error {
+	lb := make([]byte, 4)
+	if _, err := io.ReadFull(e.r, lb); err != nil {
+		return fmt.Errorf("%w: truncated", ErrBadEnvelope)
+	}
+	size := int(binary.BigEndian.Uint32(lb))
+	if size > e.chunkSize+e.aead.Overhead() {
+		return fmt.Errorf("%w: chunk too large", ErrBadEnvelope)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(e.r, sealed); err != nil {
+		return fmt.Errorf("%w: truncated", ErrBadEnvelope)
+	}
+
+	// The final chunk is the one with nothing after it
+	_, perr := e.r.Peek(1)
+	final := perr == io.EOF
+
+	plain, err := e.aead.Open(sealed[:0], chunkNonce(e.prefix, e.n, final), sealed, e.header)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadEnvelope, err)
+	}
+	e.n++
+	e.plain = plain
+	e.done = final
+	return nil
+}
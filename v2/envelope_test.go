@@ -0,0 +1,306 @@
+package aws
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// newTestEnvelopeKMS returns a KMSSession on a FakeKMS key
+func newTestEnvelopeKMS(t *testing.T) *KMSSession {
+	t.Helper()
+	f := NewFakeKMS()
+	arn, err := f.AddKey("alias/envelope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewKMSSessionWithClient(f, arn)
+}
+
+// randomBytes returns n random bytes
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	k := newTestEnvelopeKMS(t)
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"one chunk", envelopeChunkBytes},
+		{"chunk and a byte", envelopeChunkBytes + 1},
+		{"several chunks", 3*envelopeChunkBytes + 17},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext := randomBytes(t, tt.size)
+
+			ct, err := k.EnvelopeEncrypt(plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := k.EnvelopeDecrypt(ct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Errorf("decrypted %d bytes don't match the %d encrypted", len(got), len(plaintext))
+			}
+		})
+	}
+}
+
+func TestEnvelopeStreaming(t *testing.T) {
+	k := newTestEnvelopeKMS(t)
+	plaintext := randomBytes(t, 2*envelopeChunkBytes+100)
+
+	var ct bytes.Buffer
+	w, err := k.EncryptWriter(&ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd-sized writes, straddling chunks
+	for p := plaintext; len(p) > 0; {
+		n := min(len(p), 1000)
+		if _, err = w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("x")); err == nil {
+		t.Error("write after Close succeeded")
+	}
+
+	r, err := k.DecryptReader(&ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Error("decrypted stream doesn't match")
+	}
+}
+
+func TestEnvelopeTampering(t *testing.T) {
+	k := newTestEnvelopeKMS(t)
+	ct, err := k.EnvelopeEncrypt(randomBytes(t, 2*envelopeChunkBytes+100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wrapLen   = int(binary.BigEndian.Uint16(ct[len(envelopeMagic)+1:]))
+		headerLen = len(envelopeMagic) + 1 + 2 + wrapLen + 4 + envelopeSalt + envelopeNoncePre
+		chunkLen  = 4 + envelopeChunkBytes + 16
+	)
+
+	tests := []struct {
+		name   string
+		mangle func(ct []byte) []byte
+	}{
+		{"bad magic", func(ct []byte) []byte { ct[0] = 'X'; return ct }},
+		{"bad version", func(ct []byte) []byte { ct[len(envelopeMagic)]++; return ct }},
+		{"flipped salt", func(ct []byte) []byte { ct[headerLen-envelopeNoncePre-1] ^= 1; return ct }},
+		{"flipped nonce prefix", func(ct []byte) []byte { ct[headerLen-1] ^= 1; return ct }},
+		{"flipped ciphertext", func(ct []byte) []byte { ct[headerLen+10] ^= 1; return ct }},
+		{"truncated header", func(ct []byte) []byte { return ct[:headerLen-1] }},
+		{"truncated chunk", func(ct []byte) []byte { return ct[:len(ct)-1] }},
+		{"dropped final chunk", func(ct []byte) []byte { return ct[:headerLen+2*chunkLen] }},
+		{"swapped chunks", func(ct []byte) []byte {
+			out := append([]byte(nil), ct[:headerLen]...)
+			out = append(out, ct[headerLen+chunkLen:headerLen+2*chunkLen]...)
+			out = append(out, ct[headerLen:headerLen+chunkLen]...)
+			return append(out, ct[headerLen+2*chunkLen:]...)
+		}},
+		{"huge chunk size", func(ct []byte) []byte {
+			binary.BigEndian.PutUint32(ct[headerLen-envelopeNoncePre-envelopeSalt-4:], 1<<31)
+			return ct
+		}},
+		{"zero chunk size", func(ct []byte) []byte {
+			binary.BigEndian.PutUint32(ct[headerLen-envelopeNoncePre-envelopeSalt-4:], 0)
+			return ct
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mangled := tt.mangle(append([]byte(nil), ct...))
+			if _, err := k.EnvelopeDecrypt(mangled); !errors.Is(err, ErrBadEnvelope) {
+				t.Errorf("got error %v, want %v", err, ErrBadEnvelope)
+			}
+		})
+	}
+}
+
+func TestEnvelopeDataKeyCache(t *testing.T) {
+	k := newTestEnvelopeKMS(t)
+	k.EnableDataKeyCache(time.Hour, 0)
+	plaintext := []byte("hello")
+
+	a, err := k.EnvelopeEncrypt(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := k.EnvelopeEncrypt(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same data key, but every envelope has its own salt, so its own key
+	wrapLen := int(binary.BigEndian.Uint16(a[len(envelopeMagic)+1:]))
+	saltAt := len(envelopeMagic) + 1 + 2 + wrapLen + 4
+	if !bytes.Equal(a[:saltAt], b[:saltAt]) {
+		t.Error("cached data key wasn't reused")
+	}
+	if bytes.Equal(a[saltAt:saltAt+envelopeSalt], b[saltAt:saltAt+envelopeSalt]) {
+		t.Error("envelopes share a salt")
+	}
+	if bytes.Equal(a[len(a)-len(plaintext)-16:], b[len(b)-len(plaintext)-16:]) {
+		t.Error("envelopes share a ciphertext")
+	}
+
+	for _, ct := range [][]byte{a, b} {
+		got, err := k.EnvelopeDecrypt(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("got %q, want %q", got, plaintext)
+		}
+	}
+}
+
+func TestEnvelopeDataKeyCacheMaxUses(t *testing.T) {
+	k := newTestEnvelopeKMS(t)
+	k.EnableDataKeyCache(time.Hour, 2)
+
+	wrapped := func() string {
+		ct, err := k.EnvelopeEncrypt([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapLen := int(binary.BigEndian.Uint16(ct[len(envelopeMagic)+1:]))
+		return string(ct[len(envelopeMagic)+3 : len(envelopeMagic)+3+wrapLen])
+	}
+
+	first, second, third := wrapped(), wrapped(), wrapped()
+	if first != second {
+		t.Error("data key not reused within maxUses")
+	}
+	if second == third {
+		t.Error("data key reused beyond maxUses")
+	}
+}
+
+func TestEnvelopeUnwrappedCacheSize(t *testing.T) {
+	defer func(size int) { DataKeyCacheSize = size }(DataKeyCacheSize)
+	DataKeyCacheSize = 2
+
+	k := newTestEnvelopeKMS(t)
+	k.EnableDataKeyCache(time.Hour, 0)
+	// Encrypting without the cache gives a new data key every time
+	enc := NewKMSSessionWithClient(k.client, k.keyId)
+
+	for i := 0; i < 5; i++ {
+		ct, err := enc.EnvelopeEncrypt([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = k.EnvelopeDecrypt(ct); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(k.cache.unwrapped); n > DataKeyCacheSize {
+			t.Fatalf("%d unwrapped keys cached, want at most %d", n, DataKeyCacheSize)
+		}
+	}
+}
+
+func TestEnvelopeEncryptionContext(t *testing.T) {
+	k := newTestEnvelopeKMS(t)
+	plaintext := randomBytes(t, envelopeChunkBytes+1)
+	ctx := map[string]string{"tenant": "a"}
+
+	ct, err := k.EnvelopeEncryptWithContext(plaintext, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		context map[string]string
+		code    string
+	}{
+		{"same", map[string]string{"tenant": "a"}, ""},
+		{"different", map[string]string{"tenant": "b"}, kms.ErrCodeInvalidCiphertextException},
+		{"missing", nil, kms.ErrCodeInvalidCiphertextException},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := k.EnvelopeDecryptWithContext(ct, tt.context)
+			if code := awsCode(err); code != tt.code {
+				t.Fatalf("got error %v, want code %q", err, tt.code)
+			}
+			if tt.code == "" && !bytes.Equal(got, plaintext) {
+				t.Error("decrypted plaintext doesn't match")
+			}
+		})
+	}
+
+	// Without a context, as EnvelopeDecrypt
+	plain, err := k.EnvelopeEncrypt(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = k.EnvelopeDecryptWithContext(plain, ctx); awsCode(err) != kms.ErrCodeInvalidCiphertextException {
+		t.Errorf("got error %v decrypting with an unexpected context", err)
+	}
+}
+
+func TestEnvelopeDataKeyCacheContext(t *testing.T) {
+	k := newTestEnvelopeKMS(t)
+	k.EnableDataKeyCache(time.Hour, 0)
+	a, b := map[string]string{"tenant": "a"}, map[string]string{"tenant": "b"}
+
+	ctA, err := k.EnvelopeEncryptWithContext([]byte("hello"), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctB, err := k.EnvelopeEncryptWithContext([]byte("hello"), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(k.cache.encrypt) != 2 {
+		t.Errorf("%d data keys cached for encryption, want one per context", len(k.cache.encrypt))
+	}
+
+	// Once unwrapped and cached under one context, a data key isn't used for another
+	if _, err = k.EnvelopeDecryptWithContext(ctA, a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = k.EnvelopeDecryptWithContext(ctA, b); awsCode(err) != kms.ErrCodeInvalidCiphertextException {
+		t.Errorf("got error %v decrypting a cached key with the wrong context", err)
+	}
+	if _, err = k.EnvelopeDecryptWithContext(ctB, b); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,234 @@
+package aws
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ETagConcurrency is the number of parts ETags are hashed with at once. Hashing a reader
+	// buffers a part per worker, so this times the part size is the memory used.
+	ETagConcurrency = 4
+
+	// ETagPartSizesMB are the part sizes MatchETag tries, in order: the s3manager and
+	// AWS CLI defaults, and other common choices
+	ETagPartSizesMB = []int64{5, 8, 16, 64, 100}
+)
+
+// CalculateETag reads r to EOF, and returns the ETag S3 gives it when uploaded in partSizeMB
+// parts: the MD5 if it fits in one part, otherwise the MD5 of the parts' MD5s, and "-parts".
+func CalculateETag(r io.Reader, partSizeMB int64) (etag string, err error) {
+	if partSizeMB < 1 {
+		return "", errors.New("part size must be at least 1MB")
+	}
+
+	partSize := partSizeMB * 1024 * 1024
+	var (
+		workers = max(ETagConcurrency, 1)
+		free    = make(chan []byte, workers)
+	)
+	sums, err := md5Parts(workers, func() (io.Reader, func(), error) {
+		var buf []byte
+		select {
+		case buf = <-free:
+		default:
+			buf = make([]byte, partSize)
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return nil, nil, err
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+		return bytes.NewReader(buf[:n]), func() { free <- buf }, nil
+	})
+	if err != nil {
+		return
+	}
+	return formatETag(sums, false), nil
+}
+
+// MatchETag returns true if the file's contents match the S3 ETag. Multipart ETags are
+// compared using each of ETagPartSizesMB that gives the same number of parts, so files
+// uploaded with other part sizes don't match. ETags that aren't MD5s, e.g. those of objects
+// encrypted with SSE-KMS or SSE-C, never match.
+func MatchETag(filename, etag string) (bool, error) {
+	return matchETag(filename, etag, ETagPartSizesMB)
+}
+
+// matchETag is MatchETag, trying the part sizes given
+func matchETag(filename, etag string, partSizesMB []int64) (bool, error) {
+	etag = strings.Trim(etag, `"`)
+	if !md5ETag.MatchString(etag) {
+		return false, nil
+	}
+
+	i := strings.LastIndex(etag, "-")
+	if i < 0 {
+		sum, err := fileMD5(filename)
+		return sum == etag, err
+	}
+
+	parts, _ := strconv.ParseInt(etag[i+1:], 10, 64)
+	if parts < 1 {
+		return false, nil
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return false, err
+	}
+
+	for _, partSize := range etagPartSizes(fi.Size(), parts, partSizesMB) {
+		local, err := fileETag(filename, partSize, true)
+		if err != nil {
+			return false, err
+		}
+		if local == etag {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// etagPartSizes returns the part sizes in partSizesMB, in bytes, that split size bytes into the
+// number of parts, without duplicates. A single part could be any size from the file's up, all
+// giving the same ETag, so that's the only one returned. An empty file is one empty part.
+func etagPartSizes(size, parts int64, partSizesMB []int64) (sizes []int64) {
+	if parts == 1 {
+		return []int64{max(size, 1)}
+	}
+	for _, mb := range partSizesMB {
+		partSize := mb * 1024 * 1024
+		if partSize < 1 || slices.Contains(sizes, partSize) || max((size+partSize-1)/partSize, 1) != parts {
+			// Can't be it
+			continue
+		}
+		sizes = append(sizes, partSize)
+	}
+	return
+}
+
+// fileETag returns the ETag of the file uploaded in partSize byte parts, hashing the parts
+// in place. If multipart, the multipart form is returned even if there's only one part.
+func fileETag(filename string, partSize int64, multipart bool) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	var offset int64
+	sums, err := md5Parts(max(ETagConcurrency, 1), func() (io.Reader, func(), error) {
+		// An empty file is one empty part
+		if offset > 0 && offset >= fi.Size() {
+			return nil, nil, io.EOF
+		}
+		part := io.NewSectionReader(file, offset, partSize)
+		offset += partSize
+		return part, func() {}, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return formatETag(sums, multipart), nil
+}
+
+// fileMD5 returns the hex MD5 of the file's contents, which is the ETag of a single-part upload
+func fileMD5(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := md5.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// md5Parts hashes the parts returned by next, until it returns io.EOF, on up to workers at a
+// time. next isn't called concurrently, nor more than workers parts ahead of the hashing.
+// release is called once a part has been hashed.
+func md5Parts(workers int, next func() (part io.Reader, release func(), err error)) (sums [][]byte, err error) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		hashErr error
+		sem     = make(chan struct{}, workers)
+	)
+
+	for i := 0; ; i++ {
+		sem <- struct{}{}
+		part, release, nerr := next()
+		if nerr != nil {
+			<-sem
+			if nerr != io.EOF {
+				err = nerr
+			}
+			break
+		}
+
+		mu.Lock()
+		sums = append(sums, nil)
+		mu.Unlock()
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer release()
+
+			h := md5.New()
+			_, herr := io.Copy(h, part)
+
+			mu.Lock()
+			defer mu.Unlock()
+			sums[i] = h.Sum(nil)
+			if herr != nil && hashErr == nil {
+				hashErr = herr
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err == nil {
+		err = hashErr
+	}
+	return
+}
+
+// formatETag returns the ETag for the part MD5s: the MD5 of a single part, unless multipart
+func formatETag(sums [][]byte, multipart bool) string {
+	if !multipart {
+		switch len(sums) {
+		case 0:
+			sum := md5.Sum(nil)
+			return hex.EncodeToString(sum[:])
+		case 1:
+			return hex.EncodeToString(sums[0])
+		}
+	}
+
+	h := md5.New()
+	for _, sum := range sums {
+		h.Write(sum)
+	}
+	return fmt.Sprintf("%x-%d", h.Sum(nil), len(sums))
+}
@@ -0,0 +1,136 @@
+package aws
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// patternBytes returns n bytes of a repeating, non-zero pattern
+func patternBytes(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte((i*7 + 3) % 251)
+	}
+	return b
+}
+
+// writeTempFile writes data to a file in the test's temporary directory, returning its name
+func writeTempFile(t *testing.T, data []byte) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+const testMB = 1024 * 1024
+
+func TestCalculateETag(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		partSizeMB int64
+		etag       string
+	}{
+		{"empty", 0, 5, "d41d8cd98f00b204e9800998ecf8427e"},
+		{"tiny", 5, 5, "e318134e0ab2b7ab76c3876039f1c956"},
+		{"exactly one part", 5 * testMB, 5, "a5bd392d4335c1d62cbcea418a105fa9"},
+		{"one part and a byte", 5*testMB + 1, 5, "f4ee36c5de1a4f6118bfdc850a9d8528-2"},
+		{"three parts", 12 * testMB, 5, "16e955eee03ab14fda152eb08937371f-3"},
+		{"two parts", 12 * testMB, 8, "aa05b6ba9bf5c4b8c40d883399bbc8ff-2"},
+		{"two full parts", 16 * testMB, 8, "1c50fbcd1e18bb53c986bf6f5de4ce02-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etag, err := CalculateETag(bytes.NewReader(patternBytes(tt.size)), tt.partSizeMB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if etag != tt.etag {
+				t.Errorf("got %s, want %s", etag, tt.etag)
+			}
+		})
+	}
+}
+
+func TestCalculateETagBadPartSize(t *testing.T) {
+	if _, err := CalculateETag(bytes.NewReader(nil), 0); err == nil {
+		t.Error("part size 0 accepted")
+	}
+}
+
+func TestMatchETag(t *testing.T) {
+	var (
+		empty = writeTempFile(t, nil)
+		small = writeTempFile(t, patternBytes(5))
+		large = writeTempFile(t, patternBytes(12*testMB))
+	)
+
+	tests := []struct {
+		name     string
+		filename string
+		etag     string
+		match    bool
+	}{
+		{"single part", small, "e318134e0ab2b7ab76c3876039f1c956", true},
+		{"quoted", small, `"e318134e0ab2b7ab76c3876039f1c956"`, true},
+		{"single part mismatch", small, "d41d8cd98f00b204e9800998ecf8427e", false},
+		{"5MB parts", large, "16e955eee03ab14fda152eb08937371f-3", true},
+		{"8MB parts", large, "aa05b6ba9bf5c4b8c40d883399bbc8ff-2", true},
+		{"wrong part count", large, "aa05b6ba9bf5c4b8c40d883399bbc8ff-4", false},
+		{"unlisted 6MB parts", large, "eecd593f3e3df9d46efc624b3e858e77-2", false},
+		{"unlisted 4MB parts", large, "2bc32c1d298738dbb06a8937169df520-3", false},
+		{"one multipart part", small, "7e97a9a263b198bece070406afda5713-1", true},
+		{"empty multipart", empty, "59adb24ef3cdbe0297f05b395827453f-1", true},
+		{"empty", empty, "d41d8cd98f00b204e9800998ecf8427e", true},
+		{"not an MD5", small, "not-an-etag", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, err := MatchETag(tt.filename, tt.etag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match != tt.match {
+				t.Errorf("got %v, want %v", match, tt.match)
+			}
+		})
+	}
+}
+
+func TestMatchETagPartSizes(t *testing.T) {
+	large := writeTempFile(t, patternBytes(12*testMB))
+	match, err := matchETag(large, "eecd593f3e3df9d46efc624b3e858e77-2", append([]int64{6}, ETagPartSizesMB...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !match {
+		t.Error("didn't match with the part size given")
+	}
+}
+
+func TestCalculateETagFile(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		size int
+		etag string
+	}{
+		{"empty", 0, "d41d8cd98f00b204e9800998ecf8427e"},
+		{"single part", 5, "e318134e0ab2b7ab76c3876039f1c956"},
+		{"exactly one part", 5 * testMB, "a5bd392d4335c1d62cbcea418a105fa9"},
+		{"three parts", 12 * testMB, "16e955eee03ab14fda152eb08937371f-3"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			etag, err := Calculate_etag(writeTempFile(t, patternBytes(tt.size)), 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if etag != tt.etag {
+				t.Errorf("got %s, want %s", etag, tt.etag)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ toolchain go1.23.4
 require (
 	github.com/aws/aws-sdk-go v1.44.209
 	github.com/cognusion/go-timings v1.0.0
+	github.com/spf13/cast v1.5.0
 )
 
 require (
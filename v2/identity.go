@@ -0,0 +1,188 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+)
+
+var (
+	// ErrNotOnEC2 is returned (wrapped) when the EC2 instance identity document is unavailable
+	ErrNotOnEC2 = errors.New("not running on EC2")
+	// ErrNoIdentity is returned when no "who am I" source is available
+	ErrNoIdentity = errors.New("no identity source available")
+
+	// IdentityTimeout is the maximum amount of time spent on any one identity or region lookup
+	IdentityTimeout = 2 * time.Second
+)
+
+// Identity sources
+const (
+	IdentitySourceEC2    = "ec2"
+	IdentitySourceECS    = "ecs"
+	IdentitySourceLambda = "lambda"
+)
+
+// Identity describes where the running process is, from whichever source was available.
+// Exactly one of EC2, ECS or Lambda will be non-nil.
+type Identity struct {
+	Source           string
+	Region           string
+	AvailabilityZone string
+	AccountID        string
+	EC2              *ec2metadata.EC2InstanceIdentityDocument
+	ECS              *ECSTaskMetadata
+	Lambda           *LambdaEnvironment
+}
+
+// ECSTaskMetadata is the subset of the ECS task metadata (v4) we care about
+type ECSTaskMetadata struct {
+	Cluster          string `json:"Cluster"`
+	TaskARN          string `json:"TaskARN"`
+	Family           string `json:"Family"`
+	Revision         string `json:"Revision"`
+	AvailabilityZone string `json:"AvailabilityZone"`
+	LaunchType       string `json:"LaunchType"`
+}
+
+// LambdaEnvironment is the Lambda runtime's self-description, from its environment variables
+type LambdaEnvironment struct {
+	FunctionName    string
+	FunctionVersion string
+	MemorySize      string
+	LogGroupName    string
+	LogStreamName   string
+	Region          string
+}
+
+// GetMe returns the EC2 instance identity document for the running instance,
+// or an error wrapping ErrNotOnEC2. IMDSv2 session tokens are used when the
+// instance requires them.
+func (s *Session) GetMe() (*ec2metadata.EC2InstanceIdentityDocument, error) {
+	idd, err := s.getMe()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotOnEC2, err)
+	}
+	return &idd, nil
+}
+
+// Identity lazily determines, and caches, who and where we are, consulting Lambda
+// environment variables, ECS task metadata, and EC2 instance metadata, in that order.
+// If none are available, ErrNoIdentity is returned.
+func (s *Session) Identity() (*Identity, error) {
+	s.identOnce.Do(func() {
+		s.ident, s.identErr = s.findIdentity()
+	})
+	return s.ident, s.identErr
+}
+
+// findIdentity does the work for Identity
+func (s *Session) findIdentity() (*Identity, error) {
+
+	if l := lambdaEnvironment(); l != nil {
+		return &Identity{
+			Source: IdentitySourceLambda,
+			Region: l.Region,
+			Lambda: l,
+		}, nil
+	}
+
+	if uri := os.Getenv("ECS_CONTAINER_METADATA_URI_V4"); uri != "" {
+		task, err := ecsTaskMetadata(uri)
+		if err != nil {
+			DebugOut.Printf("ECS task metadata unavailable: %s\n", err)
+		} else {
+			ident := Identity{
+				Source:           IdentitySourceECS,
+				AvailabilityZone: task.AvailabilityZone,
+				ECS:              task,
+			}
+			if a, err := arn.Parse(task.TaskARN); err == nil {
+				ident.Region = a.Region
+				ident.AccountID = a.AccountID
+			}
+			return &ident, nil
+		}
+	}
+
+	// Me is only read here: it may be read concurrently by callers
+	me := s.Me
+	if me == nil {
+		var err error
+		if me, err = s.GetMe(); err != nil {
+			DebugOut.Printf("EC2 identity unavailable: %s\n", err)
+			return nil, ErrNoIdentity
+		}
+	}
+	return &Identity{
+		Source:           IdentitySourceEC2,
+		Region:           me.Region,
+		AvailabilityZone: me.AvailabilityZone,
+		AccountID:        me.AccountID,
+		EC2:              me,
+	}, nil
+}
+
+// lambdaEnvironment returns a LambdaEnvironment if we appear to be running in Lambda, or nil
+func lambdaEnvironment() *LambdaEnvironment {
+	name := os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+	if name == "" {
+		return nil
+	}
+	return &LambdaEnvironment{
+		FunctionName:    name,
+		FunctionVersion: os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
+		MemorySize:      os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"),
+		LogGroupName:    os.Getenv("AWS_LAMBDA_LOG_GROUP_NAME"),
+		LogStreamName:   os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME"),
+		Region:          os.Getenv("AWS_REGION"),
+	}
+}
+
+// ecsTaskMetadata fetches the task metadata from the ECS v4 metadata endpoint
+func ecsTaskMetadata(uri string) (*ECSTaskMetadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), IdentityTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(uri, "/")+"/task", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ECS task metadata returned %s", resp.Status)
+	}
+
+	var task ECSTaskMetadata
+	if err = json.NewDecoder(resp.Body).Decode(&task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// getMe grabs the InstanceIdentityDocument for the running instance
+func (s *Session) getMe() (ec2metadata.EC2InstanceIdentityDocument, error) {
+	// {DevpayProductCodes:[] AvailabilityZone:us-east-1d PrivateIP:10.2.21.50 Version:2017-09-30
+	//  Region:us-east-1 InstanceID:i-032681bb83e1de5cf BillingProducts:[] InstanceType:t2.medium
+	//  AccountID:929091317894 PendingTime:2018-06-27 18:06:50 +0000 UTC ImageID:ami-55ef662f KernelID:
+	//  RamdiskID: Architecture:x86_64}
+	ctx, cancel := context.WithTimeout(context.Background(), IdentityTimeout)
+	defer cancel()
+
+	// Don't spin on retries: off-EC2 this will never succeed
+	return ec2metadata.New(s.AWS, aws.NewConfig().WithMaxRetries(0)).GetInstanceIdentityDocumentWithContext(ctx)
+}
@@ -0,0 +1,253 @@
+package aws
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// ErrKeyNotAllowed is returned, once VerifyKey or AllowKeys has been called, when a ciphertext
+// was encrypted under a key other than the KMSSession's key, or one allowed with AllowKeys
+var ErrKeyNotAllowed = errors.New("ciphertext encrypted under a key that is not allowed")
+
+// KMSSession is a helper to easily [en|de]crypt strings using KMS. Encrypt and Decrypt are
+// limited to 4KB by KMS: use EnvelopeEncrypt and EnvelopeDecrypt for larger data.
+type KMSSession struct {
+	client kmsiface.KMSAPI
+	keyId  string
+	cache  *dataKeyCache
+
+	mu      sync.Mutex
+	verify  bool
+	allowed []string
+	arns    map[string]bool
+	gen     int
+}
+
+// NewKMSSession takes a keyID and returns a KMSSession.
+func (s *Session) NewKMSSession(keyId string) (ksession *KMSSession) {
+
+	ksession = &KMSSession{
+		client: kms.New(s.AWS),
+		keyId:  keyId,
+	}
+
+	return
+
+}
+
+// NewKMSSessionWithClient takes a KMS client, such as a FakeKMS, and a keyID, and returns a KMSSession
+func NewKMSSessionWithClient(client kmsiface.KMSAPI, keyId string) *KMSSession {
+	return &KMSSession{
+		client: client,
+		keyId:  keyId,
+	}
+}
+
+// Decrypt does just that on the provided ciphertext string
+func (k *KMSSession) Decrypt(ciphertext string) (decrypted string, err error) {
+	return k.DecryptWithContext(ciphertext, nil)
+}
+
+// DecryptWithContext decrypts the provided ciphertext string, which must have been encrypted with
+// the same encryption context. Once VerifyKey or AllowKeys has been called, the ciphertext must have been
+// encrypted under the KMSSession's key, or an allowed one, or ErrKeyNotAllowed is returned.
+func (k *KMSSession) DecryptWithContext(ciphertext string, context map[string]string, grantTokens ...string) (decrypted string, err error) {
+
+	decoded, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return
+	}
+
+	resp, err := k.client.Decrypt(&kms.DecryptInput{
+		CiphertextBlob:    decoded,
+		EncryptionContext: contextMap(context),
+		GrantTokens:       grantTokenSlice(grantTokens),
+	})
+	if err != nil {
+		return
+	}
+
+	if err = k.verifyKey(aws.StringValue(resp.KeyId)); err != nil {
+		return
+	}
+
+	decrypted = string(resp.Plaintext)
+	return
+
+}
+
+// Encrypt does just that on the provided plaintext string
+func (k *KMSSession) Encrypt(plaintext string) (encoded string, err error) {
+	return k.EncryptWithContext(plaintext, nil)
+}
+
+// EncryptWithContext encrypts the provided plaintext string, binding it to the encryption context,
+// which must be provided again to decrypt it
+func (k *KMSSession) EncryptWithContext(plaintext string, context map[string]string, grantTokens ...string) (encoded string, err error) {
+
+	resp, err := k.client.Encrypt(&kms.EncryptInput{
+		Plaintext:         []byte(plaintext),
+		KeyId:             aws.String(k.keyId),
+		EncryptionContext: contextMap(context),
+		GrantTokens:       grantTokenSlice(grantTokens),
+	})
+	if err != nil {
+		return
+	}
+
+	encoded = base64.StdEncoding.EncodeToString(resp.CiphertextBlob)
+	return
+
+}
+
+// ReEncrypt decrypts the provided ciphertext string and encrypts it under the KMSSession's key,
+// entirely within KMS, for rotating stored ciphertexts to a new key. Once VerifyKey or AllowKeys
+// has been called, KMS is told which source keys to accept, so a ciphertext under any other key is never
+// re-encrypted, and ErrKeyNotAllowed is returned. sourceContext and destinationContext may be
+// the same, or nil.
+func (k *KMSSession) ReEncrypt(ciphertext string, sourceContext, destinationContext map[string]string, grantTokens ...string) (encoded string, err error) {
+
+	decoded, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return
+	}
+
+	input := kms.ReEncryptInput{
+		CiphertextBlob:               decoded,
+		DestinationKeyId:             aws.String(k.keyId),
+		SourceEncryptionContext:      contextMap(sourceContext),
+		DestinationEncryptionContext: contextMap(destinationContext),
+		GrantTokens:                  grantTokenSlice(grantTokens),
+	}
+
+	sources := k.allowedKeys()
+	if sources == nil {
+		// Not verifying: KMS works out the source key
+		sources = []string{""}
+	}
+	for _, source := range sources {
+		if source != "" {
+			input.SourceKeyId = aws.String(source)
+		}
+
+		var resp *kms.ReEncryptOutput
+		resp, err = k.client.ReEncrypt(&input)
+		if aerr, ok := err.(awserr.Error); ok && source != "" && aerr.Code() == kms.ErrCodeIncorrectKeyException {
+			// Not this one
+			continue
+		} else if err != nil {
+			return
+		}
+
+		encoded = base64.StdEncoding.EncodeToString(resp.CiphertextBlob)
+		return
+	}
+
+	err = ErrKeyNotAllowed
+	return
+
+}
+
+// VerifyKey turns on verification of the key ciphertexts were encrypted under, by decryption
+// and ReEncrypt, allowing only the KMSSession's key. Use AllowKeys to allow others too.
+// Decryption may then need kms:DescribeKey, to resolve the key ID or alias to a key ARN.
+func (k *KMSSession) VerifyKey() {
+	k.AllowKeys()
+}
+
+// AllowKeys turns on verification of the key ciphertexts were encrypted under, by decryption
+// and ReEncrypt, allowing the KMSSession's key and any key IDs, ARNs or aliases given, e.g. the
+// old key when rotating with ReEncrypt. Decryption may then need kms:DescribeKey, to resolve
+// key IDs and aliases to key ARNs.
+func (k *KMSSession) AllowKeys(keyIds ...string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.verify = true
+	k.allowed = append(k.allowed, keyIds...)
+	k.arns = nil
+	k.gen++
+}
+
+// allowedKeys returns the KMSSession's key and the allowed keys, or nil if not verifying
+func (k *KMSSession) allowedKeys() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.verify {
+		return nil
+	}
+	keys := make([]string, 0, len(k.allowed)+1)
+	for _, id := range append([]string{k.keyId}, k.allowed...) {
+		if id != "" {
+			keys = append(keys, id)
+		}
+	}
+	return keys
+}
+
+// verifyKey returns ErrKeyNotAllowed unless the key ARN KMS reports a ciphertext was encrypted
+// under is the KMSSession's key, or an allowed one. Nothing is checked until VerifyKey or AllowKeys is called.
+func (k *KMSSession) verifyKey(keyArn string) error {
+	k.mu.Lock()
+	verify, arns, gen := k.verify, k.arns, k.gen
+	k.mu.Unlock()
+
+	if !verify {
+		return nil
+	}
+
+	if arns == nil {
+		// Resolve without holding the lock, so decrypts aren't serialized behind DescribeKey
+		arns = make(map[string]bool)
+		for _, id := range k.allowedKeys() {
+			if strings.HasPrefix(id, "arn:") && strings.Contains(id, ":key/") {
+				arns[id] = true
+				continue
+			}
+			// Key IDs, aliases and alias ARNs need resolving to the key ARN
+			resp, err := k.client.DescribeKey(&kms.DescribeKeyInput{
+				KeyId: aws.String(id),
+			})
+			if err != nil {
+				return fmt.Errorf("resolving key %s: %w", id, err)
+			}
+			arns[aws.StringValue(resp.KeyMetadata.Arn)] = true
+		}
+
+		k.mu.Lock()
+		if k.gen == gen {
+			k.arns = arns
+		}
+		k.mu.Unlock()
+	}
+
+	if !arns[keyArn] {
+		return fmt.Errorf("%w: %s", ErrKeyNotAllowed, keyArn)
+	}
+	return nil
+}
+
+// contextMap returns an encryption context for the KMS API, or nil if there isn't one
+func contextMap(context map[string]string) map[string]*string {
+	if len(context) == 0 {
+		return nil
+	}
+	return aws.StringMap(context)
+}
+
+// grantTokenSlice returns grant tokens for the KMS API, or nil if there aren't any
+func grantTokenSlice(grantTokens []string) []*string {
+	if len(grantTokens) == 0 {
+		return nil
+	}
+	return aws.StringSlice(grantTokens)
+}
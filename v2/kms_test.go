@@ -0,0 +1,284 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// countingKMS counts DescribeKey calls
+type countingKMS struct {
+	*FakeKMS
+	describes int
+}
+
+func (c *countingKMS) DescribeKey(input *kms.DescribeKeyInput) (*kms.DescribeKeyOutput, error) {
+	c.describes++
+	return c.FakeKMS.DescribeKey(input)
+}
+
+// newTestKMS returns a FakeKMS with the keys "alias/new", "alias/old" and "alias/other"
+func newTestKMS(t *testing.T) *FakeKMS {
+	t.Helper()
+	f := NewFakeKMS()
+	for _, alias := range []string{"alias/new", "alias/old", "alias/other"} {
+		if _, err := f.AddKey(alias); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f
+}
+
+// awsCode returns the awserr code of err, or ""
+func awsCode(err error) string {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code()
+	}
+	return ""
+}
+
+func TestKMSEncryptDecrypt(t *testing.T) {
+	f := newTestKMS(t)
+	k := NewKMSSessionWithClient(f, "alias/new")
+
+	ct, err := k.Encrypt("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := k.Decrypt(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt != "hello" {
+		t.Errorf("got %q, want %q", pt, "hello")
+	}
+}
+
+func TestKMSEncryptionContext(t *testing.T) {
+	f := newTestKMS(t)
+	k := NewKMSSessionWithClient(f, "alias/new")
+	ctx := map[string]string{"tenant": "a"}
+
+	ct, err := k.EncryptWithContext("hello", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		context map[string]string
+		code    string
+	}{
+		{"same", map[string]string{"tenant": "a"}, ""},
+		{"different", map[string]string{"tenant": "b"}, kms.ErrCodeInvalidCiphertextException},
+		{"extra", map[string]string{"tenant": "a", "x": "y"}, kms.ErrCodeInvalidCiphertextException},
+		{"missing", nil, kms.ErrCodeInvalidCiphertextException},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt, err := k.DecryptWithContext(ct, tt.context)
+			if code := awsCode(err); code != tt.code {
+				t.Fatalf("got error %v, want code %q", err, tt.code)
+			}
+			if tt.code == "" && pt != "hello" {
+				t.Errorf("got %q, want %q", pt, "hello")
+			}
+		})
+	}
+}
+
+func TestKMSDecryptDoesNotVerifyByDefault(t *testing.T) {
+	f := &countingKMS{FakeKMS: newTestKMS(t)}
+	other, err := NewKMSSessionWithClient(f, "alias/other").Encrypt("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := NewKMSSessionWithClient(f, "alias/new")
+	if _, err = k.Decrypt(other); err != nil {
+		t.Fatal(err)
+	}
+	if f.describes != 0 {
+		t.Errorf("DescribeKey called %d times, want 0", f.describes)
+	}
+}
+
+func TestKMSAllowKeys(t *testing.T) {
+	f := &countingKMS{FakeKMS: newTestKMS(t)}
+	encrypt := func(key string) string {
+		ct, err := NewKMSSessionWithClient(f, key).Encrypt("hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ct
+	}
+	var (
+		ctNew   = encrypt("alias/new")
+		ctOld   = encrypt("alias/old")
+		ctOther = encrypt("alias/other")
+	)
+
+	k := NewKMSSessionWithClient(f, "alias/new")
+	k.AllowKeys("alias/old")
+
+	tests := []struct {
+		name       string
+		ciphertext string
+		err        error
+	}{
+		{"own key", ctNew, nil},
+		{"allowed key", ctOld, nil},
+		{"other key", ctOther, ErrKeyNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := k.Decrypt(tt.ciphertext)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	// Aliases are resolved once
+	if f.describes != 2 {
+		t.Errorf("DescribeKey called %d times, want 2", f.describes)
+	}
+}
+
+func TestKMSVerifyKey(t *testing.T) {
+	f := newTestKMS(t)
+	other, err := NewKMSSessionWithClient(f, "alias/other").Encrypt("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := NewKMSSessionWithClient(f, "alias/new")
+	own, err := k.Encrypt("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.VerifyKey()
+
+	if _, err = k.Decrypt(own); err != nil {
+		t.Errorf("got error %v decrypting under the session key", err)
+	}
+	if _, err = k.Decrypt(other); !errors.Is(err, ErrKeyNotAllowed) {
+		t.Errorf("got error %v, want %v", err, ErrKeyNotAllowed)
+	}
+}
+
+func TestKMSReEncrypt(t *testing.T) {
+	f := newTestKMS(t)
+	ctOld, err := NewKMSSessionWithClient(f, "alias/old").EncryptWithContext("hello", map[string]string{"v": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctOther, err := NewKMSSessionWithClient(f, "alias/other").Encrypt("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := NewKMSSessionWithClient(f, "alias/new")
+	k.AllowKeys("alias/old")
+
+	re, err := k.ReEncrypt(ctOld, map[string]string{"v": "1"}, map[string]string{"v": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := k.DecryptWithContext(re, map[string]string{"v": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt != "hello" {
+		t.Errorf("got %q, want %q", pt, "hello")
+	}
+
+	// It's no longer under the old key
+	old := NewKMSSessionWithClient(f, "alias/old")
+	old.VerifyKey()
+	if _, err = old.DecryptWithContext(re, map[string]string{"v": "2"}); !errors.Is(err, ErrKeyNotAllowed) {
+		t.Errorf("got error %v, want %v", err, ErrKeyNotAllowed)
+	}
+
+	if _, err = k.ReEncrypt(ctOther, nil, nil); !errors.Is(err, ErrKeyNotAllowed) {
+		t.Errorf("got error %v, want %v", err, ErrKeyNotAllowed)
+	}
+}
+
+func TestKMSDisabledKey(t *testing.T) {
+	f := newTestKMS(t)
+	k := NewKMSSessionWithClient(f, "alias/new")
+	ct, err := k.Encrypt("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.DisableKey(&kms.DisableKeyInput{KeyId: aws.String("alias/new")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = k.Decrypt(ct); awsCode(err) != kms.ErrCodeDisabledException {
+		t.Errorf("got error %v, want code %q", err, kms.ErrCodeDisabledException)
+	}
+	if _, err = k.Encrypt("hello"); awsCode(err) != kms.ErrCodeDisabledException {
+		t.Errorf("got error %v, want code %q", err, kms.ErrCodeDisabledException)
+	}
+
+	if _, err = f.EnableKey(&kms.EnableKeyInput{KeyId: aws.String("alias/new")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = k.Decrypt(ct); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKMSNoSuchKey(t *testing.T) {
+	k := NewKMSSessionWithClient(newTestKMS(t), "alias/missing")
+	if _, err := k.Encrypt("hello"); awsCode(err) != kms.ErrCodeNotFoundException {
+		t.Errorf("got error %v, want code %q", err, kms.ErrCodeNotFoundException)
+	}
+}
+
+func TestFakeKMSWithContext(t *testing.T) {
+	f := newTestKMS(t)
+
+	out, err := f.EncryptWithContext(context.Background(), &kms.EncryptInput{
+		KeyId:     aws.String("alias/new"),
+		Plaintext: []byte("hello"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := f.DecryptWithContext(context.Background(), &kms.DecryptInput{CiphertextBlob: out.CiphertextBlob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dec.Plaintext) != "hello" {
+		t.Errorf("got %q, want %q", dec.Plaintext, "hello")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = f.DecryptWithContext(ctx, &kms.DecryptInput{CiphertextBlob: out.CiphertextBlob}); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestFakeKMSNotImplemented(t *testing.T) {
+	f := NewFakeKMS()
+
+	if _, err := f.ListKeys(&kms.ListKeysInput{}); awsCode(err) != "NotImplemented" {
+		t.Errorf("got error %v, want code NotImplemented", err)
+	}
+	if _, err := f.SignWithContext(context.Background(), &kms.SignInput{
+		KeyId:            aws.String("k"),
+		Message:          []byte("m"),
+		SigningAlgorithm: aws.String(kms.SigningAlgorithmSpecEcdsaSha256),
+	}); awsCode(err) != "NotImplemented" {
+		t.Errorf("got error %v, want code NotImplemented", err)
+	}
+}
@@ -0,0 +1,475 @@
+package aws
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// FakeKMS is an in-memory stand-in for KMS, for testing code that uses a KMSSession without AWS.
+// Pass it to NewKMSSessionWithClient. Keys are real AES-256 keys, ciphertexts are AES-GCM
+// sealed and bound to their encryption context, and keys may be referred to by ID, ARN, alias
+// or alias ARN. Errors are awserr.Errors with the same codes KMS uses. Only the symmetric
+// encryption operations, and key and alias management, are implemented, with or without
+// a context: anything else returns an error with the code "NotImplemented".
+type FakeKMS struct {
+	kmsiface.KMSAPI
+
+	region  string
+	account string
+
+	mu      sync.Mutex
+	keys    map[string]*fakeKey
+	aliases map[string]string
+}
+
+// fakeKey is a FakeKMS key
+type fakeKey struct {
+	id      string
+	arn     string
+	key     []byte
+	enabled bool
+	created time.Time
+}
+
+// NewFakeKMS returns an empty FakeKMS. Keys are created with CreateKey or AddKey.
+func NewFakeKMS() *FakeKMS {
+	return &FakeKMS{
+		KMSAPI:  notImplementedKMS(),
+		region:  "us-east-1",
+		account: "000000000000",
+		keys:    make(map[string]*fakeKey),
+		aliases: make(map[string]string),
+	}
+}
+
+// AddKey creates an enabled key, with the alias (e.g. "alias/test") if it isn't empty, returning its ARN
+func (f *FakeKMS) AddKey(alias string) (string, error) {
+	resp, err := f.CreateKey(&kms.CreateKeyInput{})
+	if err != nil {
+		return "", err
+	}
+	if alias != "" {
+		if _, err = f.CreateAlias(&kms.CreateAliasInput{
+			AliasName:   aws.String(alias),
+			TargetKeyId: resp.KeyMetadata.KeyId,
+		}); err != nil {
+			return "", err
+		}
+	}
+	return aws.StringValue(resp.KeyMetadata.Arn), nil
+}
+
+// CreateKey creates an enabled symmetric key
+func (f *FakeKMS) CreateKey(input *kms.CreateKeyInput) (*kms.CreateKeyOutput, error) {
+	id, err := fakeUUID()
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	k := fakeKey{
+		id:      id,
+		arn:     fmt.Sprintf("arn:aws:kms:%s:%s:key/%s", f.region, f.account, id),
+		key:     key,
+		enabled: true,
+		created: time.Now(),
+	}
+
+	f.mu.Lock()
+	f.keys[id] = &k
+	f.mu.Unlock()
+
+	return &kms.CreateKeyOutput{KeyMetadata: k.metadata()}, nil
+}
+
+// CreateAlias points a new alias at a key
+func (f *FakeKMS) CreateAlias(input *kms.CreateAliasInput) (*kms.CreateAliasOutput, error) {
+	alias := aws.StringValue(input.AliasName)
+	if !strings.HasPrefix(alias, "alias/") || strings.HasPrefix(alias, "alias/aws/") {
+		return nil, awserr.New(kms.ErrCodeInvalidAliasNameException, "invalid alias name "+alias, nil)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.aliases[alias]; ok {
+		return nil, awserr.New(kms.ErrCodeAlreadyExistsException, "alias "+alias+" already exists", nil)
+	}
+	k, err := f.lookup(aws.StringValue(input.TargetKeyId))
+	if err != nil {
+		return nil, err
+	}
+	f.aliases[alias] = k.id
+	return &kms.CreateAliasOutput{}, nil
+}
+
+// DisableKey disables a key, so it can't be used to encrypt or decrypt
+func (f *FakeKMS) DisableKey(input *kms.DisableKeyInput) (*kms.DisableKeyOutput, error) {
+	return &kms.DisableKeyOutput{}, f.setEnabled(aws.StringValue(input.KeyId), false)
+}
+
+// EnableKey re-enables a disabled key
+func (f *FakeKMS) EnableKey(input *kms.EnableKeyInput) (*kms.EnableKeyOutput, error) {
+	return &kms.EnableKeyOutput{}, f.setEnabled(aws.StringValue(input.KeyId), true)
+}
+
+// DescribeKey returns the metadata of a key
+func (f *FakeKMS) DescribeKey(input *kms.DescribeKeyInput) (*kms.DescribeKeyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	k, err := f.lookup(aws.StringValue(input.KeyId))
+	if err != nil {
+		return nil, err
+	}
+	return &kms.DescribeKeyOutput{KeyMetadata: k.metadata()}, nil
+}
+
+// Encrypt encrypts up to 4KB of plaintext under a key
+func (f *FakeKMS) Encrypt(input *kms.EncryptInput) (*kms.EncryptOutput, error) {
+	if len(input.Plaintext) == 0 || len(input.Plaintext) > 4096 {
+		return nil, awserr.New("ValidationException", "plaintext must be 1 to 4096 bytes", nil)
+	}
+
+	k, blob, err := f.encrypt(aws.StringValue(input.KeyId), input.Plaintext, input.EncryptionContext)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.EncryptOutput{
+		CiphertextBlob:      blob,
+		KeyId:               aws.String(k.arn),
+		EncryptionAlgorithm: aws.String(kms.EncryptionAlgorithmSpecSymmetricDefault),
+	}, nil
+}
+
+// Decrypt decrypts a ciphertext, which must have the same encryption context it was encrypted with
+func (f *FakeKMS) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	k, plaintext, err := f.decrypt(input.CiphertextBlob, aws.StringValue(input.KeyId), input.EncryptionContext)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.DecryptOutput{
+		Plaintext:           plaintext,
+		KeyId:               aws.String(k.arn),
+		EncryptionAlgorithm: aws.String(kms.EncryptionAlgorithmSpecSymmetricDefault),
+	}, nil
+}
+
+// ReEncrypt decrypts a ciphertext and encrypts it under another key
+func (f *FakeKMS) ReEncrypt(input *kms.ReEncryptInput) (*kms.ReEncryptOutput, error) {
+	sk, plaintext, err := f.decrypt(input.CiphertextBlob, aws.StringValue(input.SourceKeyId), input.SourceEncryptionContext)
+	if err != nil {
+		return nil, err
+	}
+	dk, blob, err := f.encrypt(aws.StringValue(input.DestinationKeyId), plaintext, input.DestinationEncryptionContext)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.ReEncryptOutput{
+		CiphertextBlob: blob,
+		SourceKeyId:    aws.String(sk.arn),
+		KeyId:          aws.String(dk.arn),
+	}, nil
+}
+
+// GenerateDataKey returns a new data key, in plaintext and encrypted under a key
+func (f *FakeKMS) GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	size := int(aws.Int64Value(input.NumberOfBytes))
+	switch aws.StringValue(input.KeySpec) {
+	case kms.DataKeySpecAes256:
+		size = 32
+	case kms.DataKeySpecAes128:
+		size = 16
+	}
+	if size < 1 || size > 1024 {
+		return nil, awserr.New("ValidationException", "one of KeySpec or NumberOfBytes is required", nil)
+	}
+
+	plaintext := make([]byte, size)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, err
+	}
+	k, blob, err := f.encrypt(aws.StringValue(input.KeyId), plaintext, input.EncryptionContext)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GenerateDataKeyOutput{
+		Plaintext:      plaintext,
+		CiphertextBlob: blob,
+		KeyId:          aws.String(k.arn),
+	}, nil
+}
+
+// CreateKeyWithContext is CreateKey, failing if the context is done
+func (f *FakeKMS) CreateKeyWithContext(ctx aws.Context, input *kms.CreateKeyInput, opts ...request.Option) (*kms.CreateKeyOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.CreateKey(input)
+}
+
+// CreateAliasWithContext is CreateAlias, failing if the context is done
+func (f *FakeKMS) CreateAliasWithContext(ctx aws.Context, input *kms.CreateAliasInput, opts ...request.Option) (*kms.CreateAliasOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.CreateAlias(input)
+}
+
+// DisableKeyWithContext is DisableKey, failing if the context is done
+func (f *FakeKMS) DisableKeyWithContext(ctx aws.Context, input *kms.DisableKeyInput, opts ...request.Option) (*kms.DisableKeyOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.DisableKey(input)
+}
+
+// EnableKeyWithContext is EnableKey, failing if the context is done
+func (f *FakeKMS) EnableKeyWithContext(ctx aws.Context, input *kms.EnableKeyInput, opts ...request.Option) (*kms.EnableKeyOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.EnableKey(input)
+}
+
+// DescribeKeyWithContext is DescribeKey, failing if the context is done
+func (f *FakeKMS) DescribeKeyWithContext(ctx aws.Context, input *kms.DescribeKeyInput, opts ...request.Option) (*kms.DescribeKeyOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.DescribeKey(input)
+}
+
+// EncryptWithContext is Encrypt, failing if the context is done
+func (f *FakeKMS) EncryptWithContext(ctx aws.Context, input *kms.EncryptInput, opts ...request.Option) (*kms.EncryptOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.Encrypt(input)
+}
+
+// DecryptWithContext is Decrypt, failing if the context is done
+func (f *FakeKMS) DecryptWithContext(ctx aws.Context, input *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.Decrypt(input)
+}
+
+// ReEncryptWithContext is ReEncrypt, failing if the context is done
+func (f *FakeKMS) ReEncryptWithContext(ctx aws.Context, input *kms.ReEncryptInput, opts ...request.Option) (*kms.ReEncryptOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.ReEncrypt(input)
+}
+
+// GenerateDataKeyWithContext is GenerateDataKey, failing if the context is done
+func (f *FakeKMS) GenerateDataKeyWithContext(ctx aws.Context, input *kms.GenerateDataKeyInput, opts ...request.Option) (*kms.GenerateDataKeyOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.GenerateDataKey(input)
+}
+
+// notImplementedKMS returns a KMS client that never sends a request, failing every one with
+// a NotImplemented error naming the operation. It stands in for the rest of the KMS API.
+func notImplementedKMS() kmsiface.KMSAPI {
+	client := kms.New(fakeKMSConfig{})
+	client.Handlers.Send.Clear()
+	client.Handlers.Send.PushBack(func(r *request.Request) {
+		r.Error = awserr.New("NotImplemented", "FakeKMS does not implement "+r.Operation.Name, nil)
+	})
+	return client
+}
+
+// fakeKMSConfig configures the notImplementedKMS client, without consulting the environment
+type fakeKMSConfig struct{}
+
+// ClientConfig returns the default client configuration, with anonymous credentials and no retries
+func (fakeKMSConfig) ClientConfig(serviceName string, cfgs ...*aws.Config) client.Config {
+	return client.Config{
+		Config: defaults.Config().
+			WithRegion("us-east-1").
+			WithCredentials(credentials.AnonymousCredentials).
+			WithMaxRetries(0),
+		Handlers:      defaults.Handlers(),
+		Endpoint:      "https://kms.invalid",
+		SigningRegion: "us-east-1",
+		SigningName:   serviceName,
+	}
+}
+
+// encrypt seals the plaintext under the key, returning a blob of the key ID's length,
+// the key ID, the nonce and the sealed plaintext. The encryption context is the additional data.
+func (f *FakeKMS) encrypt(keyId string, plaintext []byte, context map[string]*string) (*fakeKey, []byte, error) {
+	f.mu.Lock()
+	k, err := f.usable(keyId)
+	f.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newGCM(k.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	blob := binary.BigEndian.AppendUint16(nil, uint16(len(k.id)))
+	blob = append(blob, k.id...)
+	blob = append(blob, nonce...)
+	blob = aead.Seal(blob, nonce, plaintext, canonicalContext(context))
+	return k, blob, nil
+}
+
+// decrypt opens a blob from encrypt. If keyId isn't empty, the blob must have been encrypted under it.
+func (f *FakeKMS) decrypt(blob []byte, keyId string, context map[string]*string) (*fakeKey, []byte, error) {
+	invalid := awserr.New(kms.ErrCodeInvalidCiphertextException, "invalid ciphertext", nil)
+
+	if len(blob) < 2 {
+		return nil, nil, invalid
+	}
+	idLen := int(binary.BigEndian.Uint16(blob))
+	if len(blob) < 2+idLen+12 {
+		return nil, nil, invalid
+	}
+
+	f.mu.Lock()
+	k, err := f.usable(string(blob[2 : 2+idLen]))
+	if err == nil && keyId != "" {
+		var want *fakeKey
+		if want, err = f.lookup(keyId); err == nil && want != k {
+			err = awserr.New(kms.ErrCodeIncorrectKeyException, "ciphertext was not encrypted under "+keyId, nil)
+		}
+	}
+	f.mu.Unlock()
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == kms.ErrCodeNotFoundException {
+			return nil, nil, invalid
+		}
+		return nil, nil, err
+	}
+
+	aead, err := newGCM(k.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := blob[2+idLen : 2+idLen+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, blob[2+idLen+aead.NonceSize():], canonicalContext(context))
+	if err != nil {
+		// Wrong encryption context, or tampering
+		return nil, nil, invalid
+	}
+	return k, plaintext, nil
+}
+
+// setEnabled enables or disables a key
+func (f *FakeKMS) setEnabled(keyId string, enabled bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	k, err := f.lookup(keyId)
+	if err != nil {
+		return err
+	}
+	k.enabled = enabled
+	return nil
+}
+
+// usable returns the key, or an error if it doesn't exist or is disabled. f.mu must be held.
+func (f *FakeKMS) usable(keyId string) (*fakeKey, error) {
+	k, err := f.lookup(keyId)
+	if err != nil {
+		return nil, err
+	}
+	if !k.enabled {
+		return nil, awserr.New(kms.ErrCodeDisabledException, k.arn+" is disabled", nil)
+	}
+	return k, nil
+}
+
+// lookup returns the key by ID, ARN, alias or alias ARN. f.mu must be held.
+func (f *FakeKMS) lookup(keyId string) (*fakeKey, error) {
+	id := keyId
+	if strings.HasPrefix(id, "arn:") {
+		// arn:aws:kms:region:account:key/id or arn:aws:kms:region:account:alias/name
+		if parts := strings.SplitN(id, ":", 6); len(parts) == 6 {
+			id = parts[5]
+		}
+	}
+	if strings.HasPrefix(id, "alias/") {
+		id = f.aliases[id]
+	}
+	id = strings.TrimPrefix(id, "key/")
+
+	k, ok := f.keys[id]
+	if !ok {
+		return nil, awserr.New(kms.ErrCodeNotFoundException, "key "+keyId+" not found", nil)
+	}
+	return k, nil
+}
+
+// metadata returns the KeyMetadata for the key
+func (k *fakeKey) metadata() *kms.KeyMetadata {
+	state := kms.KeyStateEnabled
+	if !k.enabled {
+		state = kms.KeyStateDisabled
+	}
+	return &kms.KeyMetadata{
+		KeyId:        aws.String(k.id),
+		Arn:          aws.String(k.arn),
+		Enabled:      aws.Bool(k.enabled),
+		KeyState:     aws.String(state),
+		KeyUsage:     aws.String(kms.KeyUsageTypeEncryptDecrypt),
+		KeySpec:      aws.String(kms.KeySpecSymmetricDefault),
+		KeyManager:   aws.String(kms.KeyManagerTypeCustomer),
+		CreationDate: aws.Time(k.created),
+	}
+}
+
+// canonicalContext returns the encryption context as sorted key=value lines
+func canonicalContext(context map[string]*string) []byte {
+	keys := make([]string, 0, len(context))
+	for k := range context {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%q=%q\n", k, aws.StringValue(context[k]))
+	}
+	return []byte(b.String())
+}
+
+// fakeUUID returns a random version 4 UUID, as KMS uses for key IDs
+func fakeUUID() (string, error) {
+	u := make([]byte, 16)
+	if _, err := rand.Read(u); err != nil {
+		return "", err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
@@ -0,0 +1,159 @@
+package aws
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// Option is a functional option for NewSession
+type Option func(*sessionOptions)
+
+// sessionOptions collects the Options passed to NewSession
+type sessionOptions struct {
+	region        string
+	accessKey     string
+	secretKey     string
+	sessionToken  string
+	profile       string
+	roleARN       string
+	externalID    string
+	mfaSerial     string
+	mfaTokenFunc  func() (string, error)
+	endpoints     map[string]string
+	s3PathStyle   bool
+	httpClient    *http.Client
+	maxRetries    *int
+	logLevel      *aws.LogLevelType
+	eagerIdentity bool
+}
+
+// WithRegion sets the region, trumping the environment, shared config, and EC2 metadata
+func WithRegion(region string) Option {
+	return func(o *sessionOptions) {
+		o.region = region
+	}
+}
+
+// WithCredentials sets static credentials, trumping the environment and shared config
+func WithCredentials(accessKey, secretKey string) Option {
+	return func(o *sessionOptions) {
+		o.accessKey = accessKey
+		o.secretKey = secretKey
+	}
+}
+
+// WithSessionToken sets the session token to go along with the static credentials
+// from WithCredentials or the environment. Absent this, AWS_SESSION_TOKEN is only
+// used with the environment's credentials.
+func WithSessionToken(token string) Option {
+	return func(o *sessionOptions) {
+		o.sessionToken = token
+	}
+}
+
+// WithProfile selects a named profile from the shared config and credentials files.
+// Absent this, AWS_PROFILE is honored.
+func WithProfile(profile string) Option {
+	return func(o *sessionOptions) {
+		o.profile = profile
+	}
+}
+
+// WithAssumeRole causes the Session to assume the specified role via STS, using
+// the otherwise-configured credentials. externalID may be empty.
+func WithAssumeRole(roleARN, externalID string) Option {
+	return func(o *sessionOptions) {
+		o.roleARN = roleARN
+		o.externalID = externalID
+	}
+}
+
+// WithMFA sets the MFA device serial number and a function to call for the current token,
+// when assuming a role that requires it
+func WithMFA(serialNumber string, tokenFunc func() (string, error)) Option {
+	return func(o *sessionOptions) {
+		o.mfaSerial = serialNumber
+		o.mfaTokenFunc = tokenFunc
+	}
+}
+
+// WithEndpoint overrides the endpoint URL for the specified service (e.g. "s3", "sqs", "monitoring"),
+// or all services if service is "*". Useful for LocalStack, MinIO, or httptest servers.
+func WithEndpoint(service, url string) Option {
+	return func(o *sessionOptions) {
+		if o.endpoints == nil {
+			o.endpoints = make(map[string]string)
+		}
+		o.endpoints[service] = url
+	}
+}
+
+// WithS3PathStyle forces path-style S3 addressing, as many S3 stand-ins require
+func WithS3PathStyle() Option {
+	return func(o *sessionOptions) {
+		o.s3PathStyle = true
+	}
+}
+
+// WithHTTPClient sets the http.Client used for all requests
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *sessionOptions) {
+		o.httpClient = client
+	}
+}
+
+// WithMaxRetries sets the maximum number of retries for each request
+func WithMaxRetries(retries int) Option {
+	return func(o *sessionOptions) {
+		o.maxRetries = &retries
+	}
+}
+
+// WithLogLevel sets the AWS SDK log level
+func WithLogLevel(level aws.LogLevelType) Option {
+	return func(o *sessionOptions) {
+		o.logLevel = &level
+	}
+}
+
+// WithEagerIdentity looks up the EC2 instance identity document in NewSession, populating
+// Session.Me, rather than on the first call to Session.Identity. Off-EC2, the lookup can
+// only time out, after IdentityTimeout.
+func WithEagerIdentity() Option {
+	return func(o *sessionOptions) {
+		o.eagerIdentity = true
+	}
+}
+
+// newSessionOptions applies the Options over the defaults, which come
+// from the well-known environment variables
+func newSessionOptions(opts ...Option) *sessionOptions {
+	o := &sessionOptions{
+		region: os.Getenv("AWS_DEFAULT_REGION"),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// endpointResolver returns an EndpointResolver that honors any WithEndpoint overrides,
+// falling back to the default resolver
+func (o *sessionOptions) endpointResolver() endpoints.Resolver {
+	return endpoints.ResolverFunc(func(service, region string, optFns ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		url, ok := o.endpoints[service]
+		if !ok {
+			url, ok = o.endpoints["*"]
+		}
+		if ok {
+			return endpoints.ResolvedEndpoint{
+				URL:           url,
+				SigningRegion: region,
+			}, nil
+		}
+		return endpoints.DefaultResolver().EndpointFor(service, region, optFns...)
+	})
+}
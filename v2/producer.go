@@ -0,0 +1,402 @@
+package aws
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const (
+	// MaxSQSMessageBytes is the largest message, or batch of messages, SQS will accept
+	MaxSQSMessageBytes = 256 * 1024
+	// MaxSQSBatch is the most messages SQS will accept in a batch
+	MaxSQSBatch = 10
+
+	// payloadPointerClass is the class name the SQS extended clients use to mark S3 pointer messages
+	payloadPointerClass = "software.amazon.payloadoffloading.PayloadS3Pointer"
+	// extendedPayloadSizeAttribute is the message attribute the SQS extended clients set to the original size
+	extendedPayloadSizeAttribute = "ExtendedPayloadSize"
+)
+
+// ErrPayloadTooLarge is returned when a message is too large to send, and no LargePayloadBucket is set
+var ErrPayloadTooLarge = errors.New("message payload too large")
+
+// OutgoingMessage is a message to send with a Producer
+type OutgoingMessage struct {
+	Body string
+	// GroupID is the message group ID, and is required for FIFO queues
+	GroupID string
+	// DeduplicationID is the deduplication ID for FIFO queues. It may be omitted
+	// if the queue has content-based deduplication enabled.
+	DeduplicationID string
+	// Delay is how long the message is delayed. Not supported on FIFO queues.
+	Delay      time.Duration
+	Attributes map[string]*sqs.MessageAttributeValue
+}
+
+// Producer sends messages to an SQS queue, in batches. Messages too large for SQS
+// are stored in LargePayloadBucket, if set, and a pointer to them sent instead, in a
+// format compatible with the SQS extended clients. A Consumer deletes the payload once
+// its message has been handled and deleted, but payloads of messages that are never
+// consumed, e.g. because they expired, are left behind, so LargePayloadBucket should
+// have a lifecycle rule expiring objects after the queue's retention period. Change
+// the exported fields, if desired, before calling Send.
+type Producer struct {
+	// LargePayloadBucket is the S3 bucket large payloads are offloaded to. If empty, large payloads are an error.
+	LargePayloadBucket string
+	// LargePayloadPrefix is prepended to the S3 keys of offloaded payloads
+	LargePayloadPrefix string
+
+	session *Session
+	sqs     sqsiface.SQSAPI
+	qurl    string
+	fifo    bool
+}
+
+// payloadPointer is the body of a message whose payload has been offloaded to S3
+type payloadPointer struct {
+	S3BucketName string `json:"s3BucketName"`
+	S3Key        string `json:"s3Key"`
+}
+
+// NewProducer returns a Producer for the specified queue, or an error if the queue URL
+// can't be resolved
+func (s *Session) NewProducer(queue string) (*Producer, error) {
+	qurl, err := s.SQS_GetQueueUrl(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.NewProducerWithClient(sqs.New(s.AWS), qurl), nil
+}
+
+// NewProducerWithClient returns a Producer for the specified queue URL, using the SQS client,
+// such as a stand-in for testing. The Session is still used to offload large payloads to S3.
+func (s *Session) NewProducerWithClient(client sqsiface.SQSAPI, queueURL string) *Producer {
+	return &Producer{
+		session: s,
+		sqs:     client,
+		qurl:    queueURL,
+		fifo:    strings.HasSuffix(queueURL, ".fifo"),
+	}
+}
+
+// Send sends the messages, in as few SendMessageBatch calls as possible, returning their
+// message IDs in the same order. Entries that fail within a batch are retried individually.
+// On FIFO queues, once a message fails, no later messages in its group are sent or retried,
+// so the group's order is kept. If any messages could not be sent, their IDs will be empty,
+// and the error will say why.
+func (p *Producer) Send(messages ...*OutgoingMessage) ([]string, error) {
+	var (
+		ids       = make([]string, len(messages))
+		errs      []error
+		entries   []*sqs.SendMessageBatchRequestEntry
+		size      int
+		offloaded = make(map[int]*payloadPointer)
+		failed    map[string]bool
+	)
+	if p.fifo {
+		failed = make(map[string]bool)
+	}
+
+	for i, m := range messages {
+		if failed[m.GroupID] {
+			errs = append(errs, fmt.Errorf("message %d: not sent after an earlier failure in group %s", i, m.GroupID))
+			continue
+		}
+
+		entry, esize, ptr, err := p.entry(m)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("message %d: %w", i, err))
+			if failed != nil {
+				failed[m.GroupID] = true
+			}
+			continue
+		}
+		if ptr != nil {
+			offloaded[i] = ptr
+		}
+
+		if len(entries) == MaxSQSBatch || size+esize > MaxSQSMessageBytes {
+			errs = append(errs, p.sendBatch(entries, ids, failed)...)
+			entries, size = nil, 0
+			// The batch may have failed the group
+			if failed[m.GroupID] {
+				errs = append(errs, fmt.Errorf("message %d: not sent after an earlier failure in group %s", i, m.GroupID))
+				continue
+			}
+		}
+		entry.Id = aws.String(strconv.Itoa(i))
+		entries = append(entries, entry)
+		size += esize
+	}
+	errs = append(errs, p.sendBatch(entries, ids, failed)...)
+
+	// Don't leave the payloads of messages that weren't sent behind
+	for i, ptr := range offloaded {
+		if ids[i] == "" {
+			if err := p.session.deletePayload(ptr); err != nil {
+				errs = append(errs, fmt.Errorf("message %d: deleting payload: %w", i, err))
+			}
+		}
+	}
+
+	return ids, errors.Join(errs...)
+}
+
+// sendBatch sends a batch of entries, retrying failures individually, and filling in ids.
+// If failed isn't nil, the queue is FIFO: failures are retried in order, unless a later
+// message in the group was sent, and failed groups are recorded in it.
+func (p *Producer) sendBatch(entries []*sqs.SendMessageBatchRequestEntry, ids []string, failed map[string]bool) (errs []error) {
+	if len(entries) == 0 {
+		return
+	}
+
+	fail := func(e *sqs.SendMessageBatchRequestEntry, err error) {
+		errs = append(errs, err)
+		if failed != nil {
+			failed[aws.StringValue(e.MessageGroupId)] = true
+		}
+	}
+
+	resp, err := p.sqs.SendMessageBatch(&sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(p.qurl),
+		Entries:  entries,
+	})
+	if err != nil {
+		// The whole batch failed
+		for _, e := range entries {
+			fail(e, fmt.Errorf("message %s: %w", aws.StringValue(e.Id), err))
+		}
+		return
+	}
+
+	for _, s := range resp.Successful {
+		i, _ := strconv.Atoi(aws.StringValue(s.Id))
+		ids[i] = aws.StringValue(s.MessageId)
+	}
+
+	failures := make(map[string]*sqs.BatchResultErrorEntry, len(resp.Failed))
+	for _, f := range resp.Failed {
+		failures[aws.StringValue(f.Id)] = f
+	}
+
+	// In order, so FIFO groups are retried in order
+	for n, e := range entries {
+		f, ok := failures[aws.StringValue(e.Id)]
+		if !ok {
+			continue
+		}
+		i, _ := strconv.Atoi(aws.StringValue(e.Id))
+		group := aws.StringValue(e.MessageGroupId)
+
+		switch {
+		case failed[group]:
+			fail(e, fmt.Errorf("message %d: %s: %s, not retried after an earlier failure in group %s", i, aws.StringValue(f.Code), aws.StringValue(f.Message), group))
+			continue
+		case aws.BoolValue(f.SenderFault):
+			// Retrying won't help
+			fail(e, fmt.Errorf("message %d: %s: %s", i, aws.StringValue(f.Code), aws.StringValue(f.Message)))
+			continue
+		case failed != nil && sentLater(entries[n+1:], group, ids):
+			// Retrying would reorder the group
+			fail(e, fmt.Errorf("message %d: %s: %s, not retried as later messages in group %s were sent", i, aws.StringValue(f.Code), aws.StringValue(f.Message), group))
+			continue
+		}
+
+		out, err := p.sqs.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:               aws.String(p.qurl),
+			MessageBody:            e.MessageBody,
+			MessageAttributes:      e.MessageAttributes,
+			MessageGroupId:         e.MessageGroupId,
+			MessageDeduplicationId: e.MessageDeduplicationId,
+			DelaySeconds:           e.DelaySeconds,
+		})
+		if err != nil {
+			fail(e, fmt.Errorf("message %d: %w", i, err))
+			continue
+		}
+		ids[i] = aws.StringValue(out.MessageId)
+	}
+
+	return
+}
+
+// sentLater returns true if any of the entries in the group has been sent
+func sentLater(entries []*sqs.SendMessageBatchRequestEntry, group string, ids []string) bool {
+	for _, e := range entries {
+		i, _ := strconv.Atoi(aws.StringValue(e.Id))
+		if aws.StringValue(e.MessageGroupId) == group && ids[i] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// entry returns a batch entry, and its size, for the message, offloading the payload if needed,
+// in which case the pointer to it is returned too
+func (p *Producer) entry(m *OutgoingMessage) (*sqs.SendMessageBatchRequestEntry, int, *payloadPointer, error) {
+	if p.fifo && m.GroupID == "" {
+		return nil, 0, nil, errors.New("FIFO queues require a GroupID")
+	}
+
+	entry := sqs.SendMessageBatchRequestEntry{
+		MessageBody:       aws.String(m.Body),
+		MessageAttributes: m.Attributes,
+	}
+	if m.GroupID != "" {
+		entry.MessageGroupId = aws.String(m.GroupID)
+	}
+	if m.DeduplicationID != "" {
+		entry.MessageDeduplicationId = aws.String(m.DeduplicationID)
+	}
+	if m.Delay > 0 {
+		entry.DelaySeconds = aws.Int64(int64(m.Delay.Seconds()))
+	}
+
+	size := len(m.Body) + attributesSize(m.Attributes)
+	if size <= MaxSQSMessageBytes {
+		return &entry, size, nil, nil
+	}
+
+	if p.LargePayloadBucket == "" {
+		return nil, 0, nil, fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, size)
+	}
+
+	body, ptr, err := p.offload(m.Body)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	entry.MessageBody = aws.String(body)
+
+	attrs := make(map[string]*sqs.MessageAttributeValue, len(m.Attributes)+1)
+	for k, v := range m.Attributes {
+		attrs[k] = v
+	}
+	attrs[extendedPayloadSizeAttribute] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(len(m.Body))),
+	}
+	entry.MessageAttributes = attrs
+
+	return &entry, len(body) + attributesSize(attrs), ptr, nil
+}
+
+// offload uploads the payload to the LargePayloadBucket, returning a pointer message body,
+// and the pointer
+func (p *Producer) offload(payload string) (string, *payloadPointer, error) {
+	r := make([]byte, 16)
+	if _, err := rand.Read(r); err != nil {
+		return "", nil, err
+	}
+	key := p.LargePayloadPrefix + hex.EncodeToString(r)
+
+	uploader := s3manager.NewUploader(p.session.AWS)
+	_, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(p.LargePayloadBucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader(payload),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	ptr := payloadPointer{S3BucketName: p.LargePayloadBucket, S3Key: key}
+	b, err := json.Marshal([]interface{}{payloadPointerClass, ptr})
+	return string(b), &ptr, err
+}
+
+// IsPayloadPointer returns true if the Message body is a pointer to an offloaded S3 payload
+func IsPayloadPointer(m *Message) bool {
+	if _, ok := m.MessageAttributes[extendedPayloadSizeAttribute]; ok {
+		return true
+	}
+	return strings.HasPrefix(m.Body, `["`+payloadPointerClass+`"`)
+}
+
+// ResolveMessage replaces the body of a pointer Message with its offloaded payload from S3.
+// Messages that aren't pointers are left alone.
+func (s *Session) ResolveMessage(m *Message) error {
+	if !IsPayloadPointer(m) {
+		return nil
+	}
+
+	ptr, err := parsePayloadPointer(m.ID, m.Body)
+	if err != nil {
+		return err
+	}
+
+	buf := aws.NewWriteAtBuffer(nil)
+	downloader := s3manager.NewDownloader(s.AWS)
+	_, err = downloader.Download(buf, &s3.GetObjectInput{
+		Bucket: aws.String(ptr.S3BucketName),
+		Key:    aws.String(ptr.S3Key),
+	})
+	if err != nil {
+		return err
+	}
+
+	m.Body = string(buf.Bytes())
+	return nil
+}
+
+// DeletePayload deletes the offloaded payload of a pointer Message from S3, which should be done
+// once the message itself has been deleted. Consumers do this automatically. Messages that
+// aren't pointers are left alone. The original body is used, so it doesn't matter if the
+// Message has been resolved.
+func (s *Session) DeletePayload(m *Message) error {
+	body := m.Body
+	if m.Raw != nil {
+		body = aws.StringValue(m.Raw.Body)
+	}
+	if !IsPayloadPointer(&Message{Body: body, MessageAttributes: m.MessageAttributes}) {
+		return nil
+	}
+
+	ptr, err := parsePayloadPointer(m.ID, body)
+	if err != nil {
+		return err
+	}
+	return s.deletePayload(ptr)
+}
+
+// deletePayload deletes the object the pointer points to
+func (s *Session) deletePayload(ptr *payloadPointer) error {
+	_, err := s3.New(s.AWS).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(ptr.S3BucketName),
+		Key:    aws.String(ptr.S3Key),
+	})
+	return err
+}
+
+// parsePayloadPointer parses the body of a pointer message
+func parsePayloadPointer(id, body string) (*payloadPointer, error) {
+	var parts []json.RawMessage
+	if err := json.Unmarshal([]byte(body), &parts); err != nil || len(parts) != 2 {
+		return nil, fmt.Errorf("bad payload pointer in message %s", id)
+	}
+	var ptr payloadPointer
+	if err := json.Unmarshal(parts[1], &ptr); err != nil {
+		return nil, fmt.Errorf("bad payload pointer in message %s: %w", id, err)
+	}
+	return &ptr, nil
+}
+
+// attributesSize returns the size SQS counts against the message for the attributes
+func attributesSize(attrs map[string]*sqs.MessageAttributeValue) (size int) {
+	for k, v := range attrs {
+		size += len(k) + len(aws.StringValue(v.DataType)) + len(aws.StringValue(v.StringValue)) + len(v.BinaryValue)
+	}
+	return
+}
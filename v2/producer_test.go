@@ -0,0 +1,223 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const testFIFOQueue = "https://sqs.us-east-1.amazonaws.com/123456789012/q.fifo"
+
+func TestProducerFIFO(t *testing.T) {
+	f := newFakeSQS(true)
+	p := newTestSession(t).NewProducerWithClient(f, testFIFOQueue)
+
+	ids, err := p.Send(
+		&OutgoingMessage{Body: "a1", GroupID: "a", DeduplicationID: "d1"},
+		&OutgoingMessage{Body: "b1", GroupID: "b", DeduplicationID: "d2"},
+		&OutgoingMessage{Body: "none", DeduplicationID: "d3"},
+		&OutgoingMessage{Body: "a2", GroupID: "a", DeduplicationID: "d4"},
+		&OutgoingMessage{Body: "a1 again", GroupID: "a", DeduplicationID: "d1"},
+	)
+	if err == nil || !strings.Contains(err.Error(), "message 2: FIFO queues require a GroupID") {
+		t.Errorf("got error %v, want message 2 to need a GroupID", err)
+	}
+	for i, id := range ids {
+		if (id == "") != (i == 2) {
+			t.Errorf("message %d has ID %q", i, id)
+		}
+	}
+	if f.batches != 1 || f.singles != 0 {
+		t.Errorf("sent %d batches and %d singles, want 1 batch", f.batches, f.singles)
+	}
+
+	// The duplicate was accepted, but dropped
+	var got []string
+	for _, m := range f.queued() {
+		got = append(got, fmt.Sprintf("%s/%s/%s", aws.StringValue(m.Body),
+			aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]),
+			aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId])))
+	}
+	if want := "a1/a/d1 b1/b/d2 a2/a/d4"; strings.Join(got, " ") != want {
+		t.Errorf("queued %s, want %s", strings.Join(got, " "), want)
+	}
+}
+
+func TestProducerFIFOFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		bodies   []string // as "body/group"
+		fail     map[string]int
+		unsent   []int
+		queued   string
+		singles  int
+		contains string
+	}{
+		{
+			name:    "retried",
+			bodies:  []string{"a1/a", "b1/b", "a2/a"},
+			fail:    map[string]int{"a1": 1, "a2": 1},
+			queued:  "b1 a1 a2",
+			singles: 2,
+		},
+		{
+			name:     "later message sent",
+			bodies:   []string{"a1/a", "b1/b", "a2/a", "a3/a"},
+			fail:     map[string]int{"a1": 1},
+			unsent:   []int{0},
+			queued:   "b1 a2 a3",
+			contains: "not retried as later messages in group a were sent",
+		},
+		{
+			name:     "retry failed",
+			bodies:   []string{"a1/a", "a2/a", "b1/b"},
+			fail:     map[string]int{"a1": 2, "a2": 1},
+			unsent:   []int{0, 1},
+			queued:   "b1",
+			singles:  1,
+			contains: "not retried after an earlier failure in group a",
+		},
+		{
+			// The group fails in the first batch, so isn't sent in the second
+			name: "sender fault",
+			bodies: []string{
+				"invalid/a", "b1/b", "a2/a", "b2/b", "a3/a", "b3/b", "a4/a", "b4/b", "a5/a", "b5/b",
+				"a6/a", "b6/b",
+			},
+			unsent:   []int{0, 10},
+			queued:   "b1 a2 b2 a3 b3 a4 b4 a5 b5 b6",
+			contains: "message 10: not sent after an earlier failure in group a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeSQS(true)
+			for body, n := range tt.fail {
+				f.fail[body] = n
+			}
+			p := newTestSession(t).NewProducerWithClient(f, testFIFOQueue)
+
+			var messages []*OutgoingMessage
+			for i, bg := range tt.bodies {
+				body, group, _ := strings.Cut(bg, "/")
+				messages = append(messages, &OutgoingMessage{Body: body, GroupID: group, DeduplicationID: fmt.Sprint(i)})
+			}
+			ids, err := p.Send(messages...)
+
+			unsent := make(map[int]bool)
+			for _, i := range tt.unsent {
+				unsent[i] = true
+			}
+			for i, id := range ids {
+				if (id == "") != unsent[i] {
+					t.Errorf("message %d has ID %q", i, id)
+				}
+			}
+			if (err != nil) != (len(tt.unsent) > 0) {
+				t.Errorf("got error %v", err)
+			}
+			if tt.contains != "" && (err == nil || !strings.Contains(err.Error(), tt.contains)) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.contains)
+			}
+
+			var queued []string
+			for _, m := range f.queued() {
+				queued = append(queued, aws.StringValue(m.Body))
+			}
+			if strings.Join(queued, " ") != tt.queued {
+				t.Errorf("queued %s, want %s", strings.Join(queued, " "), tt.queued)
+			}
+			if f.singles != tt.singles {
+				t.Errorf("retried %d messages, want %d", f.singles, tt.singles)
+			}
+		})
+	}
+}
+
+func TestProducerLargePayload(t *testing.T) {
+	f := newFakeSQS(false)
+	_, s := newFakeS3(t)
+	p := s.NewProducerWithClient(f, "https://sqs.us-east-1.amazonaws.com/123456789012/q")
+
+	large := strings.Repeat("x", MaxSQSMessageBytes+1)
+	if _, err := p.Send(&OutgoingMessage{Body: large}); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("got error %v, want %v", err, ErrPayloadTooLarge)
+	}
+}
+
+func TestProducerPayloadRoundTrip(t *testing.T) {
+	f := newFakeSQS(false)
+	store, s := newFakeS3(t)
+	p := s.NewProducerWithClient(f, "https://sqs.us-east-1.amazonaws.com/123456789012/q")
+	p.LargePayloadBucket = "payloads"
+	p.LargePayloadPrefix = "sqs/"
+
+	large := strings.Repeat("0123456789", MaxSQSMessageBytes/10+1)
+	ids, err := p.Send(
+		&OutgoingMessage{Body: large},
+		&OutgoingMessage{Body: "small"},
+		&OutgoingMessage{Body: large, Attributes: map[string]*sqs.MessageAttributeValue{
+			"invalid": {DataType: aws.String("String"), StringValue: aws.String("yes")},
+		}},
+	)
+	if err == nil || !strings.Contains(err.Error(), "message 2: InvalidParameterValue") {
+		t.Errorf("got error %v, want message 2 to fail", err)
+	}
+	if ids[0] == "" || ids[1] == "" || ids[2] != "" {
+		t.Errorf("got IDs %q", ids)
+	}
+
+	// Only the sent message's payload is left
+	store.mu.Lock()
+	var key string
+	for k := range store.objects {
+		if key != "" {
+			t.Errorf("payloads %s and %s in S3, want one", key, k)
+		}
+		key = k
+	}
+	store.mu.Unlock()
+	if !strings.HasPrefix(key, "sqs/") {
+		t.Fatalf("payload key is %q, want the prefix sqs/", key)
+	}
+
+	// The pointer is in the extended clients' format
+	queued := f.queued()
+	if len(queued) != 2 {
+		t.Fatalf("queued %d messages, want 2", len(queued))
+	}
+	var ptr []json.RawMessage
+	if err := json.Unmarshal([]byte(aws.StringValue(queued[0].Body)), &ptr); err != nil || len(ptr) != 2 {
+		t.Fatalf("pointer is %s", aws.StringValue(queued[0].Body))
+	}
+	if want := fmt.Sprintf(`[%q,{"s3BucketName":"payloads","s3Key":%q}]`, payloadPointerClass, key); aws.StringValue(queued[0].Body) != want {
+		t.Errorf("pointer is %s, want %s", aws.StringValue(queued[0].Body), want)
+	}
+	if size := queued[0].MessageAttributes[extendedPayloadSizeAttribute]; size == nil || aws.StringValue(size.StringValue) != fmt.Sprint(len(large)) {
+		t.Errorf("%s is %v, want %d", extendedPayloadSizeAttribute, size, len(large))
+	}
+
+	// A Consumer resolves the pointer, and deletes the payload with the message
+	var bodies []string
+	c := s.NewConsumerWithClient(f, "https://sqs.us-east-1.amazonaws.com/123456789012/q", func(ctx context.Context, m *Message) error {
+		bodies = append(bodies, m.Body)
+		return nil
+	})
+	c.DeleteInterval = 10 * time.Millisecond
+	runConsumer(t, c, f, 2)
+
+	if len(bodies) != 2 || bodies[0] != large || bodies[1] != "small" {
+		t.Errorf("handled %d messages, want the large payload, then small", len(bodies))
+	}
+	if _, ok := store.object(key); ok {
+		t.Error("payload not deleted with its message")
+	}
+}
@@ -0,0 +1,375 @@
+package aws
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+const (
+	// MaxPutMetricDatums is the most datums CloudWatch will accept in a single PutMetricData call
+	MaxPutMetricDatums = 1000
+	// MaxPutMetricBytes is the largest PutMetricData payload CloudWatch will accept
+	MaxPutMetricBytes = 1024 * 1024
+)
+
+var (
+	// ErrPublisherClosed is returned when adding to a MetricPublisher after Close
+	ErrPublisherClosed = errors.New("metric publisher closed")
+
+	// MaxRequeuedMetrics is the most metrics a MetricPublisher buffers, including those that
+	// failed to publish and are kept for the next flush. Failed metrics beyond it are dropped.
+	MaxRequeuedMetrics = 10 * MaxPutMetricDatums
+
+	// DefaultPublishInterval is how often a MetricPublisher flushes, if not specified
+	DefaultPublishInterval = 60 * time.Second
+	// PublishRetries is how many times a MetricPublisher will retry a throttled PutMetricData
+	PublishRetries = 5
+)
+
+// metric kinds
+const (
+	kindCounter = iota
+	kindGauge
+	kindStatistic
+)
+
+// MetricPublisher buffers and aggregates metrics, publishing them to CloudWatch
+// with PutMetricData every interval, or sooner if the buffer fills. Counters are summed,
+// gauges keep their last value, and observations are rolled into statistic sets, per
+// metric name, unit and dimension set. Close must be called to drain the buffer.
+type MetricPublisher struct {
+	svc       *cloudwatch.CloudWatch
+	namespace string
+
+	mu      sync.Mutex
+	pending map[string]*metricAggregate
+	bytes   int
+	closing bool
+
+	flushNow chan struct{}
+	done     chan struct{}
+	closed   sync.WaitGroup
+	once     sync.Once
+	lasterr  error
+	closeErr error
+}
+
+// metricAggregate is the buffered state of one metric, between flushes
+type metricAggregate struct {
+	kind       int
+	name       string
+	unit       string
+	dimensions map[string]string
+	timestamp  time.Time
+	value      float64
+	min        float64
+	max        float64
+	sum        float64
+	count      float64
+}
+
+// NewMetricPublisher returns a running MetricPublisher that publishes to the specified namespace
+// every interval (or DefaultPublishInterval if interval is 0)
+func (s *Session) NewMetricPublisher(namespace string, interval time.Duration) *MetricPublisher {
+	if interval <= 0 {
+		interval = DefaultPublishInterval
+	}
+
+	p := MetricPublisher{
+		svc:       cloudwatch.New(s.AWS),
+		namespace: namespace,
+		pending:   make(map[string]*metricAggregate),
+		flushNow:  make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+
+	p.closed.Add(1)
+	go p.run(interval)
+
+	return &p
+}
+
+// Count adds n to the named counter, or returns ErrPublisherClosed
+func (p *MetricPublisher) Count(name string, dimensions map[string]string, n float64) error {
+	return p.add(kindCounter, name, cloudwatch.StandardUnitCount, dimensions, n)
+}
+
+// Gauge sets the named gauge to v, or returns ErrPublisherClosed
+func (p *MetricPublisher) Gauge(name string, dimensions map[string]string, v float64, unit string) error {
+	return p.add(kindGauge, name, unit, dimensions, v)
+}
+
+// Observe adds v to the named statistic set, which is published as its minimum,
+// maximum, sum and sample count, or returns ErrPublisherClosed
+func (p *MetricPublisher) Observe(name string, dimensions map[string]string, v float64, unit string) error {
+	return p.add(kindStatistic, name, unit, dimensions, v)
+}
+
+// add does the work for Count, Gauge and Observe
+func (p *MetricPublisher) add(kind int, name, unit string, dimensions map[string]string, v float64) error {
+	key := metricKey(kind, name, unit, dimensions)
+
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		return ErrPublisherClosed
+	}
+	a, ok := p.pending[key]
+	if !ok {
+		a = &metricAggregate{
+			kind:       kind,
+			name:       name,
+			unit:       unit,
+			dimensions: copyDimensions(dimensions),
+			timestamp:  time.Now(),
+			min:        v,
+			max:        v,
+		}
+		p.pending[key] = a
+		p.bytes += a.size()
+	}
+
+	switch kind {
+	case kindCounter:
+		a.value += v
+	case kindGauge:
+		a.value = v
+	case kindStatistic:
+		if v < a.min {
+			a.min = v
+		}
+		if v > a.max {
+			a.max = v
+		}
+		a.sum += v
+		a.count++
+	}
+
+	full := len(p.pending) >= MaxPutMetricDatums || p.bytes >= MaxPutMetricBytes
+	p.mu.Unlock()
+
+	if full {
+		select {
+		case p.flushNow <- struct{}{}:
+		default:
+			// A flush is already pending
+		}
+	}
+	return nil
+}
+
+// Flush immediately publishes anything buffered, returning an error if any PutMetricData call failed.
+// The metrics that failed are buffered again, merged with any added since, to be retried by the next
+// flush, up to MaxRequeuedMetrics.
+func (p *MetricPublisher) Flush() error {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = make(map[string]*metricAggregate)
+	p.bytes = 0
+	p.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var (
+		batch []*metricAggregate
+		size  int
+		err   error
+	)
+	send := func() {
+		if perr := p.put(batch); perr != nil {
+			err = perr
+			p.requeue(batch)
+		}
+		batch = nil
+		size = 0
+	}
+	for _, a := range pending {
+		if len(batch) >= MaxPutMetricDatums || size+a.size() > MaxPutMetricBytes {
+			send()
+		}
+		batch = append(batch, a)
+		size += a.size()
+	}
+	send()
+
+	p.mu.Lock()
+	p.lasterr = err
+	p.mu.Unlock()
+
+	return err
+}
+
+// requeue buffers aggregates that failed to publish again, merging them with any added since,
+// up to MaxRequeuedMetrics
+func (p *MetricPublisher) requeue(failed []*metricAggregate) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var dropped int
+	for _, a := range failed {
+		key := metricKey(a.kind, a.name, a.unit, a.dimensions)
+		if newer, ok := p.pending[key]; ok {
+			newer.merge(a)
+		} else if len(p.pending) < MaxRequeuedMetrics {
+			p.pending[key] = a
+			p.bytes += a.size()
+		} else {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		DebugOut.Printf("MetricPublisher dropped %d metrics that failed to publish\n", dropped)
+	}
+}
+
+// Close stops the MetricPublisher, and publishes anything still buffered, returning
+// an error if that final flush failed, in which case those metrics are lost. Anything
+// added afterwards is refused with ErrPublisherClosed. Close may safely be called more
+// than once.
+func (p *MetricPublisher) Close() error {
+	p.once.Do(func() {
+		p.mu.Lock()
+		p.closing = true
+		p.mu.Unlock()
+		close(p.done)
+	})
+	p.closed.Wait()
+	return p.closeErr
+}
+
+// LastError returns the last publishing error
+func (p *MetricPublisher) LastError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lasterr
+}
+
+// run flushes every interval, or when signalled, until Close is called
+func (p *MetricPublisher) run(interval time.Duration) {
+	defer p.closed.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.flushNow:
+		case <-p.done:
+			p.closeErr = p.Flush()
+			return
+		}
+		if err := p.Flush(); err != nil {
+			DebugOut.Printf("MetricPublisher flush error: %s\n", err)
+		}
+	}
+}
+
+// put sends a batch of aggregates, retrying with backoff if throttled
+func (p *MetricPublisher) put(batch []*metricAggregate) (err error) {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	data := make([]*cloudwatch.MetricDatum, len(batch))
+	for i, a := range batch {
+		data[i] = a.datum()
+	}
+
+	backoff := 100 * time.Millisecond
+	for try := 0; try <= PublishRetries; try++ {
+		_, err = p.svc.PutMetricData(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(p.namespace),
+			MetricData: data,
+		})
+		if err == nil || !request.IsErrorThrottle(err) {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return
+}
+
+// datum returns the aggregate as a MetricDatum
+func (a *metricAggregate) datum() *cloudwatch.MetricDatum {
+	d := cloudwatch.MetricDatum{
+		MetricName: aws.String(a.name),
+		Dimensions: dimensionsFromMap(a.dimensions),
+		Timestamp:  aws.Time(a.timestamp),
+	}
+	if a.unit != "" {
+		d.Unit = aws.String(a.unit)
+	}
+
+	if a.kind == kindStatistic {
+		d.StatisticValues = &cloudwatch.StatisticSet{
+			Minimum:     aws.Float64(a.min),
+			Maximum:     aws.Float64(a.max),
+			Sum:         aws.Float64(a.sum),
+			SampleCount: aws.Float64(a.count),
+		}
+	} else {
+		d.Value = aws.Float64(a.value)
+	}
+	return &d
+}
+
+// merge folds an older aggregate of the same metric into this one: counters are summed,
+// gauges keep this value, and statistic sets are combined
+func (a *metricAggregate) merge(older *metricAggregate) {
+	switch a.kind {
+	case kindCounter:
+		a.value += older.value
+	case kindStatistic:
+		a.min = min(a.min, older.min)
+		a.max = max(a.max, older.max)
+		a.sum += older.sum
+		a.count += older.count
+	}
+	if older.timestamp.Before(a.timestamp) {
+		a.timestamp = older.timestamp
+	}
+}
+
+// size returns a rough, conservative, estimate of the encoded size of the aggregate's datum
+func (a *metricAggregate) size() int {
+	size := 256 + len(a.name) + len(a.unit)
+	for k, v := range a.dimensions {
+		size += 64 + len(k) + len(v)
+	}
+	return size
+}
+
+// metricKey returns a string uniquely identifying the metric kind, name, unit and dimension set
+func metricKey(kind int, name, unit string, dimensions map[string]string) string {
+	var b strings.Builder
+	b.WriteByte(byte('0' + kind))
+	b.WriteString(name)
+	b.WriteByte(0)
+	b.WriteString(unit)
+	for _, k := range dimensionNames(dimensions) {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(dimensions[k])
+	}
+	return b.String()
+}
+
+// copyDimensions returns a copy of the dimensions map, so callers may reuse theirs
+func copyDimensions(dimensions map[string]string) map[string]string {
+	dims := make(map[string]string, len(dimensions))
+	for k, v := range dimensions {
+		dims[k] = v
+	}
+	return dims
+}
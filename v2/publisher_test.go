@@ -0,0 +1,181 @@
+package aws
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// published returns the datums published to the fakeCloudWatch, sorted by name and dimensions,
+// and forgets them
+func (f *fakeCloudWatch) published() []putDatum {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	put := f.put
+	f.put = nil
+	sort.Slice(put, func(i, j int) bool {
+		if put[i].Name != put[j].Name {
+			return put[i].Name < put[j].Name
+		}
+		return put[i].Dims < put[j].Dims
+	})
+	return put
+}
+
+func TestMetricPublisherAggregates(t *testing.T) {
+	f, s := newFakeCloudWatch(t)
+	p := s.NewMetricPublisher("Test", time.Hour)
+	defer p.Close()
+
+	web := map[string]string{"Service": "web"}
+	for _, v := range []float64{1, 2, 3} {
+		p.Count("Requests", web, v)
+		p.Count("Requests", map[string]string{"Service": "api"}, 1)
+		p.Gauge("Queue", web, v*10, "Count")
+		p.Observe("Latency", web, v, "Milliseconds")
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []putDatum{
+		{Namespace: "Test", Name: "Latency", Unit: "Milliseconds", Dims: "web", Stats: "min=1 max=3 sum=6 n=3"},
+		{Namespace: "Test", Name: "Queue", Unit: "Count", Dims: "web", Value: 30},
+		{Namespace: "Test", Name: "Requests", Unit: "Count", Dims: "api", Value: 3},
+		{Namespace: "Test", Name: "Requests", Unit: "Count", Dims: "web", Value: 6},
+	}
+	got := f.published()
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %+v, want %+v", got[i], want[i])
+		}
+	}
+
+	// Nothing buffered, nothing sent
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if f.calls["PutMetricData"] != 1 {
+		t.Errorf("PutMetricData called %d times, want 1", f.calls["PutMetricData"])
+	}
+}
+
+func TestMetricPublisherRequeues(t *testing.T) {
+	f, s := newFakeCloudWatch(t)
+	p := s.NewMetricPublisher("Test", time.Hour)
+	defer p.Close()
+
+	f.failPut = 1
+	p.Count("Requests", nil, 2)
+	p.Gauge("Queue", nil, 1, "Count")
+	p.Observe("Latency", nil, 5, "Milliseconds")
+	if err := p.Flush(); err == nil {
+		t.Fatal("failed flush returned no error")
+	}
+
+	// Merged with those added since
+	p.Count("Requests", nil, 3)
+	p.Gauge("Queue", nil, 7, "Count")
+	p.Observe("Latency", nil, 1, "Milliseconds")
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []putDatum{
+		{Namespace: "Test", Name: "Latency", Unit: "Milliseconds", Stats: "min=1 max=5 sum=6 n=2"},
+		{Namespace: "Test", Name: "Queue", Unit: "Count", Value: 7},
+		{Namespace: "Test", Name: "Requests", Unit: "Count", Value: 5},
+	}
+	got := f.published()
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %+v, want %+v", got[i], want[i])
+		}
+	}
+}
+
+func TestMetricPublisherRequeueLimit(t *testing.T) {
+	defer func(limit int) { MaxRequeuedMetrics = limit }(MaxRequeuedMetrics)
+	MaxRequeuedMetrics = 2
+
+	f, s := newFakeCloudWatch(t)
+	p := s.NewMetricPublisher("Test", time.Hour)
+	defer p.Close()
+
+	f.failPut = 1
+	for _, name := range []string{"A", "B", "C", "D"} {
+		p.Count(name, nil, 1)
+	}
+	if err := p.Flush(); err == nil {
+		t.Fatal("failed flush returned no error")
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.published(); len(got) != MaxRequeuedMetrics {
+		t.Errorf("%d metrics retried, want %d", len(got), MaxRequeuedMetrics)
+	}
+}
+
+func TestMetricPublisherClose(t *testing.T) {
+	f, s := newFakeCloudWatch(t)
+	p := s.NewMetricPublisher("Test", time.Hour)
+
+	// An earlier failure isn't Close's
+	f.failPut = 1
+	p.Count("Requests", nil, 1)
+	if err := p.Flush(); err == nil {
+		t.Fatal("failed flush returned no error")
+	}
+	p.Count("Requests", nil, 1)
+	if err := p.Close(); err != nil {
+		t.Errorf("Close got error %v, want nil", err)
+	}
+	if got := f.published(); len(got) != 1 || got[0].Value != 2 {
+		t.Errorf("got %+v, want Requests 2", got)
+	}
+
+	if err := p.Count("Requests", nil, 1); !errors.Is(err, ErrPublisherClosed) {
+		t.Errorf("got error %v, want %v", err, ErrPublisherClosed)
+	}
+
+	// The final flush failing is
+	p = s.NewMetricPublisher("Test", time.Hour)
+	f.failPut = 1
+	p.Count("Requests", nil, 1)
+	if err := p.Close(); err == nil {
+		t.Error("Close returned no error for a failed final flush")
+	}
+	if err := p.Close(); err == nil {
+		t.Error("second Close returned no error for a failed final flush")
+	}
+}
+
+func TestMetricPublisherFlushesWhenFull(t *testing.T) {
+	f, s := newFakeCloudWatch(t)
+	p := s.NewMetricPublisher("Test", time.Hour)
+	defer p.Close()
+
+	for i := 0; i < MaxPutMetricDatums; i++ {
+		p.Count("Requests", map[string]string{"N": strconv.Itoa(i)}, 1)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		f.mu.Lock()
+		n := len(f.put)
+		f.mu.Unlock()
+		if n == MaxPutMetricDatums {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("full buffer wasn't flushed")
+}
@@ -0,0 +1,199 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cast"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+// rdsFilterValues is the most instance identifiers described at once
+const rdsFilterValues = 100
+
+// RDSStorageInfo ...
+type RDSStorageInfo struct {
+	Allocated float64
+	Free      float64
+	Used      float64
+	PercFree  float64
+	PercUsed  float64
+	ReadIops  float64
+	WriteIops float64
+}
+
+// NewRDSStorageInfo returns an RDSStorageInfo struct or an error for the specified instance
+func (s *Session) NewRDSStorageInfo(instance string) (sInfo *RDSStorageInfo, err error) {
+
+	infos, err := s.NewRDSStorageInfos([]string{instance})
+	if err != nil {
+		return
+	}
+
+	sInfo = infos[instance]
+	return
+}
+
+// NewRDSStorageInfos returns a map of instance names to RDSStorageInfo structs, or an error,
+// for the specified instances. All of the metrics are fetched using batched GetMetricData calls,
+// so this is much cheaper than calling NewRDSStorageInfo for each instance. Instances that can't
+// be found, or have no datapoints, are left out of the map, and err joins an error for each of
+// them, wrapping ErrNoDatapoints for the latter: the map may be populated even if err isn't nil.
+func (s *Session) NewRDSStorageInfos(instances []string) (sInfos map[string]*RDSStorageInfo, err error) {
+
+	dbs, err := s.rdsInstances(instances)
+	if err != nil {
+		return
+	}
+
+	var (
+		metrics = []string{"FreeStorageSpace", "ReadIOPS", "WriteIOPS"}
+		units   = []string{"Bytes", "Count/Second", "Count/Second"}
+		found   = make([]string, 0, len(instances))
+		errs    []error
+	)
+	for _, instance := range instances {
+		if _, ok := dbs[instance]; ok {
+			found = append(found, instance)
+		} else {
+			errs = append(errs, fmt.Errorf("RDS instance %s not found", instance))
+		}
+	}
+
+	queries := make([]*MetricQuery, 0, len(found)*len(metrics))
+	for _, instance := range found {
+		for m := range metrics {
+			queries = append(queries, &MetricQuery{
+				Namespace:  "AWS/RDS",
+				MetricName: metrics[m],
+				Dimensions: map[string]string{"DBInstanceIdentifier": instance},
+				Statistics: []string{cloudwatch.StatisticMaximum},
+				Unit:       units[m],
+			})
+		}
+	}
+
+	results, err := s.QueryMetrics(queries)
+	if err != nil {
+		return
+	}
+
+	sInfos = make(map[string]*RDSStorageInfo)
+	for i, instance := range found {
+		fInfo := results[i*len(metrics)].Last()
+		rInfo := results[i*len(metrics)+1].Last()
+		wInfo := results[i*len(metrics)+2].Last()
+		if fInfo == nil || rInfo == nil || wInfo == nil {
+			errs = append(errs, fmt.Errorf("%s: %w", instance, ErrNoDatapoints))
+			continue
+		}
+
+		storage := cast.ToFloat64(dbs[instance].AllocatedStorage) * 1073741824
+		freeStorage := fInfo.Values[cloudwatch.StatisticMaximum]
+		freePerc := (freeStorage / storage) * 100
+
+		sInfos[instance] = &RDSStorageInfo{
+			Allocated: storage,
+			Free:      freeStorage,
+			PercFree:  freePerc,
+			Used:      storage - freeStorage,
+			PercUsed:  100 - freePerc,
+			ReadIops:  rInfo.Values[cloudwatch.StatisticMaximum],
+			WriteIops: wInfo.Values[cloudwatch.StatisticMaximum],
+		}
+	}
+
+	err = errors.Join(errs...)
+	return
+}
+
+// rdsInstances returns a map of instance names to DBInstances for the specified instances,
+// which are missing from it if they can't be found
+func (s *Session) rdsInstances(instances []string) (map[string]*rds.DBInstance, error) {
+
+	dbs := make(map[string]*rds.DBInstance)
+	svc := rds.New(s.AWS)
+
+	// Only describe the instances we want, a batch at a time
+	for len(instances) > 0 {
+		n := min(len(instances), rdsFilterValues)
+		batch := instances[:n]
+		instances = instances[n:]
+
+		params := &rds.DescribeDBInstancesInput{
+			Filters: []*rds.Filter{{
+				Name:   aws.String("db-instance-id"),
+				Values: aws.StringSlice(batch),
+			}},
+		}
+		err := svc.DescribeDBInstancesPages(params, func(page *rds.DescribeDBInstancesOutput, lastPage bool) bool {
+			for _, i := range page.DBInstances {
+				dbs[aws.StringValue(i.DBInstanceIdentifier)] = i
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dbs, nil
+}
+
+// RDS_Instance returns the DBInstance for the specified instance, or an error
+func (s *Session) RDS_Instance(instance string) (i *rds.DBInstance, err error) {
+
+	svc := rds.New(s.AWS)
+
+	params := &rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(instance),
+	}
+	resp, err := svc.DescribeDBInstances(params)
+	if err != nil {
+		return
+	}
+	if len(resp.DBInstances) == 0 {
+		err = fmt.Errorf("RDS instance %s not found", instance)
+		return
+	}
+
+	i = resp.DBInstances[0]
+	return
+}
+
+// RDS_CPUUtilization returns the last CPUUtilization datapoint for the specified instance.
+func (s *Session) RDS_CPUUtilization(instance string) (point *cloudwatch.Datapoint, err error) {
+	return s.rdsMetric(instance, "CPUUtilization", "Percent")
+}
+
+// RDS_DatabaseConnections returns the last DatabaseConnections datapoint for the specified instance.
+func (s *Session) RDS_DatabaseConnections(instance string) (point *cloudwatch.Datapoint, err error) {
+	return s.rdsMetric(instance, "DatabaseConnections", "Count")
+}
+
+// RDS_FreeableMemory returns the last FreeableMemory datapoint for the specified instance.
+func (s *Session) RDS_FreeableMemory(instance string) (point *cloudwatch.Datapoint, err error) {
+	return s.rdsMetric(instance, "FreeableMemory", "Bytes")
+}
+
+// RDS_FreeStorageSpace returns the last FreeStorageSpace datapoint for the specified instance.
+func (s *Session) RDS_FreeStorageSpace(instance string) (point *cloudwatch.Datapoint, err error) {
+	return s.rdsMetric(instance, "FreeStorageSpace", "Bytes")
+}
+
+// RDS_ReadIOPS returns the last ReadIOPS datapoint for the specified instance.
+func (s *Session) RDS_ReadIOPS(instance string) (point *cloudwatch.Datapoint, err error) {
+	return s.rdsMetric(instance, "ReadIOPS", "Count/Second")
+}
+
+// RDS_WriteIOPS returns the last WriteIOPS datapoint for the specified instance.
+func (s *Session) RDS_WriteIOPS(instance string) (point *cloudwatch.Datapoint, err error) {
+	return s.rdsMetric(instance, "WriteIOPS", "Count/Second")
+}
+
+// rdsMetric returns the last Maximum datapoint for the specified instance and metric
+func (s *Session) rdsMetric(instance, metric, unit string) (*cloudwatch.Datapoint, error) {
+	return s.GetLastCloudWatchValue("DBInstanceIdentifier", instance, "AWS/RDS", metric, cloudwatch.StatisticMaximum, unit)
+}
@@ -0,0 +1,59 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestNewRDSStorageInfos(t *testing.T) {
+	f, s := newFakeCloudWatch(t)
+	for _, id := range []string{"db-a", "db-b", "db-quiet"} {
+		f.instances[id] = 10
+	}
+	for _, id := range []string{"db-a", "db-b"} {
+		f.values["FreeStorageSpace/"+id] = 4 * 1073741824
+		f.values["ReadIOPS/"+id] = 100
+		f.values["WriteIOPS/"+id] = 50
+	}
+	// Not the instances asked about
+	f.instances["db-other"] = 10
+
+	infos, err := s.NewRDSStorageInfos([]string{"db-a", "db-quiet", "db-missing", "db-b"})
+	if !errors.Is(err, ErrNoDatapoints) {
+		t.Errorf("got error %v, want %v", err, ErrNoDatapoints)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("got %d infos, want 2", len(infos))
+	}
+	for _, id := range []string{"db-a", "db-b"} {
+		info := infos[id]
+		if info == nil {
+			t.Fatalf("no info for %s", id)
+		}
+		if info.Allocated != 10*1073741824 || info.PercFree != 40 || info.PercUsed != 60 || info.ReadIops != 100 || info.WriteIops != 50 {
+			t.Errorf("%s: got %+v", id, *info)
+		}
+	}
+
+	// The lookup is filtered to the instances asked about
+	if want := "[[db-a db-quiet db-missing db-b]]"; fmt.Sprint(f.filters) != want {
+		t.Errorf("described %v, want %s", f.filters, want)
+	}
+}
+
+func TestNewRDSStorageInfo(t *testing.T) {
+	f, s := newFakeCloudWatch(t)
+	f.instances["db-quiet"] = 10
+
+	if _, err := s.NewRDSStorageInfo("db-quiet"); !errors.Is(err, ErrNoDatapoints) {
+		t.Errorf("got error %v, want %v", err, ErrNoDatapoints)
+	}
+	if _, err := s.NewRDSStorageInfo("db-missing"); err == nil {
+		t.Error("missing instance didn't fail")
+	}
+	// Described, but not there, doesn't panic
+	if _, err := s.RDS_Instance("db-missing"); err == nil {
+		t.Error("missing instance didn't fail")
+	}
+}
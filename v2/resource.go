@@ -0,0 +1,300 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+var (
+	// ErrUnknownResource is returned when a resource string can't be parsed
+	ErrUnknownResource = errors.New("unknown resource identifier")
+	// ErrNoResourceMetrics is returned when a resource type has no CloudWatch namespace
+	ErrNoResourceMetrics = errors.New("resource type has no CloudWatch metrics")
+)
+
+// Resource types
+const (
+	ResourceInstance      = "instance"
+	ResourceVolume        = "volume"
+	ResourceSecurityGroup = "security-group"
+	ResourceSubnet        = "subnet"
+	ResourceElasticIP     = "elastic-ip"
+	ResourceImage         = "image"
+	ResourceSnapshot      = "snapshot"
+	ResourceDBInstance    = "db"
+	ResourceDBCluster     = "cluster"
+	ResourceLoadBalancer  = "loadbalancer"
+	ResourceBucket        = "bucket"
+	ResourceObject        = "object"
+	ResourceQueue         = "queue"
+	ResourceFunction      = "function"
+)
+
+// ResourceRef is a parsed AWS resource identifier. Region and Account are only
+// set if they could be determined from the identifier.
+type ResourceRef struct {
+	// Service is the ARN service name, e.g. "ec2", "rds", "elasticloadbalancing", "s3"
+	Service string
+	// Type is one of the Resource* constants
+	Type    string
+	Region  string
+	Account string
+	// ID is the resource's identifier, e.g. "i-0123456789abcdef0", "mydb", "app/name/1234", "bucket/key"
+	ID string
+}
+
+// bareIDPrefixes maps bare EC2 resource ID prefixes to their types
+var bareIDPrefixes = map[string]string{
+	"i-":        ResourceInstance,
+	"vol-":      ResourceVolume,
+	"sg-":       ResourceSecurityGroup,
+	"subnet-":   ResourceSubnet,
+	"eipalloc-": ResourceElasticIP,
+	"ami-":      ResourceImage,
+	"snap-":     ResourceSnapshot,
+}
+
+var (
+	// rdsEndpoint matches mydb.abc123.us-east-1.rds.amazonaws.com and mycluster.cluster-abc123.us-east-1.rds.amazonaws.com
+	rdsEndpoint = regexp.MustCompile(`^([^.]+)\.(cluster-(?:ro-)?)?[^.]+\.([a-z0-9-]+)\.rds\.amazonaws\.com$`)
+	// elbEndpoint matches name-123.us-east-1.elb.amazonaws.com and internal-name-123.us-east-1.elb.amazonaws.com
+	elbEndpoint = regexp.MustCompile(`^(?:internal-)?(.+)-[0-9a-f]+\.([a-z0-9-]+)\.elb\.amazonaws\.com$`)
+	// nlbEndpoint matches name-0123456789abcdef.elb.us-east-1.amazonaws.com, the hex being the NLB's ID
+	nlbEndpoint = regexp.MustCompile(`^(.+)-([0-9a-f]+)\.elb\.([a-z0-9-]+)\.amazonaws\.com$`)
+	// s3Virtual matches bucket.s3.amazonaws.com, bucket.s3.us-west-2.amazonaws.com and bucket.s3-us-west-2.amazonaws.com
+	s3Virtual = regexp.MustCompile(`^(.+)\.s3(?:[.-]([a-z0-9-]+))?\.amazonaws\.com$`)
+	// s3Path matches s3.amazonaws.com, s3.us-west-2.amazonaws.com and s3-us-west-2.amazonaws.com
+	s3Path = regexp.MustCompile(`^s3(?:[.-]([a-z0-9-]+))?\.amazonaws\.com$`)
+)
+
+// ParseResource parses an ARN, bare EC2 resource ID, RDS endpoint, ELB DNS name,
+// or S3 URL into a ResourceRef, or returns an error wrapping ErrUnknownResource
+func ParseResource(name string) (*ResourceRef, error) {
+	name = strings.TrimSpace(name)
+
+	switch {
+	case arn.IsARN(name):
+		return parseARN(name)
+	case strings.HasPrefix(name, "s3://"):
+		bucket, key, _ := S3urlToParts(name)
+		if bucket == "" {
+			// s3://bucket
+			bucket = strings.TrimSuffix(strings.TrimPrefix(name, "s3://"), "/")
+		}
+		return s3Ref(bucket, key, ""), nil
+	case strings.HasPrefix(name, "https://") || strings.HasPrefix(name, "http://"):
+		return parseURL(name)
+	}
+
+	for prefix, rtype := range bareIDPrefixes {
+		if strings.HasPrefix(name, prefix) && !strings.Contains(name, ".") {
+			return &ResourceRef{
+				Service: "ec2",
+				Type:    rtype,
+				ID:      name,
+			}, nil
+		}
+	}
+
+	// Hostnames, possibly with ports
+	host := name
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		host = host[:i]
+	}
+	if ref := parseHost(host, ""); ref != nil {
+		return ref, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownResource, name)
+}
+
+// parseARN does the work of ParseResource for ARNs
+func parseARN(name string) (*ResourceRef, error) {
+	a, err := arn.Parse(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownResource, err)
+	}
+
+	ref := ResourceRef{
+		Service: a.Service,
+		Region:  a.Region,
+		Account: a.AccountID,
+	}
+
+	switch a.Service {
+	case "s3":
+		// arn:aws:s3:::bucket or arn:aws:s3:::bucket/key
+		parts := strings.SplitN(a.Resource, "/", 2)
+		if len(parts) == 2 {
+			return s3Ref(parts[0], parts[1], ""), nil
+		}
+		return s3Ref(parts[0], "", ""), nil
+	case "sqs":
+		// arn:aws:sqs:region:account:queue
+		ref.Type = ResourceQueue
+		ref.ID = a.Resource
+		return &ref, nil
+	}
+
+	// type/id or type:id
+	i := strings.IndexAny(a.Resource, "/:")
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownResource, name)
+	}
+	ref.Type = a.Resource[:i]
+	ref.ID = a.Resource[i+1:]
+
+	if ref.Service == "lambda" && ref.Type == ResourceFunction {
+		// Drop any version or alias qualifier
+		ref.ID = strings.SplitN(ref.ID, ":", 2)[0]
+	}
+
+	return &ref, nil
+}
+
+// parseURL does the work of ParseResource for http[s] URLs
+func parseURL(name string) (*ResourceRef, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownResource, err)
+	}
+
+	if ref := parseHost(u.Hostname(), strings.TrimPrefix(u.Path, "/")); ref != nil {
+		return ref, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownResource, name)
+}
+
+// parseHost returns a ResourceRef for RDS, ELB and S3 hostnames, or nil. path is only
+// consulted for S3.
+func parseHost(host, path string) *ResourceRef {
+	host = strings.ToLower(host)
+
+	if m := rdsEndpoint.FindStringSubmatch(host); m != nil {
+		ref := ResourceRef{
+			Service: "rds",
+			Type:    ResourceDBInstance,
+			Region:  m[3],
+			ID:      m[1],
+		}
+		if m[2] != "" {
+			ref.Type = ResourceDBCluster
+		}
+		return &ref
+	}
+
+	if m := elbEndpoint.FindStringSubmatch(host); m != nil {
+		return &ResourceRef{
+			Service: "elasticloadbalancing",
+			Type:    ResourceLoadBalancer,
+			Region:  m[2],
+			ID:      m[1],
+		}
+	}
+	if m := nlbEndpoint.FindStringSubmatch(host); m != nil {
+		return &ResourceRef{
+			Service: "elasticloadbalancing",
+			Type:    ResourceLoadBalancer,
+			Region:  m[3],
+			ID:      "net/" + m[1] + "/" + m[2],
+		}
+	}
+
+	if m := s3Path.FindStringSubmatch(host); m != nil {
+		parts := strings.SplitN(path, "/", 2)
+		if parts[0] == "" {
+			return nil
+		}
+		if len(parts) == 2 {
+			return s3Ref(parts[0], parts[1], m[1])
+		}
+		return s3Ref(parts[0], "", m[1])
+	}
+	if m := s3Virtual.FindStringSubmatch(host); m != nil {
+		return s3Ref(m[1], path, m[2])
+	}
+
+	return nil
+}
+
+// s3Ref returns a ResourceRef for the bucket, or object if key isn't empty
+func s3Ref(bucket, key, region string) *ResourceRef {
+	ref := ResourceRef{
+		Service: "s3",
+		Type:    ResourceBucket,
+		Region:  region,
+		ID:      bucket,
+	}
+	if key != "" {
+		ref.Type = ResourceObject
+		ref.ID = bucket + "/" + key
+	}
+	return &ref
+}
+
+// CloudWatch returns the CloudWatch namespace, dimension name and dimension value
+// for the resource, or an error wrapping ErrNoResourceMetrics. NLB DNS names include
+// the NLB's ID, but Classic ELB and ALB DNS names don't, and can't be told apart, so
+// those are assumed to be Classic ELBs: use ALBs' ARNs instead.
+func (r *ResourceRef) CloudWatch() (namespace, dimensionName, dimensionValue string, err error) {
+	switch r.Service + ":" + r.Type {
+	case "ec2:" + ResourceInstance:
+		return "AWS/EC2", "InstanceId", r.ID, nil
+	case "ec2:" + ResourceVolume:
+		return "AWS/EBS", "VolumeId", r.ID, nil
+	case "rds:" + ResourceDBInstance:
+		return "AWS/RDS", "DBInstanceIdentifier", r.ID, nil
+	case "rds:" + ResourceDBCluster:
+		return "AWS/RDS", "DBClusterIdentifier", r.ID, nil
+	case "elasticloadbalancing:" + ResourceLoadBalancer:
+		switch {
+		case strings.HasPrefix(r.ID, "app/"):
+			return "AWS/ApplicationELB", "LoadBalancer", r.ID, nil
+		case strings.HasPrefix(r.ID, "net/"):
+			return "AWS/NetworkELB", "LoadBalancer", r.ID, nil
+		}
+		return "AWS/ELB", "LoadBalancerName", r.ID, nil
+	case "s3:" + ResourceBucket, "s3:" + ResourceObject:
+		return "AWS/S3", "BucketName", strings.SplitN(r.ID, "/", 2)[0], nil
+	case "sqs:" + ResourceQueue:
+		return "AWS/SQS", "QueueName", r.ID, nil
+	case "lambda:" + ResourceFunction:
+		return "AWS/Lambda", "FunctionName", r.ID, nil
+	}
+	return "", "", "", fmt.Errorf("%w: %s %s", ErrNoResourceMetrics, r.Service, r.Type)
+}
+
+// MetricQuery returns a MetricQuery for the named metric of the resource,
+// or an error wrapping ErrNoResourceMetrics
+func (r *ResourceRef) MetricQuery(metric string, statistics ...string) (*MetricQuery, error) {
+	namespace, dimensionName, dimensionValue, err := r.CloudWatch()
+	if err != nil {
+		return nil, err
+	}
+	return &MetricQuery{
+		Namespace:  namespace,
+		MetricName: metric,
+		Dimensions: map[string]string{dimensionName: dimensionValue},
+		Statistics: statistics,
+	}, nil
+}
+
+// GetResourceCloudWatchValue returns the most recent datapoint for the specified metric of
+// any resource string ParseResource understands, or an error
+func (s *Session) GetResourceCloudWatchValue(resource, metric, stat, unit string) (*cloudwatch.Datapoint, error) {
+	ref, err := ParseResource(resource)
+	if err != nil {
+		return nil, err
+	}
+	namespace, dimensionName, dimensionValue, err := ref.CloudWatch()
+	if err != nil {
+		return nil, err
+	}
+	return s.GetLastCloudWatchValue(dimensionName, dimensionValue, namespace, metric, stat, unit)
+}
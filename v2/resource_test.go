@@ -0,0 +1,134 @@
+package aws
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseResource(t *testing.T) {
+	tests := []struct {
+		name string
+		want ResourceRef
+		// namespace and dimension are CloudWatch's, if any
+		namespace, dimension, value string
+	}{
+		{"i-0123456789abcdef0", ResourceRef{Service: "ec2", Type: ResourceInstance, ID: "i-0123456789abcdef0"}, "AWS/EC2", "InstanceId", "i-0123456789abcdef0"},
+		{" vol-0123 ", ResourceRef{Service: "ec2", Type: ResourceVolume, ID: "vol-0123"}, "AWS/EBS", "VolumeId", "vol-0123"},
+		{"sg-0123", ResourceRef{Service: "ec2", Type: ResourceSecurityGroup, ID: "sg-0123"}, "", "", ""},
+		{"eipalloc-0123", ResourceRef{Service: "ec2", Type: ResourceElasticIP, ID: "eipalloc-0123"}, "", "", ""},
+		{
+			"arn:aws:ec2:us-east-1:123456789012:instance/i-0123",
+			ResourceRef{Service: "ec2", Type: ResourceInstance, Region: "us-east-1", Account: "123456789012", ID: "i-0123"},
+			"AWS/EC2", "InstanceId", "i-0123",
+		},
+		{
+			"arn:aws:rds:us-east-1:123456789012:db:mydb",
+			ResourceRef{Service: "rds", Type: ResourceDBInstance, Region: "us-east-1", Account: "123456789012", ID: "mydb"},
+			"AWS/RDS", "DBInstanceIdentifier", "mydb",
+		},
+		{
+			"arn:aws:rds:us-east-1:123456789012:cluster:mycluster",
+			ResourceRef{Service: "rds", Type: ResourceDBCluster, Region: "us-east-1", Account: "123456789012", ID: "mycluster"},
+			"AWS/RDS", "DBClusterIdentifier", "mycluster",
+		},
+		{
+			"arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/my-alb/50dc6c495c0c9188",
+			ResourceRef{Service: "elasticloadbalancing", Type: ResourceLoadBalancer, Region: "us-east-1", Account: "123456789012", ID: "app/my-alb/50dc6c495c0c9188"},
+			"AWS/ApplicationELB", "LoadBalancer", "app/my-alb/50dc6c495c0c9188",
+		},
+		{
+			"arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/net/my-nlb/5d1b75f4f1cee11e",
+			ResourceRef{Service: "elasticloadbalancing", Type: ResourceLoadBalancer, Region: "us-east-1", Account: "123456789012", ID: "net/my-nlb/5d1b75f4f1cee11e"},
+			"AWS/NetworkELB", "LoadBalancer", "net/my-nlb/5d1b75f4f1cee11e",
+		},
+		{
+			"arn:aws:sqs:us-east-1:123456789012:my-queue",
+			ResourceRef{Service: "sqs", Type: ResourceQueue, Region: "us-east-1", Account: "123456789012", ID: "my-queue"},
+			"AWS/SQS", "QueueName", "my-queue",
+		},
+		{
+			"arn:aws:lambda:us-east-1:123456789012:function:my-func:prod",
+			ResourceRef{Service: "lambda", Type: ResourceFunction, Region: "us-east-1", Account: "123456789012", ID: "my-func"},
+			"AWS/Lambda", "FunctionName", "my-func",
+		},
+		{"arn:aws:s3:::bucket", ResourceRef{Service: "s3", Type: ResourceBucket, ID: "bucket"}, "AWS/S3", "BucketName", "bucket"},
+		{"arn:aws:s3:::bucket/dir/key", ResourceRef{Service: "s3", Type: ResourceObject, ID: "bucket/dir/key"}, "AWS/S3", "BucketName", "bucket"},
+		{
+			"mydb.abc123.us-east-1.rds.amazonaws.com",
+			ResourceRef{Service: "rds", Type: ResourceDBInstance, Region: "us-east-1", ID: "mydb"},
+			"AWS/RDS", "DBInstanceIdentifier", "mydb",
+		},
+		{
+			"mydb.abc123.us-east-1.rds.amazonaws.com:5432",
+			ResourceRef{Service: "rds", Type: ResourceDBInstance, Region: "us-east-1", ID: "mydb"},
+			"AWS/RDS", "DBInstanceIdentifier", "mydb",
+		},
+		{
+			"mycluster.cluster-ro-abc123.eu-west-1.rds.amazonaws.com",
+			ResourceRef{Service: "rds", Type: ResourceDBCluster, Region: "eu-west-1", ID: "mycluster"},
+			"AWS/RDS", "DBClusterIdentifier", "mycluster",
+		},
+		{
+			"my-elb-1234567890.us-east-1.elb.amazonaws.com",
+			ResourceRef{Service: "elasticloadbalancing", Type: ResourceLoadBalancer, Region: "us-east-1", ID: "my-elb"},
+			"AWS/ELB", "LoadBalancerName", "my-elb",
+		},
+		{
+			"internal-my-elb-1234567890.us-east-1.elb.amazonaws.com",
+			ResourceRef{Service: "elasticloadbalancing", Type: ResourceLoadBalancer, Region: "us-east-1", ID: "my-elb"},
+			"AWS/ELB", "LoadBalancerName", "my-elb",
+		},
+		{
+			"my-nlb-5d1b75f4f1cee11e.elb.us-east-2.amazonaws.com",
+			ResourceRef{Service: "elasticloadbalancing", Type: ResourceLoadBalancer, Region: "us-east-2", ID: "net/my-nlb/5d1b75f4f1cee11e"},
+			"AWS/NetworkELB", "LoadBalancer", "net/my-nlb/5d1b75f4f1cee11e",
+		},
+		{"s3://bucket", ResourceRef{Service: "s3", Type: ResourceBucket, ID: "bucket"}, "AWS/S3", "BucketName", "bucket"},
+		{"s3://bucket/dir/key", ResourceRef{Service: "s3", Type: ResourceObject, ID: "bucket/dir/key"}, "AWS/S3", "BucketName", "bucket"},
+		{"https://bucket.s3.amazonaws.com/key", ResourceRef{Service: "s3", Type: ResourceObject, ID: "bucket/key"}, "AWS/S3", "BucketName", "bucket"},
+		{"https://bucket.s3.us-west-2.amazonaws.com/", ResourceRef{Service: "s3", Type: ResourceBucket, Region: "us-west-2", ID: "bucket"}, "AWS/S3", "BucketName", "bucket"},
+		{"https://s3-us-west-2.amazonaws.com/bucket/key", ResourceRef{Service: "s3", Type: ResourceObject, Region: "us-west-2", ID: "bucket/key"}, "AWS/S3", "BucketName", "bucket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := ParseResource(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *ref != tt.want {
+				t.Errorf("got %+v, want %+v", *ref, tt.want)
+			}
+
+			namespace, dimension, value, err := ref.CloudWatch()
+			if tt.namespace == "" {
+				if !errors.Is(err, ErrNoResourceMetrics) {
+					t.Errorf("got error %v, want %v", err, ErrNoResourceMetrics)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if namespace != tt.namespace || dimension != tt.dimension || value != tt.value {
+				t.Errorf("got %s %s=%s, want %s %s=%s", namespace, dimension, value, tt.namespace, tt.dimension, tt.value)
+			}
+		})
+	}
+}
+
+func TestParseResourceUnknown(t *testing.T) {
+	for _, name := range []string{
+		"",
+		"mystery",
+		"example.com",
+		"https://example.com/path",
+		"https://s3.amazonaws.com/",
+		"arn:aws:iam::123456789012:root",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if ref, err := ParseResource(name); !errors.Is(err, ErrUnknownResource) {
+				t.Errorf("got %+v, %v, want error %v", ref, err, ErrUnknownResource)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// DefaultPresignExpiry is how long presigned requests are valid for, if PresignOptions.Expires isn't set
+const DefaultPresignExpiry = 15 * time.Minute
+
+// PresignOptions controls S3Presign
+type PresignOptions struct {
+	// Method is GET (default), PUT, HEAD or DELETE
+	Method string
+	// Expires is how long the request is valid for. Default DefaultPresignExpiry, maximum 7 days.
+	Expires time.Duration
+	// VersionID selects an object version, for GET, HEAD and DELETE
+	VersionID string
+
+	// ContentType, ContentMD5 (base64), ServerSideEncryption ("AES256" or "aws:kms") and
+	// SSEKMSKeyID are signed into PUT requests, so the uploader must send them as given
+	ContentType          string
+	ContentMD5           string
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+
+	// ResponseContentDisposition and ResponseContentType override those headers in
+	// GET and HEAD responses, e.g. `attachment; filename="report.csv"`
+	ResponseContentDisposition string
+	ResponseContentType        string
+
+	// Region is the bucket's region, if different from the Session's
+	Region string
+	// Endpoint is a custom S3 endpoint, e.g. "http://localhost:9000" for MinIO
+	Endpoint string
+	// PathStyle forces path-style (https://host/bucket/key) rather than virtual-hosted-style
+	// (https://bucket.host/key) addressing. Usually wanted with Endpoint.
+	PathStyle bool
+	// DualStack uses the IPv4/IPv6 dual-stack endpoint
+	DualStack bool
+	// FIPS uses the FIPS endpoint
+	FIPS bool
+	// Credentials, if set, sign the request instead of the Session's credentials
+	Credentials *credentials.Credentials
+}
+
+// PresignedRequest is a presigned S3 request
+type PresignedRequest struct {
+	Method string
+	URL    string
+	// Header holds the signed headers, which must be sent with the request
+	Header http.Header
+}
+
+// S3Presign presigns a request for the key in the bucket, per the options
+func (s *Session) S3Presign(bucket, key string, opts PresignOptions) (*PresignedRequest, error) {
+	if opts.Method == "" {
+		opts.Method = http.MethodGet
+	}
+	if opts.Expires <= 0 {
+		opts.Expires = DefaultPresignExpiry
+	}
+
+	svc := s.presignClient(opts)
+
+	var req *request.Request
+	switch opts.Method {
+	case http.MethodGet:
+		req, _ = svc.GetObjectRequest(&s3.GetObjectInput{
+			Bucket:                     aws.String(bucket),
+			Key:                        aws.String(key),
+			VersionId:                  optionalString(opts.VersionID),
+			ResponseContentDisposition: optionalString(opts.ResponseContentDisposition),
+			ResponseContentType:        optionalString(opts.ResponseContentType),
+		})
+	case http.MethodHead:
+		req, _ = svc.HeadObjectRequest(&s3.HeadObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(key),
+			VersionId: optionalString(opts.VersionID),
+		})
+		// HeadObjectInput lacks the response overrides, but S3 honors them
+		q := req.HTTPRequest.URL.Query()
+		if opts.ResponseContentDisposition != "" {
+			q.Set("response-content-disposition", opts.ResponseContentDisposition)
+		}
+		if opts.ResponseContentType != "" {
+			q.Set("response-content-type", opts.ResponseContentType)
+		}
+		req.HTTPRequest.URL.RawQuery = q.Encode()
+	case http.MethodPut:
+		req, _ = svc.PutObjectRequest(&s3.PutObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			ContentType:          optionalString(opts.ContentType),
+			ContentMD5:           optionalString(opts.ContentMD5),
+			ServerSideEncryption: optionalString(opts.ServerSideEncryption),
+			SSEKMSKeyId:          optionalString(opts.SSEKMSKeyID),
+		})
+	case http.MethodDelete:
+		req, _ = svc.DeleteObjectRequest(&s3.DeleteObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(key),
+			VersionId: optionalString(opts.VersionID),
+		})
+	default:
+		return nil, fmt.Errorf("unsupported presign method %q", opts.Method)
+	}
+
+	url, header, err := req.PresignRequest(opts.Expires)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PresignedRequest{
+		Method: opts.Method,
+		URL:    url,
+		Header: header,
+	}, nil
+}
+
+// presignClient returns an S3 client configured per the endpoint and credential options
+func (s *Session) presignClient(opts PresignOptions) *s3.S3 {
+	cfg := aws.NewConfig()
+	if opts.Region != "" {
+		cfg.Region = aws.String(opts.Region)
+	}
+	if opts.Endpoint != "" {
+		cfg.Endpoint = aws.String(opts.Endpoint)
+	}
+	if opts.PathStyle {
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+	if opts.DualStack {
+		cfg.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	}
+	if opts.FIPS {
+		cfg.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	if opts.Credentials != nil {
+		cfg.Credentials = opts.Credentials
+	}
+	return s3.New(s.AWS, cfg)
+}
+
+// S3PresignV4 "presigns" a path-style S3 GET URL, e.g. https://s3.amazonaws.com/bucket/path.
+// If creds is nil, the Session credentials are used. If bucketRegion is empty, the Session
+// region is used. Use S3Presign for virtual-hosted-style URLs and other options.
+func (s *Session) S3PresignV4(bucketName, filePath, bucketRegion string, expireFromNow time.Duration, creds *credentials.Credentials) (signedUrl string, err error) {
+
+	req, err := s.S3Presign(bucketName, strings.TrimPrefix(filePath, "/"), PresignOptions{
+		Expires:     expireFromNow,
+		Region:      bucketRegion,
+		PathStyle:   true,
+		Credentials: creds,
+	})
+	if err == nil {
+		signedUrl = req.URL
+	}
+
+	return
+}
+
+// optionalString returns nil for empty strings, else a pointer to the string
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+// BucketToFileVersion copies a version of a file from an S3 bucket to a local file, as BucketToFile does
+func (s *Session) BucketToFileVersion(bucket, bucketPath, filename, version string) (size int64, err error) {
+
+	return s.bucketToFile(bucket, bucketPath, filename, version)
+}
+
+// bucketToFile downloads the object, or a version of it, atomically with S3Object.DownloadFile
+func (s *Session) bucketToFile(bucket, bucketPath, filename, version string) (size int64, err error) {
+
+	object := s.NewS3Object(bucket, bucketPath)
+	object.VersionID = version
+	return object.DownloadFile(filename, DownloadFileMode)
+}
+
+// UploadOptions controls FileToBucketWithOptions
+type UploadOptions struct {
+	// Key is the object key. If empty, KeyPrefix and the file's base name are used.
+	Key       string
+	KeyPrefix string
+	// ContentType, if empty, is detected from the file's extension, or else its content
+	ContentType  string
+	CacheControl string
+	// Metadata is stored as x-amz-meta-* headers
+	Metadata map[string]string
+	Tags     map[string]string
+	// ACL is a canned ACL, e.g. "private" or "bucket-owner-full-control"
+	ACL string
+	// StorageClass is e.g. "STANDARD_IA" or "INTELLIGENT_TIERING"
+	StorageClass string
+	// ServerSideEncryption is "AES256" or "aws:kms", with SSEKMSKeyID optionally naming the key
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+	// SSECustomerKey is a 32-byte key for SSE-C. It must be provided again to download the object.
+	SSECustomerKey []byte
+}
+
+// UploadResult is the outcome of FileToBucketWithOptions
+type UploadResult struct {
+	Key      string
+	ETag     string
+	Location string
+	// VersionID is only set if the bucket is versioned
+	VersionID string
+	// Size is the size of the local file
+	Size int64
+}
+
+// FileToBucket copies a "local" file to an S3 bucket
+func (s *Session) FileToBucket(filename, bucket string) (size int64, err error) {
+
+	result, err := s.FileToBucketWithOptions(filename, bucket, UploadOptions{})
+	if result != nil {
+		size = result.Size
+	}
+
+	return
+}
+
+// FileToBucketWithOptions copies a "local" file to an S3 bucket, per the options
+func (s *Session) FileToBucketWithOptions(filename, bucket string, opts UploadOptions) (result *UploadResult, err error) {
+
+	// Open the file
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	result = &UploadResult{Key: opts.Key}
+	if result.Key == "" {
+		result.Key = opts.KeyPrefix + filepath.Base(filename)
+	}
+
+	// Get the filesize
+	fi, ferr := file.Stat()
+	if ferr == nil {
+		result.Size = fi.Size()
+	}
+
+	if opts.ContentType == "" {
+		if opts.ContentType, err = detectContentType(file); err != nil {
+			return
+		}
+	}
+
+	input := opts.uploadInput(bucket, result.Key)
+	input.Body = file
+
+	// Setup the uploader, and git'r'done
+	svc := s3manager.NewUploader(s.AWS)
+	out, err := svc.Upload(input)
+	if err != nil {
+		return
+	}
+
+	result.ETag = strings.Trim(aws.StringValue(out.ETag), `"`)
+	result.Location = out.Location
+	result.VersionID = aws.StringValue(out.VersionID)
+	return
+}
+
+// uploadInput returns an UploadInput for the key, per the options, lacking only the Body
+func (opts *UploadOptions) uploadInput(bucket, key string) *s3manager.UploadInput {
+	input := s3manager.UploadInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		ContentType:          optionalString(opts.ContentType),
+		CacheControl:         optionalString(opts.CacheControl),
+		ACL:                  optionalString(opts.ACL),
+		StorageClass:         optionalString(opts.StorageClass),
+		ServerSideEncryption: optionalString(opts.ServerSideEncryption),
+		SSEKMSKeyId:          optionalString(opts.SSEKMSKeyID),
+	}
+	if len(opts.Metadata) > 0 {
+		input.Metadata = aws.StringMap(opts.Metadata)
+	}
+	if len(opts.Tags) > 0 {
+		tags := make(url.Values, len(opts.Tags))
+		for k, v := range opts.Tags {
+			tags.Set(k, v)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+	if len(opts.SSECustomerKey) > 0 {
+		// The SDK base64s the key and adds its MD5
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(string(opts.SSECustomerKey))
+	}
+
+	return &input
+}
+
+// detectContentType returns the content type of the file, from its extension, or else its first
+// 512 bytes, leaving the file at the start
+func detectContentType(file *os.File) (string, error) {
+	if ct := mime.TypeByExtension(filepath.Ext(file.Name())); ct != "" {
+		return ct, nil
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// Calculate_etag reads the specified filename in chunkSizeMB blocks, and returns
+// the S3 multipart-upload etag/md5sum-of-sums, or the plain MD5 if the file fits in
+// one block, as S3 gives it, or an error. See also CalculateETag and MatchETag.
+func Calculate_etag(filename string, chunkSizeMB int64) (etag string, err error) {
+	if chunkSizeMB < 1 {
+		return "", errors.New("chunk size must be at least 1MB")
+	}
+	return fileETag(filename, chunkSizeMB*1024*1024, false)
+}
@@ -0,0 +1,457 @@
+package aws
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// presignStandIn is a local S3-compatible stand-in that serves "hello" for any GET whose
+// presigned SigV4 query string verifies against creds, and 403 otherwise
+type presignStandIn struct {
+	creds *credentials.Credentials
+}
+
+func (p *presignStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	when, err := time.Parse("20060102T150405Z", q.Get("X-Amz-Date"))
+	if err != nil {
+		http.Error(w, "no date", http.StatusForbidden)
+		return
+	}
+	expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil {
+		http.Error(w, "no expiry", http.StatusForbidden)
+		return
+	}
+	if time.Now().After(when.Add(time.Duration(expires) * time.Second)) {
+		http.Error(w, "expired", http.StatusForbidden)
+		return
+	}
+	// AKID/date/region/s3/aws4_request
+	scope := strings.Split(q.Get("X-Amz-Credential"), "/")
+	if len(scope) != 5 {
+		http.Error(w, "bad credential", http.StatusForbidden)
+		return
+	}
+
+	// Presign the same request again, and compare the signatures
+	unsigned := *r.URL
+	uq := unsigned.Query()
+	for k := range uq {
+		if strings.HasPrefix(k, "X-Amz-") {
+			uq.Del(k)
+		}
+	}
+	unsigned.RawQuery = uq.Encode()
+	unsigned.Scheme, unsigned.Host = "http", r.Host
+
+	req, _ := http.NewRequest(r.Method, unsigned.String(), nil)
+	signer := v4.NewSigner(p.creds, func(s *v4.Signer) { s.DisableURIPathEscaping = true })
+	if _, err = signer.Presign(req, nil, "s3", scope[2], time.Duration(expires)*time.Second, when); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.URL.Query().Get("X-Amz-Signature") != q.Get("X-Amz-Signature") {
+		http.Error(w, "signature mismatch", http.StatusForbidden)
+		return
+	}
+	io.WriteString(w, "hello")
+}
+
+// fakeS3 is a local, path-style stand-in for the S3 object API, holding objects by key,
+// whatever the bucket. PUT, GET, including ranges, HEAD, DELETE, ListObjectsV2 and
+// multipart uploads are implemented, and anything else is a 501.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	uploads map[string]map[int][]byte
+	// requests lists the requests, as "METHOD key", and parts the sizes of the uploaded parts
+	requests []string
+	parts    []int
+	// failPart, if set, is a part number whose uploads are denied
+	failPart int
+}
+
+// fakeObject is an object in a fakeS3
+type fakeObject struct {
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+// newFakeS3 starts a fakeS3, returning it and a Session using it
+func newFakeS3(t *testing.T) (*fakeS3, *Session) {
+	t.Helper()
+	f := &fakeS3{objects: make(map[string]*fakeObject), uploads: make(map[string]map[int][]byte)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, newTestSession(t, WithEndpoint("s3", srv.URL), WithS3PathStyle())
+}
+
+// object returns the object's data, and whether it exists
+func (f *fakeS3) object(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.objects[key]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+// put stores an object
+func (f *fakeS3) put(key string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sum := md5.Sum(data)
+	f.objects[key] = &fakeObject{data: data, etag: hex.EncodeToString(sum[:]), modified: time.Now()}
+}
+
+// putAt stores an object with the modification time
+func (f *fakeS3) putAt(key string, data []byte, modified time.Time) {
+	f.put(key, data)
+	f.mu.Lock()
+	f.objects[key].modified = modified
+	f.mu.Unlock()
+}
+
+// keys returns the keys of the objects, sorted
+func (f *fakeS3) keys() (keys []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// fakeS3Error writes an S3 error response
+func fakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// /bucket/key
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	key := ""
+	if len(path) == 2 {
+		key = path[1]
+	}
+
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+key)
+	f.mu.Unlock()
+
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, q.Get("prefix"))
+	case q.Has("uploads") || q.Has("uploadId"):
+		f.multipart(w, r, key)
+	default:
+		f.serveObject(w, r, key)
+	}
+}
+
+// list writes a ListObjectsV2 response, in one page
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	fmt.Fprint(w, `<ListBucketResult><IsTruncated>false</IsTruncated>`)
+	for _, k := range f.keys() {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		f.mu.Lock()
+		o := f.objects[k]
+		f.mu.Unlock()
+		fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size><ETag>&quot;%s&quot;</ETag><LastModified>%s</LastModified></Contents>`,
+			k, len(o.data), o.etag, o.modified.UTC().Format(time.RFC3339Nano))
+	}
+	fmt.Fprint(w, `</ListBucketResult>`)
+}
+
+// multipart handles the multipart upload calls
+func (f *fakeS3) multipart(w http.ResponseWriter, r *http.Request, key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	q := r.URL.Query()
+	id := q.Get("uploadId")
+	if r.Method == http.MethodPost && q.Has("uploads") {
+		id = fmt.Sprintf("upload-%d", len(f.requests))
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, id)
+		return
+	}
+	parts, ok := f.uploads[id]
+	if !ok {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			fakeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		if n == f.failPart {
+			fakeS3Error(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		parts[n] = data
+		f.parts = append(f.parts, len(data))
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(data)))
+
+	case http.MethodGet:
+		// ListParts, in one page
+		fmt.Fprint(w, `<ListPartsResult><IsTruncated>false</IsTruncated>`)
+		for n, data := range parts {
+			fmt.Fprintf(w, `<Part><PartNumber>%d</PartNumber><ETag>&quot;%x&quot;</ETag><Size>%d</Size></Part>`, n, md5.Sum(data), len(data))
+		}
+		fmt.Fprint(w, `</ListPartsResult>`)
+
+	case http.MethodPost:
+		// Complete, in part number order
+		var (
+			numbers   []int
+			data, mds []byte
+		)
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		for _, n := range numbers {
+			sum := md5.Sum(parts[n])
+			data = append(data, parts[n]...)
+			mds = append(mds, sum[:]...)
+		}
+		f.objects[key] = &fakeObject{data: data, etag: fmt.Sprintf("%x-%d", md5.Sum(mds), len(numbers)), modified: time.Now()}
+		delete(f.uploads, id)
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Key>%s</Key><ETag>&quot;%s&quot;</ETag></CompleteMultipartUploadResult>`, key, f.objects[key].etag)
+
+	case http.MethodDelete:
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// serveObject handles the object calls
+func (f *fakeS3) serveObject(w http.ResponseWriter, r *http.Request, key string) {
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			fakeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.put(key, data)
+		f.mu.Lock()
+		w.Header().Set("ETag", `"`+f.objects[key].etag+`"`)
+		f.mu.Unlock()
+
+	case http.MethodGet, http.MethodHead:
+		f.mu.Lock()
+		o, ok := f.objects[key]
+		f.mu.Unlock()
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", `"`+o.etag+`"`)
+		w.Header().Set("Last-Modified", o.modified.UTC().Format(http.TimeFormat))
+
+		data, status := o.data, http.StatusOK
+		if rg := r.Header.Get("Range"); rg != "" {
+			var first, last int
+			if _, err := fmt.Sscanf(rg, "bytes=%d-%d", &first, &last); err != nil || first >= len(data) {
+				fakeS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			last = min(last, len(data)-1)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(data)))
+			data, status = data[first:last+1], http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+
+	case http.MethodDelete:
+		f.mu.Lock()
+		delete(f.objects, key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func TestS3PresignV4StandIn(t *testing.T) {
+	standIn := &presignStandIn{creds: credentials.NewStaticCredentials("AKIDTEST", "SECRETTEST", "")}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	s := newTestSession(t, WithEndpoint("s3", srv.URL))
+
+	tests := []struct {
+		name   string
+		path   string
+		creds  *credentials.Credentials
+		status int
+	}{
+		{"session credentials", "/dir/file.txt", nil, http.StatusOK},
+		{"no leading slash", "dir/file.txt", nil, http.StatusOK},
+		{"escaped key", "/dir/a file+b.txt", nil, http.StatusOK},
+		{"given credentials", "/dir/file.txt", credentials.NewStaticCredentials("AKIDTEST", "SECRETTEST", ""), http.StatusOK},
+		{"wrong credentials", "/dir/file.txt", credentials.NewStaticCredentials("AKIDTEST", "SECRETOTHER", ""), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed, err := s.S3PresignV4("bucket", tt.path, "", time.Minute, tt.creds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "/bucket/" + strings.TrimPrefix(tt.path, "/"); u.Path != want {
+				t.Errorf("path is %q, want path-style %q", u.Path, want)
+			}
+
+			resp, err := http.Get(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status {
+				t.Errorf("got %d %s, want %d", resp.StatusCode, body, tt.status)
+			}
+		})
+	}
+
+	// Tampering with the signed URL fails
+	signed, err := s.S3PresignV4("bucket", "/dir/file.txt", "", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(strings.Replace(signed, "/dir/file.txt", "/dir/other.txt", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("tampered URL got %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestS3PresignV4PathStyle(t *testing.T) {
+	s := newTestSession(t)
+
+	tests := []struct {
+		region string
+		prefix string
+	}{
+		{"", "https://s3.amazonaws.com/bucket/dir/file.txt?"},
+		{"us-east-1", "https://s3.amazonaws.com/bucket/dir/file.txt?"},
+		{"eu-west-1", "https://s3.eu-west-1.amazonaws.com/bucket/dir/file.txt?"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.region, func(t *testing.T) {
+			signed, err := s.S3PresignV4("bucket", "/dir/file.txt", tt.region, time.Minute, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(signed, tt.prefix) {
+				t.Errorf("got %s, want it to start %s", signed, tt.prefix)
+			}
+		})
+	}
+}
+
+func TestBucketToFile(t *testing.T) {
+	f, s := newFakeS3(t)
+	f.put("key", []byte("new"))
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "file")
+	if err := os.WriteFile(filename, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed download leaves the file alone
+	if _, err := s.BucketToFile("bucket", "missing", filename); err == nil {
+		t.Error("got no error for a missing object")
+	}
+	if data, _ := os.ReadFile(filename); string(data) != "old" {
+		t.Errorf("file is %q after a failed download, want old", data)
+	}
+
+	for _, download := range []func() (int64, error){
+		func() (int64, error) { return s.BucketToFile("bucket", "key", filename) },
+		func() (int64, error) { return s.BucketToFileVersion("bucket", "key", filename, "v1") },
+	} {
+		size, err := download()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := os.ReadFile(filename)
+		fi, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != 3 || string(data) != "new" || fi.Mode().Perm() != DownloadFileMode {
+			t.Errorf("downloaded %d bytes, %q, with mode %v", size, data, fi.Mode().Perm())
+		}
+	}
+
+	// No temporary files are left
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files in the directory, want 1", len(entries))
+	}
+}
+
+func TestS3ObjectWriteTo(t *testing.T) {
+	f, s := newFakeS3(t)
+	data := patternBytes(testMB)
+	f.put("key", data)
+
+	var buf bytes.Buffer
+	n, err := s.NewS3Object("bucket", "key").WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("wrote %d bytes, want %d", n, len(data))
+	}
+
+	if _, err = s.NewS3Object("bucket", "missing").WriteTo(&buf); err == nil {
+		t.Error("got no error for a missing object")
+	}
+}
@@ -0,0 +1,346 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	// DefaultReadAhead is how much an S3Reader fetches at a time, if S3Object.ReadAhead isn't set
+	DefaultReadAhead = 8 * 1024 * 1024
+
+	// downloadTempPrefix prefixes the temporary files downloads are written to
+	downloadTempPrefix = ".download-"
+)
+
+// DownloadFileMode is the permissions BucketToFile, BucketToFileVersion and ResumableDownload give the files they complete
+var DownloadFileMode os.FileMode = 0644
+
+// errUploadAborted is what an S3Writer's upload fails with when it's aborted
+var errUploadAborted = errors.New("upload aborted")
+
+// S3Object is a handle on an object in S3, for streaming reads and writes without local files.
+// Change the exported fields, if desired, before reading or writing.
+type S3Object struct {
+	Bucket string
+	Key    string
+	// VersionID, if set, selects the version read
+	VersionID string
+	// ReadAhead is how much an S3Reader fetches per ranged GET. Default DefaultReadAhead.
+	ReadAhead int64
+
+	svc  *s3.S3
+	mu   sync.Mutex
+	size int64
+	etag string
+}
+
+// NewS3Object returns an S3Object for the key in the bucket. Nothing is fetched until it's used.
+func (s *Session) NewS3Object(bucket, key string) *S3Object {
+	return &S3Object{
+		Bucket: bucket,
+		Key:    key,
+		svc:    s3.New(s.AWS),
+		size:   -1,
+	}
+}
+
+// Size returns the size of the object, fetching it with a HEAD the first time
+func (o *S3Object) Size() (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.size >= 0 {
+		return o.size, nil
+	}
+
+	resp, err := o.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket:    aws.String(o.Bucket),
+		Key:       aws.String(o.Key),
+		VersionId: optionalString(o.VersionID),
+	})
+	if err != nil {
+		return 0, err
+	}
+	o.size = aws.Int64Value(resp.ContentLength)
+	o.etag = aws.StringValue(resp.ETag)
+	return o.size, nil
+}
+
+// ReadAt reads len(p) bytes from the object at off with a ranged GET. It is safe for concurrent use.
+func (o *S3Object) ReadAt(p []byte, off int64) (int, error) {
+	size, err := o.Size()
+	if err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	want := p
+	if off+int64(len(p)) > size {
+		want = p[:size-off]
+	}
+
+	input := s3.GetObjectInput{
+		Bucket:    aws.String(o.Bucket),
+		Key:       aws.String(o.Key),
+		VersionId: optionalString(o.VersionID),
+		Range:     aws.String(fmt.Sprintf("bytes=%d-%d", off, off+int64(len(want))-1)),
+	}
+	if o.VersionID == "" && o.etag != "" {
+		// Don't stitch together pieces of different objects
+		input.IfMatch = aws.String(o.etag)
+	}
+	resp, err := o.svc.GetObject(&input)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.ReadFull(resp.Body, want)
+	if err == nil && len(want) < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// NewReader returns an io.ReadSeeker over the object, which fetches ReadAhead bytes at a time
+func (o *S3Object) NewReader() *S3Reader {
+	return &S3Reader{object: o}
+}
+
+// S3Reader is an io.ReadSeeker over an S3Object. It is not safe for concurrent use.
+type S3Reader struct {
+	object *S3Object
+	offset int64
+	buf    []byte
+	bufAt  int64
+}
+
+// Read reads from the current offset, from the read-ahead buffer if possible
+func (r *S3Reader) Read(p []byte) (int, error) {
+	if r.offset < r.bufAt || r.offset >= r.bufAt+int64(len(r.buf)) {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf[r.offset-r.bufAt:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// fill reads ahead from the current offset
+func (r *S3Reader) fill() error {
+	size := r.object.ReadAhead
+	if size <= 0 {
+		size = DefaultReadAhead
+	}
+	if cap(r.buf) < int(size) {
+		r.buf = make([]byte, size)
+	}
+
+	n, err := r.object.ReadAt(r.buf[:size], r.offset)
+	r.buf = r.buf[:n]
+	r.bufAt = r.offset
+	if n > 0 && err == io.EOF {
+		// Got the tail end
+		return nil
+	}
+	return err
+}
+
+// Seek sets the offset for the next Read
+func (r *S3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		size, err := r.object.Size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// NewWriter returns an io.WriteCloser that uploads everything written to it to the object,
+// in parts as they fill, per the options (Key and KeyPrefix are ignored). Close must be
+// called to finish the upload, and returns any error uploading. Abort abandons it.
+func (o *S3Object) NewWriter(opts UploadOptions) *S3Writer {
+	pr, pw := io.Pipe()
+	w := S3Writer{
+		pw:     pw,
+		done:   make(chan struct{}),
+		svc:    o.svc,
+		bucket: o.Bucket,
+		key:    o.Key,
+	}
+
+	input := opts.uploadInput(o.Bucket, o.Key)
+	input.Body = pr
+
+	go func() {
+		defer close(w.done)
+		out, err := s3manager.NewUploaderWithClient(o.svc).Upload(input)
+		// Unblock any Write if the upload gave up
+		pr.CloseWithError(err)
+		w.err = err
+		if err == nil {
+			w.result = UploadResult{
+				Key:       o.Key,
+				ETag:      strings.Trim(aws.StringValue(out.ETag), `"`),
+				Location:  out.Location,
+				VersionID: aws.StringValue(out.VersionID),
+			}
+		}
+	}()
+
+	return &w
+}
+
+// S3Writer is the io.WriteCloser returned by S3Object.NewWriter
+type S3Writer struct {
+	pw      *io.PipeWriter
+	done    chan struct{}
+	written int64
+	result  UploadResult
+	err     error
+
+	svc    *s3.S3
+	bucket string
+	key    string
+}
+
+// Write writes to the upload
+func (w *S3Writer) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Close finishes the upload, waiting for it to complete
+func (w *S3Writer) Close() error {
+	w.pw.Close()
+	<-w.done
+	return w.err
+}
+
+// Abort abandons the upload, cleaning up any parts uploaded so far. It returns an error if
+// the parts couldn't be cleaned up, or the upload had already failed for another reason.
+func (w *S3Writer) Abort() error {
+	w.pw.CloseWithError(errUploadAborted)
+	<-w.done
+
+	var mf s3manager.MultiUploadFailure
+	if errors.As(w.err, &mf) {
+		// The uploader tries to abort the multipart upload, but only logs if it can't
+		_, err := w.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(w.bucket),
+			Key:      aws.String(w.key),
+			UploadId: aws.String(mf.UploadID()),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+			// Already gone
+		} else if err != nil {
+			return fmt.Errorf("aborting upload %s: %w", mf.UploadID(), err)
+		}
+	}
+
+	if w.err == nil || uploadAborted(w.err) {
+		return nil
+	}
+	return w.err
+}
+
+// uploadAborted returns true if the upload error was caused by Abort
+func uploadAborted(err error) bool {
+	for err != nil {
+		if errors.Is(err, errUploadAborted) {
+			return true
+		}
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			return false
+		}
+		err = aerr.OrigErr()
+	}
+	return false
+}
+
+// Result returns the outcome of the upload, once Close has returned nil
+func (w *S3Writer) Result() UploadResult {
+	w.result.Size = w.written
+	return w.result
+}
+
+// DownloadFile downloads the object to filename, atomically: it's written to a temporary file
+// in the same directory, which is renamed into place once complete, with the permissions perm
+func (o *S3Object) DownloadFile(filename string, perm os.FileMode) (size int64, err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), downloadTempPrefix+"*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	downloader := s3manager.NewDownloaderWithClient(o.svc)
+	size, err = downloader.Download(tmp, &s3.GetObjectInput{
+		Bucket:    aws.String(o.Bucket),
+		Key:       aws.String(o.Key),
+		VersionId: optionalString(o.VersionID),
+	})
+	if err != nil {
+		return
+	}
+
+	if err = tmp.Chmod(perm); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), filename)
+	return
+}
+
+// WriteTo writes the object to w, as it's fetched by a single GET, making S3Object an io.WriterTo.
+// Use it rather than DownloadFile to write in place, e.g. to os.Stdout or a pipe.
+func (o *S3Object) WriteTo(w io.Writer) (n int64, err error) {
+	out, err := o.svc.GetObject(&s3.GetObjectInput{
+		Bucket:    aws.String(o.Bucket),
+		Key:       aws.String(o.Key),
+		VersionId: optionalString(o.VersionID),
+	})
+	if err != nil {
+		return
+	}
+	defer out.Body.Close()
+
+	return io.Copy(w, out.Body)
+}
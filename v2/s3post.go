@@ -0,0 +1,324 @@
+package aws
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cast"
+)
+
+const (
+	postAlgorithm  = "AWS4-HMAC-SHA256"
+	postDateFormat = "20060102T150405Z"
+	postExpiration = "2006-01-02T15:04:05.000Z"
+)
+
+// ErrPolicyViolation is returned when a POST form doesn't satisfy its policy
+var ErrPolicyViolation = errors.New("form violates POST policy")
+
+// PostPolicyOptions controls S3PresignPost. The endpoint and credential options are as for PresignOptions.
+type PostPolicyOptions struct {
+	// Key is the exact object key, which may include ${filename} for S3 to replace
+	// with the uploaded file's name. Ignored if KeyPrefix is set.
+	Key string
+	// KeyPrefix allows any key starting with it. The form's key field is set to KeyPrefix + "${filename}".
+	KeyPrefix string
+	// MinContentLength and MaxContentLength limit the upload size, if MaxContentLength is set
+	MinContentLength int64
+	MaxContentLength int64
+	// ContentType is the exact Content-Type, or ContentTypePrefix a prefix, e.g. "image/",
+	// in which case the uploader must add a Content-Type field to the form
+	ContentType       string
+	ContentTypePrefix string
+	// ACL is the canned ACL for the object, e.g. "private"
+	ACL string
+	// SuccessActionStatus is the status S3 responds with on success, e.g. "201". S3's default is 204.
+	SuccessActionStatus string
+	// Fields are additional form fields, e.g. "x-amz-meta-user", that must be sent as given
+	Fields map[string]string
+	// Expires is how long the form is valid for. Default DefaultPresignExpiry.
+	Expires time.Duration
+
+	Region      string
+	Endpoint    string
+	PathStyle   bool
+	DualStack   bool
+	FIPS        bool
+	Credentials *credentials.Credentials
+}
+
+// PresignedPost is a presigned S3 POST form. Fields must all be sent, as form fields before the "file" field, to URL.
+type PresignedPost struct {
+	URL     string
+	Fields  map[string]string
+	Expires time.Time
+}
+
+// postPolicy is the JSON policy document
+type postPolicy struct {
+	Expiration string        `json:"expiration"`
+	Conditions []interface{} `json:"conditions"`
+}
+
+// S3PresignPost returns a presigned POST form, for browser uploads to the bucket, per the options
+func (s *Session) S3PresignPost(bucket string, opts PostPolicyOptions) (*PresignedPost, error) {
+	if opts.Expires <= 0 {
+		opts.Expires = DefaultPresignExpiry
+	}
+
+	svc := s.presignClient(PresignOptions{
+		Region:      opts.Region,
+		Endpoint:    opts.Endpoint,
+		PathStyle:   opts.PathStyle,
+		DualStack:   opts.DualStack,
+		FIPS:        opts.FIPS,
+		Credentials: opts.Credentials,
+	})
+
+	// Let the SDK work out the bucket URL
+	req, _ := svc.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	if err := req.Build(); err != nil {
+		return nil, err
+	}
+	u := *req.HTTPRequest.URL
+	u.RawQuery = ""
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	u.RawPath = ""
+
+	creds, err := svc.Config.Credentials.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		now        = time.Now().UTC()
+		region     = svc.SigningRegion
+		credential = fmt.Sprintf("%s/%s/%s/s3/aws4_request", creds.AccessKeyID, now.Format("20060102"), region)
+		fields     = make(map[string]string)
+		conditions = []interface{}{map[string]string{"bucket": bucket}}
+	)
+
+	// Exact-match fields
+	exact := func(name, value string) {
+		fields[name] = value
+		conditions = append(conditions, map[string]string{name: value})
+	}
+
+	if opts.KeyPrefix != "" {
+		fields["key"] = opts.KeyPrefix + "${filename}"
+		conditions = append(conditions, []string{"starts-with", "$key", opts.KeyPrefix})
+	} else if opts.Key != "" {
+		exact("key", opts.Key)
+	} else {
+		return nil, errors.New("one of Key or KeyPrefix is required")
+	}
+
+	if opts.MaxContentLength > 0 {
+		conditions = append(conditions, []interface{}{"content-length-range", opts.MinContentLength, opts.MaxContentLength})
+	}
+	if opts.ContentType != "" {
+		exact("Content-Type", opts.ContentType)
+	} else if opts.ContentTypePrefix != "" {
+		conditions = append(conditions, []string{"starts-with", "$Content-Type", opts.ContentTypePrefix})
+	}
+	if opts.ACL != "" {
+		exact("acl", opts.ACL)
+	}
+	if opts.SuccessActionStatus != "" {
+		exact("success_action_status", opts.SuccessActionStatus)
+	}
+	for name, value := range opts.Fields {
+		exact(name, value)
+	}
+
+	exact("x-amz-algorithm", postAlgorithm)
+	exact("x-amz-credential", credential)
+	exact("x-amz-date", now.Format(postDateFormat))
+	if creds.SessionToken != "" {
+		exact("x-amz-security-token", creds.SessionToken)
+	}
+
+	expires := now.Add(opts.Expires)
+	policy, err := json.Marshal(postPolicy{
+		Expiration: expires.Format(postExpiration),
+		Conditions: conditions,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fields["policy"] = base64.StdEncoding.EncodeToString(policy)
+	fields["x-amz-signature"] = postSignature(creds.SecretAccessKey, now.Format("20060102"), region, fields["policy"])
+
+	return &PresignedPost{
+		URL:     u.String(),
+		Fields:  fields,
+		Expires: expires,
+	}, nil
+}
+
+// ValidatePostForm checks the fields of a POST form, and the size of its file, against the form's policy,
+// as S3 would, returning an error wrapping ErrPolicyViolation if they don't satisfy it. If creds isn't
+// nil, the signature is verified too, and x-amz-date must be on the date in x-amz-credential's scope.
+// form keys are the field names, which are matched case-insensitively.
+func ValidatePostForm(form url.Values, contentLength int64, creds *credentials.Credentials) error {
+	get := func(name string) (string, bool) {
+		for k, v := range form {
+			if strings.EqualFold(k, name) && len(v) > 0 {
+				return v[0], true
+			}
+		}
+		return "", false
+	}
+
+	encoded, ok := get("policy")
+	if !ok {
+		return fmt.Errorf("%w: no policy", ErrPolicyViolation)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("%w: bad policy encoding: %v", ErrPolicyViolation, err)
+	}
+	var policy postPolicy
+	if err = json.Unmarshal(raw, &policy); err != nil {
+		return fmt.Errorf("%w: bad policy: %v", ErrPolicyViolation, err)
+	}
+
+	expiration, err := time.Parse(time.RFC3339, policy.Expiration)
+	if err != nil {
+		return fmt.Errorf("%w: bad expiration %q", ErrPolicyViolation, policy.Expiration)
+	}
+	if time.Now().After(expiration) {
+		return fmt.Errorf("%w: expired at %s", ErrPolicyViolation, policy.Expiration)
+	}
+
+	covered := make(map[string]bool)
+	for _, c := range policy.Conditions {
+		name, err := checkPostCondition(c, get, contentLength)
+		if err != nil {
+			return err
+		}
+		covered[strings.ToLower(name)] = true
+	}
+
+	// Every field, bar a few, must be covered by a condition
+	for k := range form {
+		lk := strings.ToLower(k)
+		switch {
+		case lk == "policy", lk == "x-amz-signature", lk == "file", strings.HasPrefix(lk, "x-ignore-"):
+		case !covered[lk]:
+			return fmt.Errorf("%w: field %q not in policy", ErrPolicyViolation, k)
+		}
+	}
+
+	if creds == nil {
+		return nil
+	}
+
+	v, err := creds.Get()
+	if err != nil {
+		return err
+	}
+	credential, _ := get("x-amz-credential")
+	date, _ := get("x-amz-date")
+	signature, _ := get("x-amz-signature")
+
+	// AKID/date/region/s3/aws4_request
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[0] != v.AccessKeyID || parts[3] != "s3" || parts[4] != "aws4_request" {
+		return fmt.Errorf("%w: bad credential %q", ErrPolicyViolation, credential)
+	}
+	when, err := time.Parse(postDateFormat, date)
+	if err != nil {
+		return fmt.Errorf("%w: bad date %q", ErrPolicyViolation, date)
+	}
+	// The key is derived from the credential scope's date, which must be the request's
+	if when.Format("20060102") != parts[1] {
+		return fmt.Errorf("%w: date %q is not the credential's %q", ErrPolicyViolation, date, parts[1])
+	}
+	if !hmac.Equal([]byte(signature), []byte(postSignature(v.SecretAccessKey, parts[1], parts[2], encoded))) {
+		return fmt.Errorf("%w: signature mismatch", ErrPolicyViolation)
+	}
+	return nil
+}
+
+// checkPostCondition checks a single policy condition against the form, returning the field it covers
+func checkPostCondition(c interface{}, get func(string) (string, bool), contentLength int64) (string, error) {
+	switch cond := c.(type) {
+	case map[string]interface{}:
+		// {"field": "value"}
+		for name, want := range cond {
+			if name == "bucket" {
+				// Determined by the URL, not the form
+				return name, nil
+			}
+			if got, _ := get(name); got != cast.ToString(want) {
+				return name, fmt.Errorf("%w: %s is %q, not %q", ErrPolicyViolation, name, got, want)
+			}
+			return name, nil
+		}
+
+	case []interface{}:
+		if len(cond) != 3 {
+			break
+		}
+		op := strings.ToLower(cast.ToString(cond[0]))
+
+		if op == "content-length-range" {
+			lo, lerr := cast.ToInt64E(cond[1])
+			hi, herr := cast.ToInt64E(cond[2])
+			if lerr != nil || herr != nil {
+				break
+			}
+			if contentLength < lo || contentLength > hi {
+				return "", fmt.Errorf("%w: content length %d not in %d-%d", ErrPolicyViolation, contentLength, lo, hi)
+			}
+			return "", nil
+		}
+
+		name := strings.TrimPrefix(cast.ToString(cond[1]), "$")
+		want := cast.ToString(cond[2])
+		got, _ := get(name)
+		switch op {
+		case "eq":
+			if got != want {
+				return name, fmt.Errorf("%w: %s is %q, not %q", ErrPolicyViolation, name, got, want)
+			}
+			return name, nil
+		case "starts-with":
+			if !strings.HasPrefix(got, want) {
+				return name, fmt.Errorf("%w: %s %q doesn't start with %q", ErrPolicyViolation, name, got, want)
+			}
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: bad condition %v", ErrPolicyViolation, c)
+}
+
+// postSignature returns the SigV4 signature of the base64 policy, for the credential scope
+// date (YYYYMMDD) and region
+func postSignature(secret, date, region, policy string) string {
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+
+	key := mac([]byte("AWS4"+secret), date)
+	key = mac(key, region)
+	key = mac(key, "s3")
+	key = mac(key, "aws4_request")
+	return hex.EncodeToString(mac(key, policy))
+}
@@ -0,0 +1,181 @@
+package aws
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// newTestSession returns a Session with static credentials, that never needs AWS
+func newTestSession(t *testing.T, opts ...Option) *Session {
+	t.Helper()
+	s, err := NewSession(append([]Option{WithRegion("us-east-1"), WithCredentials("AKIDTEST", "SECRETTEST")}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// postForm returns the presigned POST's fields as a form
+func postForm(p *PresignedPost) url.Values {
+	form := url.Values{}
+	for k, v := range p.Fields {
+		form.Set(k, v)
+	}
+	return form
+}
+
+func TestValidatePostForm(t *testing.T) {
+	s := newTestSession(t)
+	post, err := s.S3PresignPost("bucket", PostPolicyOptions{
+		KeyPrefix:         "uploads/",
+		MinContentLength:  1,
+		MaxContentLength:  1024,
+		ContentTypePrefix: "image/",
+		Fields:            map[string]string{"x-amz-meta-user": "alice"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		good      = credentials.NewStaticCredentials("AKIDTEST", "SECRETTEST", "")
+		badKey    = credentials.NewStaticCredentials("AKIDOTHER", "SECRETTEST", "")
+		badSecret = credentials.NewStaticCredentials("AKIDTEST", "SECRETOTHER", "")
+	)
+
+	tests := []struct {
+		name   string
+		change func(form url.Values)
+		length int64
+		creds  *credentials.Credentials
+		err    error
+	}{
+		{"valid", func(url.Values) {}, 100, good, nil},
+		{"valid without signature check", func(url.Values) {}, 100, nil, nil},
+		{"field names are case-insensitive", func(f url.Values) {
+			f.Set("X-Amz-Meta-User", f.Get("x-amz-meta-user"))
+			f.Del("x-amz-meta-user")
+		}, 100, good, nil},
+		{"ignored field", func(f url.Values) { f.Set("x-ignore-me", "1") }, 100, good, nil},
+		{"key outside prefix", func(f url.Values) { f.Set("key", "elsewhere/a.png") }, 100, good, ErrPolicyViolation},
+		{"changed field", func(f url.Values) { f.Set("x-amz-meta-user", "mallory") }, 100, good, ErrPolicyViolation},
+		{"missing field", func(f url.Values) { f.Del("x-amz-meta-user") }, 100, good, ErrPolicyViolation},
+		{"field not in policy", func(f url.Values) { f.Set("x-amz-meta-extra", "1") }, 100, good, ErrPolicyViolation},
+		{"wrong content type", func(f url.Values) { f.Set("Content-Type", "text/html") }, 100, good, ErrPolicyViolation},
+		{"too small", func(url.Values) {}, 0, good, ErrPolicyViolation},
+		{"too large", func(url.Values) {}, 1025, good, ErrPolicyViolation},
+		{"no policy", func(f url.Values) { f.Del("policy") }, 100, good, ErrPolicyViolation},
+		{"garbled policy", func(f url.Values) { f.Set("policy", "!!!") }, 100, good, ErrPolicyViolation},
+		{"tampered policy", func(f url.Values) {
+			p, _ := base64.StdEncoding.DecodeString(f.Get("policy"))
+			f.Set("policy", base64.StdEncoding.EncodeToString(append(p[:len(p)-1], ' ', '}')))
+		}, 100, good, ErrPolicyViolation},
+		{"tampered policy without signature check", func(f url.Values) {
+			p, _ := base64.StdEncoding.DecodeString(f.Get("policy"))
+			f.Set("policy", base64.StdEncoding.EncodeToString(append(p[:len(p)-1], ' ', '}')))
+		}, 100, nil, nil},
+		{"wrong access key", func(url.Values) {}, 100, badKey, ErrPolicyViolation},
+		{"wrong secret", func(url.Values) {}, 100, badSecret, ErrPolicyViolation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := postForm(post)
+			form.Set("key", "uploads/a.png")
+			form.Set("Content-Type", "image/png")
+			tt.change(form)
+
+			err := ValidatePostForm(form, tt.length, tt.creds)
+			if tt.err == nil && err != nil {
+				t.Errorf("got error %v", err)
+			} else if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidatePostFormExpired(t *testing.T) {
+	form := url.Values{}
+	form.Set("key", "a")
+	form.Set("policy", base64.StdEncoding.EncodeToString([]byte(`{"expiration":"2000-01-01T00:00:00.000Z","conditions":[{"key":"a"}]}`)))
+
+	if err := ValidatePostForm(form, 0, nil); !errors.Is(err, ErrPolicyViolation) {
+		t.Errorf("got error %v, want %v", err, ErrPolicyViolation)
+	}
+}
+
+func TestS3PresignPostExactKey(t *testing.T) {
+	s := newTestSession(t)
+	post, err := s.S3PresignPost("bucket", PostPolicyOptions{
+		Key:                 "exact",
+		ContentType:         "text/plain",
+		ACL:                 "private",
+		SuccessActionStatus: "201",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for field, want := range map[string]string{
+		"key":                   "exact",
+		"Content-Type":          "text/plain",
+		"acl":                   "private",
+		"success_action_status": "201",
+	} {
+		if got := post.Fields[field]; got != want {
+			t.Errorf("%s is %q, want %q", field, got, want)
+		}
+	}
+	if err = ValidatePostForm(postForm(post), 10, credentials.NewStaticCredentials("AKIDTEST", "SECRETTEST", "")); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = s.S3PresignPost("bucket", PostPolicyOptions{}); err == nil {
+		t.Error("presigned a POST without a key")
+	}
+}
+
+func TestValidatePostFormDates(t *testing.T) {
+	creds := credentials.NewStaticCredentials("AKIDTEST", "SECRETTEST", "")
+
+	// form returns a form signed with the key for signDate, scoped to scopeDate, dated date
+	form := func(scopeDate, date, signDate string) url.Values {
+		credential := "AKIDTEST/" + scopeDate + "/us-east-1/s3/aws4_request"
+		policy := base64.StdEncoding.EncodeToString([]byte(`{"expiration":"2100-01-01T00:00:00.000Z","conditions":[` +
+			`{"key":"a"},{"x-amz-algorithm":"AWS4-HMAC-SHA256"},{"x-amz-credential":"` + credential + `"},{"x-amz-date":"` + date + `"}]}`))
+
+		f := url.Values{}
+		f.Set("key", "a")
+		f.Set("x-amz-algorithm", "AWS4-HMAC-SHA256")
+		f.Set("x-amz-credential", credential)
+		f.Set("x-amz-date", date)
+		f.Set("policy", policy)
+		f.Set("x-amz-signature", postSignature("SECRETTEST", signDate, "us-east-1", policy))
+		return f
+	}
+
+	tests := []struct {
+		name string
+		form url.Values
+		err  error
+	}{
+		{"matching", form("20240102", "20240102T120000Z", "20240102"), nil},
+		{"date after scope", form("20240102", "20240103T000000Z", "20240102"), ErrPolicyViolation},
+		{"signed with the request date", form("20240102", "20240103T000000Z", "20240103"), ErrPolicyViolation},
+		{"signed with another date", form("20240102", "20240102T120000Z", "20240103"), ErrPolicyViolation},
+		{"bad date", form("20240102", "yesterday", "20240102"), ErrPolicyViolation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePostForm(tt.form, 0, creds)
+			if tt.err == nil && err != nil {
+				t.Errorf("got error %v", err)
+			} else if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
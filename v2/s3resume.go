@@ -0,0 +1,711 @@
+package aws
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// DefaultResumePartSizeMB is the part size for resumable transfers, if ResumeOptions.PartSizeMB isn't set
+	DefaultResumePartSizeMB = 8
+
+	uploadStateSuffix   = ".s3upload"
+	downloadStateSuffix = ".s3download"
+	partialSuffix       = ".part"
+)
+
+var (
+	// ErrChecksumMismatch is returned when a file doesn't match its object's ETag or checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrUnverifiable is returned when an object has neither an MD5-based ETag, nor a
+	// CRC32C or SHA256 checksum, or its part size can't be determined
+	ErrUnverifiable = errors.New("object can't be verified")
+
+	// md5ETag matches ETags that are MD5s, or multipart MD5s of MD5s
+	md5ETag = regexp.MustCompile(`^[0-9a-f]{32}(-[0-9]+)?$`)
+)
+
+// ResumeOptions controls ResumableUpload and ResumableDownload
+type ResumeOptions struct {
+	// PartSizeMB is the size of the parts, or ranges, transferred. Default DefaultResumePartSizeMB.
+	// It can't be changed when resuming a transfer.
+	PartSizeMB int64
+	// Workers is the number of parts transferred at once. Default 4.
+	Workers int
+	// Checksum is an additional checksum, "CRC32C" or "SHA256", for S3 to store with uploads
+	Checksum string
+	// NoVerify skips verifying the transfer once complete: uploads re-read the file to check it
+	// against the parts S3 acknowledged, and downloads use VerifyObject
+	NoVerify bool
+}
+
+// uploadState is the progress of a ResumableUpload, saved beside the file
+type uploadState struct {
+	Bucket   string
+	Key      string
+	UploadID string
+	Size     int64
+	ModTime  time.Time
+	PartSize int64
+	Checksum string
+	Parts    map[int64]uploadedPart
+}
+
+// uploadedPart is a part of a ResumableUpload that's been uploaded. MD5 is the base64
+// Content-MD5 S3 checked the part against.
+type uploadedPart struct {
+	ETag     string
+	MD5      string
+	Checksum string
+}
+
+// downloadState is the progress of a ResumableDownload, saved beside the file
+type downloadState struct {
+	Bucket    string
+	Key       string
+	VersionID string
+	ETag      string
+	Size      int64
+	PartSize  int64
+	Done      map[int64]bool
+}
+
+// defaults fills in unset options
+func (o *ResumeOptions) defaults() {
+	if o.PartSizeMB < 1 {
+		o.PartSizeMB = DefaultResumePartSizeMB
+	}
+	if o.Workers < 1 {
+		o.Workers = 4
+	}
+}
+
+// ResumableUpload uploads the file to the key in the bucket with a multipart upload, saving
+// its progress in a sidecar file (filename + ".s3upload"). If the upload fails, calling
+// ResumableUpload again with the same arguments resumes it, uploading only the missing parts,
+// as long as the file hasn't changed. Otherwise the old multipart upload is aborted, and a new
+// one started. Every part is sent with its MD5, for S3 to check. Unless opts.NoVerify, the file
+// is re-read once every part is uploaded, and checked against the parts S3 acknowledged, before
+// the upload is completed. If it doesn't match, e.g. as it changed while being uploaded, nothing
+// is published, and calling ResumableUpload again uploads the parts that didn't match.
+func (s *Session) ResumableUpload(filename, bucket, key string, opts ResumeOptions) (*UploadResult, error) {
+	opts.defaults()
+	svc := s3.New(s.AWS)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	partSize := opts.PartSizeMB * 1024 * 1024
+	parts := max((fi.Size()+partSize-1)/partSize, 1)
+	if parts > 10000 {
+		return nil, fmt.Errorf("%d parts is more than S3 allows: increase PartSizeMB", parts)
+	}
+
+	var (
+		statefile = filename + uploadStateSuffix
+		state     uploadState
+		resume    bool
+	)
+	if loadState(statefile, &state) == nil && state.UploadID != "" {
+		if state.Bucket == bucket && state.Key == key && state.Size == fi.Size() && state.ModTime.Equal(fi.ModTime()) &&
+			state.PartSize == partSize && state.Checksum == opts.Checksum {
+			err = state.confirm(svc)
+			if err == nil {
+				resume = true
+			} else if !isAWSCode(err, s3.ErrCodeNoSuchUpload) {
+				// Maybe transient, so keep the state to resume from
+				return nil, err
+			}
+		} else if err = state.abort(svc); err != nil {
+			return nil, fmt.Errorf("aborting stale upload %s: %w", state.UploadID, err)
+		}
+	}
+
+	if !resume {
+		// Start afresh
+		resp, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:            aws.String(bucket),
+			Key:               aws.String(key),
+			ChecksumAlgorithm: optionalString(opts.Checksum),
+		})
+		if err != nil {
+			return nil, err
+		}
+		state = uploadState{
+			Bucket:   bucket,
+			Key:      key,
+			UploadID: aws.StringValue(resp.UploadId),
+			Size:     fi.Size(),
+			ModTime:  fi.ModTime(),
+			PartSize: partSize,
+			Checksum: opts.Checksum,
+			Parts:    make(map[int64]uploadedPart),
+		}
+		if err = saveState(statefile, &state); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	runParts(parts, opts.Workers, func(n int64) bool {
+		mu.Lock()
+		_, done := state.Parts[n]
+		mu.Unlock()
+		return !done
+	}, func(n int64) error {
+		buf := make([]byte, min(partSize, fi.Size()-(n-1)*partSize))
+		if _, err := file.ReadAt(buf, (n-1)*partSize); err != nil && err != io.EOF {
+			return err
+		}
+
+		sum := md5.Sum(buf)
+		input := s3.UploadPartInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			UploadId:   aws.String(state.UploadID),
+			PartNumber: aws.Int64(n),
+			Body:       bytes.NewReader(buf),
+			ContentMD5: aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+		}
+		var checksum string
+		if opts.Checksum != "" {
+			h, err := newChecksum(opts.Checksum)
+			if err != nil {
+				return err
+			}
+			h.Write(buf)
+			checksum = base64.StdEncoding.EncodeToString(h.Sum(nil))
+			setPartChecksum(&input, opts.Checksum, checksum)
+		}
+
+		resp, err := svc.UploadPart(&input)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		state.Parts[n] = uploadedPart{ETag: aws.StringValue(resp.ETag), MD5: aws.StringValue(input.ContentMD5), Checksum: checksum}
+		return saveState(statefile, &state)
+	}, func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	completed := make([]*s3.CompletedPart, 0, len(state.Parts))
+	for n, p := range state.Parts {
+		cp := s3.CompletedPart{PartNumber: aws.Int64(n), ETag: aws.String(p.ETag)}
+		switch opts.Checksum {
+		case s3.ChecksumAlgorithmCrc32c:
+			cp.ChecksumCRC32C = aws.String(p.Checksum)
+		case s3.ChecksumAlgorithmSha256:
+			cp.ChecksumSHA256 = aws.String(p.Checksum)
+		}
+		completed = append(completed, &cp)
+	}
+	sort.Slice(completed, func(i, j int) bool { return *completed[i].PartNumber < *completed[j].PartNumber })
+
+	if !opts.NoVerify {
+		if err = state.verify(file, parts); err != nil {
+			// The bad parts were dropped, so save the state to upload them again
+			return nil, errors.Join(err, saveState(statefile, &state))
+		}
+	}
+
+	resp, err := svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(statefile)
+
+	return &UploadResult{
+		Key:       key,
+		ETag:      strings.Trim(aws.StringValue(resp.ETag), `"`),
+		Location:  aws.StringValue(resp.Location),
+		VersionID: aws.StringValue(resp.VersionId),
+		Size:      fi.Size(),
+	}, nil
+}
+
+// confirm drops any saved parts S3 doesn't have, returning an error if the upload can't be listed
+func (u *uploadState) confirm(svc *s3.S3) error {
+	listed := make(map[int64]string)
+	err := svc.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(u.Bucket),
+		Key:      aws.String(u.Key),
+		UploadId: aws.String(u.UploadID),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, p := range page.Parts {
+			listed[aws.Int64Value(p.PartNumber)] = aws.StringValue(p.ETag)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for n, p := range u.Parts {
+		if listed[n] != p.ETag {
+			delete(u.Parts, n)
+		}
+	}
+	return nil
+}
+
+// abort aborts the multipart upload, which is fine if it's already gone
+func (u *uploadState) abort(svc *s3.S3) error {
+	_, err := svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(u.Bucket),
+		Key:      aws.String(u.Key),
+		UploadId: aws.String(u.UploadID),
+	})
+	if isAWSCode(err, s3.ErrCodeNoSuchUpload) {
+		return nil
+	}
+	return err
+}
+
+// verify re-reads the file's parts, returning an error wrapping ErrChecksumMismatch if any
+// doesn't match the MD5, and checksum if any, that S3 acknowledged for it. Those that don't
+// are dropped, to be uploaded again.
+func (u *uploadState) verify(file *os.File, parts int64) error {
+	var errs []error
+	for n := int64(1); n <= parts; n++ {
+		p, ok := u.Parts[n]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%w: part %d wasn't uploaded", ErrChecksumMismatch, n))
+			continue
+		}
+
+		var (
+			sum      = md5.New()
+			checksum hash.Hash
+			w        io.Writer = sum
+		)
+		if u.Checksum != "" {
+			checksum, _ = newChecksum(u.Checksum)
+			w = io.MultiWriter(sum, checksum)
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(file, (n-1)*u.PartSize, u.PartSize)); err != nil {
+			return err
+		}
+
+		if got := base64.StdEncoding.EncodeToString(sum.Sum(nil)); got != p.MD5 {
+			errs = append(errs, fmt.Errorf("%w: part %d MD5 is %s, not %s", ErrChecksumMismatch, n, got, p.MD5))
+			delete(u.Parts, n)
+			continue
+		}
+		if checksum != nil {
+			if got := base64.StdEncoding.EncodeToString(checksum.Sum(nil)); got != p.Checksum {
+				errs = append(errs, fmt.Errorf("%w: part %d %s is %s, not %s", ErrChecksumMismatch, n, u.Checksum, got, p.Checksum))
+				delete(u.Parts, n)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isAWSCode returns true if err is an awserr.Error with the code
+func isAWSCode(err error, code string) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == code
+}
+
+// ResumableDownload downloads the key in the bucket to filename, in ranges, saving its progress in
+// a sidecar file (filename + ".s3download") and the data in filename + ".part". If the download fails,
+// calling ResumableDownload again with the same arguments resumes it, downloading only the missing
+// ranges, as long as the object hasn't changed and the partial file is still there. The version current
+// when the download started is the one downloaded. Once complete, and unless opts.NoVerify verified with VerifyObject, the file is
+// renamed into place, with permissions DownloadFileMode. Objects VerifyObject can't verify, e.g. those
+// encrypted with SSE-KMS without a checksum, aren't an error.
+func (s *Session) ResumableDownload(bucket, key, filename string, opts ResumeOptions) (size int64, err error) {
+	opts.defaults()
+	svc := s3.New(s.AWS)
+
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return
+	}
+	size = aws.Int64Value(head.ContentLength)
+	etag := aws.StringValue(head.ETag)
+	version := aws.StringValue(head.VersionId)
+	partSize := opts.PartSizeMB * 1024 * 1024
+	parts := (size + partSize - 1) / partSize
+
+	statefile, partial := filename+downloadStateSuffix, filename+partialSuffix
+	flags := os.O_RDWR | os.O_CREATE
+
+	var state downloadState
+	resume := loadState(statefile, &state) == nil && state.Bucket == bucket && state.Key == key && state.VersionID == version &&
+		state.ETag == etag && state.Size == size && state.PartSize == partSize
+	if resume {
+		// The ranges done are only there if the partial file is, and is whole
+		if fi, err := os.Stat(partial); err != nil || fi.Size() < size {
+			resume = false
+		}
+	}
+	if !resume {
+		// Start afresh
+		state = downloadState{
+			Bucket:    bucket,
+			Key:       key,
+			VersionID: version,
+			ETag:      etag,
+			Size:      size,
+			PartSize:  partSize,
+			Done:      make(map[int64]bool),
+		}
+		flags |= os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(partial, flags, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	if err = file.Truncate(size); err != nil {
+		return
+	}
+
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	runParts(parts, opts.Workers, func(n int64) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return !state.Done[n]
+	}, func(n int64) error {
+		start := (n - 1) * partSize
+		end := min(start+partSize, size) - 1
+
+		resp, err := svc.GetObject(&s3.GetObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(key),
+			VersionId: optionalString(version),
+			Range:     aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			IfMatch:   aws.String(etag),
+		})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		buf := make([]byte, end-start+1)
+		if _, err = io.ReadFull(resp.Body, buf); err != nil {
+			return err
+		}
+		if _, err = file.WriteAt(buf, start); err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		// Don't record the range as done until it's safely on disk
+		if err = file.Sync(); err != nil {
+			return err
+		}
+		state.Done[n] = true
+		return saveState(statefile, &state)
+	}, func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+	if len(errs) > 0 {
+		return 0, errors.Join(errs...)
+	}
+
+	if err = file.Chmod(DownloadFileMode); err != nil {
+		return
+	}
+	if err = file.Close(); err != nil {
+		return
+	}
+
+	if !opts.NoVerify {
+		if err = s.verifyObject(bucket, key, version, partial); errors.Is(err, ErrUnverifiable) {
+			DebugOut.Printf("ResumableDownload s3://%s/%s: %s\n", bucket, key, err)
+		} else if err != nil {
+			// The data's bad, so start again next time
+			os.Remove(statefile)
+			os.Remove(partial)
+			return 0, err
+		}
+	}
+
+	if err = os.Rename(partial, filename); err != nil {
+		return
+	}
+	os.Remove(statefile)
+	return
+}
+
+// runParts calls transfer for parts 1 to n for which want returns true, over the workers,
+// passing errors to fail. Once something has failed, no more parts are started.
+func runParts(n int64, workers int, want func(int64) bool, transfer func(int64) error, fail func(error)) {
+	var (
+		jobs   = make(chan int64)
+		wg     sync.WaitGroup
+		failed = make(chan struct{})
+		once   sync.Once
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				if err := transfer(p); err != nil {
+					fail(fmt.Errorf("part %d: %w", p, err))
+					once.Do(func() { close(failed) })
+				}
+			}
+		}()
+	}
+
+feed:
+	for p := int64(1); p <= n; p++ {
+		if !want(p) {
+			continue
+		}
+		select {
+		case jobs <- p:
+		case <-failed:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// VerifyObject checks that the local file matches the key in the bucket, by its CRC32C or SHA256
+// checksum if S3 has one, or else its ETag, returning an error wrapping ErrChecksumMismatch if it
+// doesn't, or ErrUnverifiable if it can't tell. For multipart objects, each of ETagPartSizesMB
+// that gives the same number of parts is tried, so add to it if uploads use other part sizes.
+func (s *Session) VerifyObject(bucket, key, filename string) error {
+	return s.verifyObject(bucket, key, "", filename)
+}
+
+// verifyObject is VerifyObject, for a version of the object if version isn't empty
+func (s *Session) verifyObject(bucket, key, version, filename string) error {
+	head, err := s3.New(s.AWS).HeadObject(&s3.HeadObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		VersionId:    optionalString(version),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	})
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	size := aws.Int64Value(head.ContentLength)
+	if fi.Size() != size {
+		return fmt.Errorf("%w: %s is %d bytes, s3://%s/%s is %d", ErrChecksumMismatch, filename, fi.Size(), bucket, key, size)
+	}
+
+	var (
+		algorithm string
+		want      string
+		compute   func(partSize int64) (string, error)
+	)
+	switch {
+	case head.ChecksumCRC32C != nil:
+		algorithm, want = s3.ChecksumAlgorithmCrc32c, aws.StringValue(head.ChecksumCRC32C)
+	case head.ChecksumSHA256 != nil:
+		algorithm, want = s3.ChecksumAlgorithmSha256, aws.StringValue(head.ChecksumSHA256)
+	}
+
+	if algorithm != "" {
+		compute = func(partSize int64) (string, error) {
+			return fileChecksum(filename, algorithm, partSize)
+		}
+	} else {
+		want = strings.Trim(aws.StringValue(head.ETag), `"`)
+		if !md5ETag.MatchString(want) {
+			// e.g. SSE-KMS or SSE-C
+			return fmt.Errorf("%w: ETag %s isn't an MD5", ErrUnverifiable, want)
+		}
+		compute = func(partSize int64) (string, error) {
+			if partSize == 0 {
+				return fileMD5(filename)
+			}
+			return fileETag(filename, partSize, true)
+		}
+	}
+
+	// Multipart values end "-parts"
+	if i := strings.LastIndex(want, "-"); i > 0 {
+		parts, err := strconv.ParseInt(want[i+1:], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: bad part count in %s", ErrUnverifiable, want)
+		}
+		candidates := etagPartSizes(size, parts, ETagPartSizesMB)
+		if len(candidates) == 0 {
+			return fmt.Errorf("%w: none of ETagPartSizesMB gives %d parts for %d bytes", ErrUnverifiable, parts, size)
+		}
+		for _, ps := range candidates {
+			got, err := compute(ps)
+			if err != nil {
+				return err
+			}
+			if got == want {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s doesn't match %s with any part size", ErrChecksumMismatch, filename, want)
+	}
+
+	got, err := compute(0)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%w: %s is %s, not %s", ErrChecksumMismatch, filename, got, want)
+	}
+	return nil
+}
+
+// fileChecksum returns the base64 checksum of the file, or for a non-zero partSize,
+// the checksum of the part checksums and the number of parts, as S3 computes them
+func fileChecksum(filename, algorithm string, partSize int64) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	whole, err := newChecksum(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if partSize == 0 {
+		if _, err = io.Copy(whole, file); err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(whole.Sum(nil)), nil
+	}
+
+	var parts int
+	for {
+		h, _ := newChecksum(algorithm)
+		n, err := io.CopyN(h, file, partSize)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if n == 0 {
+			break
+		}
+		whole.Write(h.Sum(nil))
+		parts++
+		if err == io.EOF {
+			break
+		}
+	}
+	if parts == 0 {
+		// An empty file is uploaded as one empty part
+		h, _ := newChecksum(algorithm)
+		whole.Write(h.Sum(nil))
+		parts++
+	}
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(whole.Sum(nil)), parts), nil
+}
+
+// newChecksum returns a hash for the S3 checksum algorithm
+func newChecksum(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case s3.ChecksumAlgorithmCrc32c:
+		return crc32BigEndian{crc32.New(crc32.MakeTable(crc32.Castagnoli))}, nil
+	case s3.ChecksumAlgorithmSha256:
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+}
+
+// crc32BigEndian is a hash.Hash32 whose Sum is big-endian, as S3 expects
+type crc32BigEndian struct {
+	hash.Hash32
+}
+
+// Sum appends the big-endian CRC to b
+func (c crc32BigEndian) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint32(b, c.Sum32())
+}
+
+// setPartChecksum sets the checksum for the algorithm on the UploadPartInput
+func setPartChecksum(input *s3.UploadPartInput, algorithm, sum string) {
+	switch algorithm {
+	case s3.ChecksumAlgorithmCrc32c:
+		input.ChecksumCRC32C = aws.String(sum)
+	case s3.ChecksumAlgorithmSha256:
+		input.ChecksumSHA256 = aws.String(sum)
+	}
+}
+
+// loadState reads a transfer state sidecar file
+func loadState(filename string, state interface{}) error {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, state)
+}
+
+// saveState writes a transfer state sidecar file, atomically
+func saveState(filename string, state interface{}) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(filename+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
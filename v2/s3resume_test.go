@@ -0,0 +1,202 @@
+package aws
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestETagPartSizes(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int64
+		parts int64
+		want  []int64
+	}{
+		{"no parts", 10 * testMB, 0, nil},
+		{"empty, one part", 0, 1, []int64{1}},
+		{"empty, two parts", 0, 2, nil},
+		{"one part", 200 * testMB, 1, []int64{200 * testMB}},
+		{"two parts", 12 * testMB, 2, []int64{8 * testMB}},
+		{"three parts", 12 * testMB, 3, []int64{5 * testMB}},
+		{"unlisted", 12 * testMB, 4, nil},
+		{"many parts", 1000 * testMB, 10, []int64{100 * testMB}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := etagPartSizes(tt.size, tt.parts, ETagPartSizesMB)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Configured sizes are tried too, once
+	if got := etagPartSizes(12*testMB, 2, append([]int64{6, 8}, ETagPartSizesMB...)); !slices.Equal(got, []int64{6 * testMB, 8 * testMB}) {
+		t.Errorf("got %v, want 6MB and 8MB", got)
+	}
+}
+
+func TestUploadStateVerify(t *testing.T) {
+	const partSize = 5 * testMB
+	data := patternBytes(12 * testMB)
+	filename := writeTempFile(t, data)
+
+	// The parts as uploaded
+	state := uploadState{PartSize: partSize, Checksum: "SHA256", Parts: make(map[int64]uploadedPart)}
+	for n := int64(1); n <= 3; n++ {
+		part := data[(n-1)*partSize : min(n*partSize, int64(len(data)))]
+		sum := md5.Sum(part)
+		h, _ := newChecksum("SHA256")
+		h.Write(part)
+		state.Parts[n] = uploadedPart{
+			MD5:      base64.StdEncoding.EncodeToString(sum[:]),
+			Checksum: base64.StdEncoding.EncodeToString(h.Sum(nil)),
+		}
+	}
+
+	verify := func(parts int64) error {
+		file, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		return state.verify(file, parts)
+	}
+
+	if err := verify(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(4); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("missing part: got error %v, want %v", err, ErrChecksumMismatch)
+	}
+
+	good := state.Parts[2]
+	bad := good
+	bad.Checksum = state.Parts[1].Checksum
+	state.Parts[2] = bad
+	if err := verify(3); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("bad checksum: got error %v, want %v", err, ErrChecksumMismatch)
+	}
+	state.Parts[2] = good
+
+	// The file changed after its parts were uploaded
+	data[testMB] ^= 1
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(3); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("changed file: got error %v, want %v", err, ErrChecksumMismatch)
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	f, s := newFakeS3(t)
+	data := patternBytes(12 * testMB)
+	filename := writeTempFile(t, data)
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := ResumeOptions{PartSizeMB: 5, Workers: 1}
+
+	f.failPart = 2
+	if _, err = s.ResumableUpload(filename, "bucket", "key", opts); err == nil {
+		t.Fatal("got no error with a part failing")
+	}
+	if _, err = os.Stat(filename + uploadStateSuffix); err != nil {
+		t.Fatalf("no state to resume from: %v", err)
+	}
+
+	// The file changes without its size or time changing, so the uploaded part is stale
+	data[0] ^= 1
+	if err = os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(filename, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	f.failPart = 0
+	if _, err = s.ResumableUpload(filename, "bucket", "key", opts); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("got error %v, want %v", err, ErrChecksumMismatch)
+	}
+	if _, ok := f.object("key"); ok {
+		t.Error("the object was published despite the mismatch")
+	}
+
+	// Resuming uploads the stale part again
+	result, err := s.ResumableUpload(filename, "bucket", "key", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := f.object("key"); !bytes.Equal(got, data) || result.Size != int64(len(data)) {
+		t.Errorf("uploaded %d bytes, not the file", len(got))
+	}
+	if _, err = os.Stat(filename + uploadStateSuffix); !os.IsNotExist(err) {
+		t.Errorf("the state wasn't removed: %v", err)
+	}
+}
+
+func TestResumableDownloadPartial(t *testing.T) {
+	f, s := newFakeS3(t)
+	data := patternBytes(3 * testMB)
+	f.put("key", data)
+	f.mu.Lock()
+	etag := `"` + f.objects["key"].etag + `"`
+	f.mu.Unlock()
+	filename := filepath.Join(t.TempDir(), "file")
+	opts := ResumeOptions{PartSizeMB: 1, NoVerify: true}
+
+	tests := []struct {
+		name    string
+		partial []byte
+		done    []int64
+		gets    int
+	}{
+		{"missing partial", nil, []int64{1, 2, 3}, 3},
+		{"short partial", data[:testMB], []int64{1, 2, 3}, 3},
+		{"resumed", append(append([]byte(nil), data[:testMB]...), make([]byte, 2*testMB)...), []int64{1}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := downloadState{Bucket: "bucket", Key: "key", ETag: etag, Size: int64(len(data)), PartSize: testMB, Done: make(map[int64]bool)}
+			for _, n := range tt.done {
+				state.Done[n] = true
+			}
+			if err := saveState(filename+downloadStateSuffix, &state); err != nil {
+				t.Fatal(err)
+			}
+			if tt.partial != nil {
+				if err := os.WriteFile(filename+partialSuffix, tt.partial, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f.mu.Lock()
+			f.requests = nil
+			f.mu.Unlock()
+
+			if _, err := s.ResumableDownload("bucket", "key", filename, opts); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(filename); !bytes.Equal(got, data) {
+				t.Error("downloaded the wrong data")
+			}
+			f.mu.Lock()
+			gets := 0
+			for _, r := range f.requests {
+				if r == "GET key" {
+					gets++
+				}
+			}
+			f.mu.Unlock()
+			if gets != tt.gets {
+				t.Errorf("got %d ranges, want %d", gets, tt.gets)
+			}
+		})
+	}
+}
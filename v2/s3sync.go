@@ -0,0 +1,379 @@
+package aws
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Sync actions
+const (
+	SyncUpload   = "upload"
+	SyncDownload = "download"
+	SyncDelete   = "delete"
+	SyncSkip     = "skip"
+)
+
+// SyncOptions controls SyncDirToBucket and SyncBucketToDir
+type SyncOptions struct {
+	// Workers is the number of concurrent transfers and ETag comparisons. Default 4.
+	Workers int
+	// Delete removes files from the destination that aren't in the source
+	Delete bool
+	// Include, if set, limits the sync to files matching at least one of the globs. Exclude
+	// skips files matching any of them. Globs are path.Match patterns, matched against both
+	// the slash-separated path relative to the directory or prefix, and the file's base name.
+	// Excluded files are neither transferred nor deleted.
+	Include []string
+	Exclude []string
+	// CompareMtime transfers files that differ in size, or are newer in the source, rather
+	// than comparing ETags. ETags of objects encrypted with SSE-KMS or SSE-C aren't MD5s,
+	// so this is needed to sync them efficiently.
+	CompareMtime bool
+	// PartSizeMB is the part size of multipart uploads, and the first tried when comparing
+	// multipart ETags. Default 5, the s3manager default.
+	PartSizeMB int64
+	// DryRun reports what would be done, without doing it
+	DryRun bool
+}
+
+// SyncResult is the outcome for one file
+type SyncResult struct {
+	// Path is slash-separated and relative to the directory
+	Path string
+	Key  string
+	// Action is one of the Sync* constants
+	Action string
+	// Reason is why: "new", "size", "etag", "mtime", "extraneous" or "unchanged"
+	Reason string
+	Size   int64
+	Err    error
+}
+
+// SyncReport summarizes a sync
+type SyncReport struct {
+	Uploaded   int
+	Downloaded int
+	Deleted    int
+	Skipped    int
+	Failed     int
+	// Bytes is the total size of the files transferred
+	Bytes   int64
+	Results []SyncResult
+}
+
+// syncFile is a local file or S3 object, by relative path
+type syncFile struct {
+	path  string
+	size  int64
+	mtime time.Time
+	etag  string
+}
+
+// SyncDirToBucket uploads new and changed files under dir to the bucket, under prefix. The
+// report is always returned. The error is only set if the directory or bucket couldn't be listed;
+// the errors for individual files are in the report.
+func (s *Session) SyncDirToBucket(dir, bucket, prefix string, opts SyncOptions) (*SyncReport, error) {
+	opts.defaults()
+	prefix = syncPrefix(prefix)
+
+	local, err := opts.localFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := s.remoteFiles(bucket, prefix, &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := s3.New(s.AWS)
+	uploader := s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+		u.PartSize = opts.PartSizeMB * 1024 * 1024
+	})
+	results := opts.plan(local, remote, SyncUpload, func(r *SyncResult) error {
+		file, err := os.Open(filepath.Join(dir, filepath.FromSlash(r.Path)))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = uploader.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(r.Key),
+			Body:   file,
+		})
+		return err
+	}, func(r *SyncResult) error {
+		_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(r.Key),
+		})
+		return err
+	}, prefix, dir)
+
+	return newSyncReport(results), nil
+}
+
+// SyncBucketToDir downloads new and changed objects under prefix in the bucket to dir,
+// creating it if needed. Downloads are atomic, as with S3Object.DownloadFile, and have
+// their modification times set to the objects'. The report is always returned. The
+// error is only set if the bucket or directory couldn't be listed; the errors for
+// individual files are in the report.
+func (s *Session) SyncBucketToDir(bucket, prefix, dir string, opts SyncOptions) (*SyncReport, error) {
+	opts.defaults()
+	prefix = syncPrefix(prefix)
+
+	remote, err := s.remoteFiles(bucket, prefix, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.DryRun {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	local, err := opts.localFiles(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	results := opts.plan(remote, local, SyncDownload, func(r *SyncResult) error {
+		if !filepath.IsLocal(filepath.FromSlash(r.Path)) {
+			return fmt.Errorf("refusing to write outside of %s", dir)
+		}
+		filename := filepath.Join(dir, filepath.FromSlash(r.Path))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return err
+		}
+
+		if _, err := s.NewS3Object(bucket, r.Key).DownloadFile(filename, 0644); err != nil {
+			return err
+		}
+		mtime := remote[r.Path].mtime
+		return os.Chtimes(filename, mtime, mtime)
+	}, func(r *SyncResult) error {
+		return os.Remove(filepath.Join(dir, filepath.FromSlash(r.Path)))
+	}, prefix, dir)
+
+	return newSyncReport(results), nil
+}
+
+// defaults fills in unset options
+func (o *SyncOptions) defaults() {
+	if o.Workers < 1 {
+		o.Workers = 4
+	}
+	if o.PartSizeMB < 1 {
+		o.PartSizeMB = s3manager.DefaultUploadPartSize / (1024 * 1024)
+	}
+}
+
+// selected returns true if the relative path passes the Include and Exclude globs
+func (o *SyncOptions) selected(rel string) bool {
+	match := func(globs []string) bool {
+		for _, g := range globs {
+			if ok, _ := path.Match(g, rel); ok {
+				return true
+			}
+			if ok, _ := path.Match(g, path.Base(rel)); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(o.Include) > 0 && !match(o.Include) {
+		return false
+	}
+	return !match(o.Exclude)
+}
+
+// localFiles returns the selected regular files under dir
+func (o *SyncOptions) localFiles(dir string) (map[string]*syncFile, error) {
+	files := make(map[string]*syncFile)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), downloadTempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !o.selected(rel) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[rel] = &syncFile{path: rel, size: fi.Size(), mtime: fi.ModTime()}
+		return nil
+	})
+	return files, err
+}
+
+// remoteFiles returns the selected objects under prefix in the bucket
+func (s *Session) remoteFiles(bucket, prefix string, o *SyncOptions) (map[string]*syncFile, error) {
+	files := make(map[string]*syncFile)
+	err := s3.New(s.AWS).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			rel := strings.TrimPrefix(aws.StringValue(obj.Key), prefix)
+			if rel == "" || strings.HasSuffix(rel, "/") || !o.selected(rel) {
+				// Directory markers, or not wanted
+				continue
+			}
+			files[rel] = &syncFile{
+				path:  rel,
+				size:  aws.Int64Value(obj.Size),
+				mtime: aws.TimeValue(obj.LastModified),
+				etag:  strings.Trim(aws.StringValue(obj.ETag), `"`),
+			}
+		}
+		return true
+	})
+	return files, err
+}
+
+// plan compares the source and destination, then runs transfer and remove over the Workers,
+// unless DryRun, returning the results sorted by path. Files that can only be compared by
+// ETag are hashed by the Workers too.
+func (o *SyncOptions) plan(src, dst map[string]*syncFile, action string, transfer, remove func(*SyncResult) error, prefix, dir string) []SyncResult {
+	var (
+		results []SyncResult
+		// compare has the ETags to compare the local files to, by path
+		compare = make(map[string]string)
+	)
+
+	for rel, sf := range src {
+		r := SyncResult{Path: rel, Key: prefix + rel, Action: action, Size: sf.size}
+		df, ok := dst[rel]
+		switch {
+		case !ok:
+			r.Reason = "new"
+		case sf.size != df.size:
+			r.Reason = "size"
+		case o.CompareMtime:
+			if sf.mtime.After(df.mtime) {
+				r.Reason = "mtime"
+			}
+		default:
+			// One of them is local, and the other has the ETag
+			etag := df.etag
+			if action == SyncDownload {
+				etag = sf.etag
+			}
+			compare[rel] = etag
+		}
+		if _, ok := compare[rel]; r.Reason == "" && !ok {
+			r.Action, r.Reason = SyncSkip, "unchanged"
+		}
+		results = append(results, r)
+	}
+
+	if o.Delete {
+		for rel, df := range dst {
+			if _, ok := src[rel]; !ok {
+				results = append(results, SyncResult{Path: rel, Key: prefix + rel, Action: SyncDelete, Reason: "extraneous", Size: df.size})
+			}
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+
+	var (
+		jobs = make(chan *SyncResult)
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < o.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				if etag, ok := compare[r.Path]; ok && r.Action != SyncDelete {
+					same, err := o.sameETag(filepath.Join(dir, filepath.FromSlash(r.Path)), etag)
+					if err != nil {
+						r.Err = err
+						continue
+					}
+					if same {
+						r.Action, r.Reason = SyncSkip, "unchanged"
+						continue
+					}
+					r.Reason = "etag"
+				}
+
+				switch {
+				case o.DryRun:
+				case r.Action == SyncDelete:
+					r.Err = remove(r)
+				default:
+					r.Err = transfer(r)
+				}
+			}
+		}()
+	}
+	for i := range results {
+		if results[i].Action != SyncSkip {
+			jobs <- &results[i]
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// sameETag returns true if the local file's content matches the S3 ETag. Multipart
+// ETags ("md5-parts") are compared using PartSizeMB, then ETagPartSizesMB.
+func (o *SyncOptions) sameETag(filename, etag string) (bool, error) {
+	return matchETag(filename, etag, append([]int64{o.PartSizeMB}, ETagPartSizesMB...))
+}
+
+// syncPrefix normalizes an S3 key prefix to end with a slash, unless it's empty
+func syncPrefix(prefix string) string {
+	prefix = strings.TrimPrefix(prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// newSyncReport tallies the results
+func newSyncReport(results []SyncResult) *SyncReport {
+	report := SyncReport{Results: results}
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			report.Failed++
+		case r.Action == SyncUpload:
+			report.Uploaded++
+			report.Bytes += r.Size
+		case r.Action == SyncDownload:
+			report.Downloaded++
+			report.Bytes += r.Size
+		case r.Action == SyncDelete:
+			report.Deleted++
+		default:
+			report.Skipped++
+		}
+	}
+	return &report
+}
@@ -0,0 +1,233 @@
+package aws
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFiles writes the files, by slash-separated path, under dir
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for rel, data := range files {
+		name := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// syncActions returns the results as "path:action:reason", in order
+func syncActions(report *SyncReport) string {
+	var actions []string
+	for _, r := range report.Results {
+		a := r.Path + ":" + r.Action + ":" + r.Reason
+		if r.Err != nil {
+			a += ":error"
+		}
+		actions = append(actions, a)
+	}
+	return strings.Join(actions, " ")
+}
+
+// putRequests returns the keys PUT to the fakeS3, sorted
+func (f *fakeS3) putRequests() (keys []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.requests {
+		if key, ok := strings.CutPrefix(r, "PUT "); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+func TestSyncDirToBucket(t *testing.T) {
+	f, s := newFakeS3(t)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"new.txt":        "new",
+		"same.txt":       "same",
+		"changed.txt":    "after",
+		"grown.txt":      "grown",
+		"sub/deep.txt":   "deep",
+		"skip/ignore.me": "ignored",
+	})
+	f.put("p/same.txt", []byte("same"))
+	f.put("p/changed.txt", []byte("befor"))
+	f.put("p/grown.txt", []byte("grow"))
+	f.put("p/gone.txt", []byte("gone"))
+	f.put("p/ignore.me", []byte("excluded, so not deleted"))
+	f.put("other/x.txt", []byte("outside the prefix"))
+
+	opts := SyncOptions{Delete: true, Exclude: []string{"*.me"}}
+
+	dry := opts
+	dry.DryRun = true
+	report, err := s.SyncDirToBucket(dir, "bucket", "p", dry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "changed.txt:upload:etag gone.txt:delete:extraneous grown.txt:upload:size new.txt:upload:new same.txt:skip:unchanged sub/deep.txt:upload:new"
+	if got := syncActions(report); got != want {
+		t.Errorf("dry run got %s, want %s", got, want)
+	}
+	if puts := f.putRequests(); len(puts) != 0 {
+		t.Errorf("dry run uploaded %v", puts)
+	}
+	if _, ok := f.object("p/gone.txt"); !ok {
+		t.Error("dry run deleted p/gone.txt")
+	}
+
+	report, err = s.SyncDirToBucket(dir, "bucket", "p", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := syncActions(report); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if report.Uploaded != 4 || report.Deleted != 1 || report.Skipped != 1 || report.Failed != 0 || report.Bytes != 17 {
+		t.Errorf("got report %+v", report)
+	}
+	if got := strings.Join(f.keys(), " "); got != "other/x.txt p/changed.txt p/grown.txt p/ignore.me p/new.txt p/same.txt p/sub/deep.txt" {
+		t.Errorf("bucket has %s", got)
+	}
+	for key, want := range map[string]string{"p/changed.txt": "after", "p/sub/deep.txt": "deep"} {
+		if got, _ := f.object(key); string(got) != want {
+			t.Errorf("%s is %q, want %q", key, got, want)
+		}
+	}
+
+	// Everything is unchanged now
+	report, err = s.SyncDirToBucket(dir, "bucket", "p", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Skipped != 5 || report.Uploaded+report.Deleted+report.Failed != 0 {
+		t.Errorf("second sync got %s", syncActions(report))
+	}
+}
+
+func TestSyncDirToBucketInclude(t *testing.T) {
+	f, s := newFakeS3(t)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.go": "a", "b.txt": "b", "sub/c.go": "c"})
+
+	report, err := s.SyncDirToBucket(dir, "bucket", "", SyncOptions{Include: []string{"*.go"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := syncActions(report); got != "a.go:upload:new sub/c.go:upload:new" {
+		t.Errorf("got %s", got)
+	}
+	if got := strings.Join(f.keys(), " "); got != "a.go sub/c.go" {
+		t.Errorf("bucket has %s", got)
+	}
+}
+
+func TestSyncDirToBucketPartSize(t *testing.T) {
+	f, s := newFakeS3(t)
+	dir := t.TempDir()
+	data := patternBytes(13 * testMB)
+	if err := os.WriteFile(filepath.Join(dir, "big"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := SyncOptions{PartSizeMB: 6}
+
+	if _, err := s.SyncDirToBucket(dir, "bucket", "", opts); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	parts := append([]int(nil), f.parts...)
+	etag := f.objects["big"].etag
+	f.mu.Unlock()
+	sort.Ints(parts)
+	if fmt.Sprint(parts) != fmt.Sprint([]int{testMB, 6 * testMB, 6 * testMB}) {
+		t.Errorf("uploaded parts of %v, want 6MB, 6MB and 1MB", parts)
+	}
+	want, err := CalculateETag(bytes.NewReader(data), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etag != want {
+		t.Errorf("got ETag %s, want %s", etag, want)
+	}
+
+	// It matches with the same part size, which isn't one of ETagPartSizesMB
+	report, err := s.SyncDirToBucket(dir, "bucket", "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := syncActions(report); got != "big:skip:unchanged" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestSyncBucketToDir(t *testing.T) {
+	f, s := newFakeS3(t)
+	dir := t.TempDir()
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	f.putAt("p/new.txt", []byte("new"), modified)
+	f.putAt("p/sub/deep.txt", []byte("deep"), modified)
+	f.putAt("p/same.txt", []byte("same"), modified)
+	f.putAt("p/changed.txt", []byte("after"), modified)
+	writeFiles(t, dir, map[string]string{"same.txt": "same", "changed.txt": "befor", "gone.txt": "gone"})
+
+	report, err := s.SyncBucketToDir("bucket", "p/", dir, SyncOptions{Delete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "changed.txt:download:etag gone.txt:delete:extraneous new.txt:download:new same.txt:skip:unchanged sub/deep.txt:download:new"
+	if got := syncActions(report); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	for rel, want := range map[string]string{"new.txt": "new", "sub/deep.txt": "deep", "changed.txt": "after"} {
+		name := filepath.Join(dir, filepath.FromSlash(rel))
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != want {
+			t.Errorf("%s is %q (%v), want %q", rel, data, err, want)
+		}
+		if fi, err := os.Stat(name); err != nil || !fi.ModTime().Equal(modified) {
+			t.Errorf("%s modified %v (%v), want %v", rel, fi.ModTime(), err, modified)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "gone.txt")); !os.IsNotExist(err) {
+		t.Errorf("gone.txt wasn't deleted: %v", err)
+	}
+
+	// The downloads have the objects' times, so compare as unchanged
+	report, err = s.SyncBucketToDir("bucket", "p/", dir, SyncOptions{CompareMtime: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Skipped != 4 || report.Downloaded != 0 {
+		t.Errorf("second sync got %s", syncActions(report))
+	}
+}
+
+func TestSyncBucketToDirOutside(t *testing.T) {
+	f, s := newFakeS3(t)
+	dir := filepath.Join(t.TempDir(), "dir")
+	f.put("p/../../escape", []byte("escape"))
+
+	report, err := s.SyncBucketToDir("bucket", "p", dir, SyncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Failed != 1 {
+		t.Errorf("got %s, want a failure", syncActions(report))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "..", "..", "escape")); !os.IsNotExist(err) {
+		t.Errorf("wrote outside of the directory: %v", err)
+	}
+}
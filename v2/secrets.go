@@ -0,0 +1,243 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const (
+	// SecretPrefix marks a config string as a KMSSession.Encrypt ciphertext
+	SecretPrefix = "kms:"
+	// PlaintextSecretPrefix marks a config string as a plaintext secret for EncryptConfig to encrypt
+	PlaintextSecretPrefix = "kms+plain:"
+	// SecretTag is the struct tag, set to "true", that marks string fields as secrets
+	SecretTag = "kms"
+)
+
+// ConfigConcurrency is the most KMS calls DecryptConfig and EncryptConfig make at once
+var ConfigConcurrency = 8
+
+// configSecret is a string found in a config, and how to replace it
+type configSecret struct {
+	path  string
+	value string
+	set   func(string)
+}
+
+// DecryptConfig walks config, which must be a pointer to a struct, or a map, decrypting
+// secrets in place. Secrets are strings prefixed with SecretPrefix, anywhere, and string
+// fields (or slices of them) tagged `kms:"true"`, with or without the prefix. Empty strings
+// are left alone. Every secret is attempted, and any errors returned together.
+func (k *KMSSession) DecryptConfig(config interface{}) error {
+	secrets, err := findSecrets(config)
+	if err != nil {
+		return err
+	}
+
+	var targets []configSecret
+	for _, cs := range secrets {
+		if cs.value == "" || strings.HasPrefix(cs.value, PlaintextSecretPrefix) {
+			continue
+		}
+		cs.value = strings.TrimPrefix(cs.value, SecretPrefix)
+		targets = append(targets, cs)
+	}
+
+	return k.transformSecrets(targets, k.Decrypt)
+}
+
+// EncryptConfig is the reverse of DecryptConfig, for preparing a config to be committed.
+// Strings prefixed with PlaintextSecretPrefix, and string fields tagged `kms:"true"`, are
+// encrypted and replaced with SecretPrefix and the ciphertext. Strings that already have
+// SecretPrefix, and empty strings, are left alone.
+func (k *KMSSession) EncryptConfig(config interface{}) error {
+	secrets, err := findSecrets(config)
+	if err != nil {
+		return err
+	}
+
+	var targets []configSecret
+	for _, cs := range secrets {
+		if cs.value == "" || strings.HasPrefix(cs.value, SecretPrefix) {
+			continue
+		}
+		cs.value = strings.TrimPrefix(cs.value, PlaintextSecretPrefix)
+		targets = append(targets, cs)
+	}
+
+	return k.transformSecrets(targets, func(plaintext string) (string, error) {
+		ciphertext, err := k.Encrypt(plaintext)
+		return SecretPrefix + ciphertext, err
+	})
+}
+
+// transformSecrets runs f over the targets, at most ConfigConcurrency at a time, then sets
+// the results. Setting is done afterwards, and serially, as maps aren't safe for concurrent writes.
+func (k *KMSSession) transformSecrets(targets []configSecret, f func(string) (string, error)) error {
+	var (
+		results = make([]string, len(targets))
+		errs    = make([]error, len(targets))
+		sem     = make(chan struct{}, max(ConfigConcurrency, 1))
+		wg      sync.WaitGroup
+	)
+
+	for i := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			results[i], errs[i] = f(targets[i].value)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("%s: %w", targets[i].path, errs[i])
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, t := range targets {
+		if errs[i] == nil {
+			t.set(results[i])
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// findSecrets returns the settable strings in config that are tagged, or have either prefix
+func findSecrets(config interface{}) ([]configSecret, error) {
+	v := reflect.ValueOf(config)
+	if !(v.Kind() == reflect.Ptr && !v.IsNil()) && v.Kind() != reflect.Map {
+		return nil, fmt.Errorf("config must be a non-nil pointer or a map, not %T", config)
+	}
+
+	w := secretWalker{seen: make(map[uintptr]bool)}
+	w.walk(v, "", false)
+	return w.secrets, nil
+}
+
+// secretWalker accumulates secrets while walking a config
+type secretWalker struct {
+	secrets []configSecret
+	seen    map[uintptr]bool
+}
+
+// isSecret returns true if s should be decrypted or encrypted
+func isSecret(s string, tagged bool) bool {
+	return tagged || strings.HasPrefix(s, SecretPrefix) || strings.HasPrefix(s, PlaintextSecretPrefix)
+}
+
+// walk recurses through v, recording secrets with their paths
+func (w *secretWalker) walk(v reflect.Value, path string, tagged bool) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || w.seen[v.Pointer()] {
+			return
+		}
+		w.seen[v.Pointer()] = true
+		w.walk(v.Elem(), path, tagged)
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		e := v.Elem()
+		if e.Kind() == reflect.String {
+			// The string in an interface isn't settable, but the interface may be
+			if v.CanSet() && isSecret(e.String(), tagged) {
+				w.add(path, e.String(), func(s string) { v.Set(reflect.ValueOf(s).Convert(e.Type())) })
+			}
+			return
+		}
+		if (e.Kind() == reflect.Struct || e.Kind() == reflect.Array) && v.CanSet() {
+			w.walkCopy(e, path, tagged, func(cp reflect.Value) { v.Set(cp) })
+			return
+		}
+		w.walk(e, path, tagged)
+
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				// unexported
+				continue
+			}
+			w.walk(v.Field(i), joinPath(path, f.Name), f.Tag.Get(SecretTag) == "true")
+		}
+
+	case reflect.Map:
+		if v.IsNil() || w.seen[v.Pointer()] {
+			return
+		}
+		w.seen[v.Pointer()] = true
+		iter := v.MapRange()
+		for iter.Next() {
+			key, val := iter.Key(), iter.Value()
+			kpath := fmt.Sprintf("%s[%v]", path, key.Interface())
+
+			s := val
+			if s.Kind() == reflect.Interface && !s.IsNil() {
+				s = s.Elem()
+			}
+			if s.Kind() == reflect.String {
+				// Map values aren't settable, but the map is
+				if isSecret(s.String(), tagged) {
+					st, et := s.Type(), v.Type().Elem()
+					w.add(kpath, s.String(), func(ns string) {
+						v.SetMapIndex(key, reflect.ValueOf(ns).Convert(st).Convert(et))
+					})
+				}
+				continue
+			}
+			if s.Kind() == reflect.Struct || s.Kind() == reflect.Array {
+				w.walkCopy(s, kpath, tagged, func(cp reflect.Value) { v.SetMapIndex(key, cp) })
+				continue
+			}
+			w.walk(val, kpath, tagged)
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			w.walk(v.Index(i), fmt.Sprintf("%s[%d]", path, i), tagged)
+		}
+
+	case reflect.String:
+		if v.CanSet() && isSecret(v.String(), tagged) {
+			w.add(path, v.String(), func(s string) { v.SetString(s) })
+		}
+	}
+}
+
+// walkCopy walks a copy of v, which isn't settable, such as a struct or array held in a map
+// or an interface, so the secrets in it can be set. Once one is, the copy is stored back with store.
+func (w *secretWalker) walkCopy(v reflect.Value, path string, tagged bool, store func(reflect.Value)) {
+	cp := reflect.New(v.Type()).Elem()
+	cp.Set(v)
+
+	n := len(w.secrets)
+	w.walk(cp, path, tagged)
+	for i := n; i < len(w.secrets); i++ {
+		set := w.secrets[i].set
+		w.secrets[i].set = func(s string) {
+			set(s)
+			store(cp)
+		}
+	}
+}
+
+// add records a secret
+func (w *secretWalker) add(path, value string, set func(string)) {
+	w.secrets = append(w.secrets, configSecret{path: path, value: value, set: set})
+}
+
+// joinPath returns the path to a struct field
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
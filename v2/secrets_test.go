@@ -0,0 +1,151 @@
+package aws
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testSecret is a struct held by value in maps, arrays and interfaces in testConfig
+type testSecret struct {
+	Password string `kms:"true"`
+	User     string
+}
+
+// testConfig has secrets in every place DecryptConfig and EncryptConfig look
+type testConfig struct {
+	Password string   `kms:"true"`
+	Tokens   []string `kms:"true"`
+	Empty    string   `kms:"true"`
+	Plain    string
+	Prefixed string
+	Nested   *testConfig
+	ByName   map[string]testSecret
+	Pairs    map[string][2]string
+	Any      map[string]interface{}
+	Iface    interface{}
+	Array    [2]testSecret
+	hidden   string
+}
+
+// newTestConfig returns a testConfig with plaintext secrets, and a pointer cycle
+func newTestConfig() *testConfig {
+	c := &testConfig{
+		Password: "p0",
+		Tokens:   []string{"t0", "t1"},
+		Plain:    "not secret",
+		Prefixed: PlaintextSecretPrefix + "p1",
+		Nested:   &testConfig{Password: "p2"},
+		ByName:   map[string]testSecret{"db": {Password: "p3", User: "u3"}},
+		Pairs:    map[string][2]string{"pair": {PlaintextSecretPrefix + "p4", "not secret"}},
+		Any: map[string]interface{}{
+			"str":    PlaintextSecretPrefix + "p5",
+			"struct": testSecret{Password: "p6"},
+			"map":    map[string]string{"key": PlaintextSecretPrefix + "p7"},
+		},
+		Iface:  testSecret{Password: "p8"},
+		Array:  [2]testSecret{{Password: "p9"}, {User: "u10"}},
+		hidden: PlaintextSecretPrefix + "hidden",
+	}
+	c.Nested.Nested = c
+	return c
+}
+
+// secretsOf returns the secret strings of a testConfig, in order
+func secretsOf(c *testConfig) []string {
+	return []string{
+		c.Password, c.Tokens[0], c.Tokens[1], c.Prefixed, c.Nested.Password,
+		c.ByName["db"].Password, c.Pairs["pair"][0],
+		c.Any["str"].(string), c.Any["struct"].(testSecret).Password, c.Any["map"].(map[string]string)["key"],
+		c.Iface.(testSecret).Password, c.Array[0].Password,
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	k := NewKMSSessionWithClient(newTestKMS(t), "alias/new")
+	c := newTestConfig()
+	want := []string{"p0", "t0", "t1", "p1", "p2", "p3", "p4", "p5", "p6", "p7", "p8", "p9"}
+
+	if err := k.EncryptConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range secretsOf(c) {
+		if !strings.HasPrefix(s, SecretPrefix) {
+			t.Errorf("secret %d (%s) wasn't encrypted: %q", i, want[i], s)
+		}
+	}
+	// Everything else is left alone
+	if c.Empty != "" || c.Plain != "not secret" || c.Pairs["pair"][1] != "not secret" ||
+		c.ByName["db"].User != "u3" || c.Array[1].User != "u10" || c.hidden != PlaintextSecretPrefix+"hidden" {
+		t.Errorf("non-secrets changed: %+v", c)
+	}
+
+	// Encrypting again changes nothing
+	encrypted := secretsOf(c)
+	if err := k.EncryptConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(secretsOf(c), " ") != strings.Join(encrypted, " ") {
+		t.Error("encrypting again changed the secrets")
+	}
+
+	if err := k.DecryptConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if got := secretsOf(c); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("decrypted %q, want %q", got, want)
+	}
+}
+
+func TestConfigMap(t *testing.T) {
+	k := NewKMSSessionWithClient(newTestKMS(t), "alias/new")
+	config := map[string]testSecret{"a": {Password: "pa"}, "b": {User: "ub"}}
+
+	if err := k.EncryptConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(config["a"].Password, SecretPrefix) || config["b"].Password != "" {
+		t.Errorf("got %+v", config)
+	}
+	if err := k.DecryptConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if config["a"].Password != "pa" || config["b"].User != "ub" {
+		t.Errorf("got %+v", config)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	k := NewKMSSessionWithClient(newTestKMS(t), "alias/new")
+
+	if err := k.DecryptConfig(testConfig{}); err == nil {
+		t.Error("got no error for a config that isn't a pointer")
+	}
+
+	good, err := k.Encrypt("good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testConfig{
+		Password: good,
+		ByName:   map[string]testSecret{"db": {Password: SecretPrefix + "bm90IGEgY2lwaGVydGV4dA=="}},
+	}
+
+	// Every secret is attempted, and the failures reported by path
+	err = k.DecryptConfig(c)
+	if err == nil || !strings.Contains(err.Error(), "ByName[db].Password") {
+		t.Errorf("got error %v, want it to name ByName[db].Password", err)
+	}
+	if c.Password != "good" {
+		t.Errorf("Password is %q, want it decrypted despite the other failure", c.Password)
+	}
+
+	other, err := NewKMSSessionWithClient(k.client, "alias/other").Encrypt("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.VerifyKey()
+	if err = k.DecryptConfig(&testConfig{Password: other}); !errors.Is(err, ErrKeyNotAllowed) {
+		t.Errorf("got error %v, want %v", err, ErrKeyNotAllowed)
+	}
+}
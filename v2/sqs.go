@@ -0,0 +1,223 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cast"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// SQS_GetQueueUrl returns the queue URL for the specified queue.
+func (s *Session) SQS_GetQueueUrl(queue string) (qurl string, err error) {
+	svc := sqs.New(s.AWS)
+
+	params := &sqs.GetQueueUrlInput{
+		QueueName: aws.String(queue),
+	}
+	resp, err := svc.GetQueueUrl(params)
+
+	if err != nil {
+		return
+	}
+
+	qurl = *resp.QueueUrl
+	return
+}
+
+// SQS_Attributes returns an SqsInfo struct for the specified queue, as NewSqsInfo
+func (s *Session) SQS_Attributes(queue string) (sInfo *SqsInfo, err error) {
+	return s.NewSqsInfo(queue)
+}
+
+// RedrivePolicy is a queue's dead-letter queue configuration
+type RedrivePolicy struct {
+	DeadLetterTargetArn string
+	MaxReceiveCount     int64
+}
+
+// SqsInfo describes an SQS queue. Call Refresh to update it, or Watch to receive
+// updated snapshots periodically.
+type SqsInfo struct {
+	Name                      string
+	URL                       string
+	Messages                  int64
+	MessagesDelayed           int64
+	MessagesInvisible         int64
+	ModifiedStamp             int64
+	FifoQueue                 bool
+	ContentBasedDeduplication bool
+	VisibilityTimeout         time.Duration
+	Retention                 time.Duration
+	// OldestMessageAge is from the CloudWatch ApproximateAgeOfOldestMessage metric,
+	// so lags by a few minutes, and is zero if there is no recent datapoint, or
+	// it couldn't be retrieved (e.g. without cloudwatch:GetMetricStatistics)
+	OldestMessageAge time.Duration
+	// RedrivePolicy is nil if the queue has no dead-letter queue
+	RedrivePolicy *RedrivePolicy
+	// DLQMessages is the number of messages in the dead-letter queue, if any, and
+	// is zero if it couldn't be retrieved
+	DLQMessages int64
+
+	session *Session
+	sqs     *sqs.SQS
+	qurl    string
+	lasterr error
+}
+
+// NewSqsInfo returns an SqsInfo struct or an error for the specified queue
+func (s *Session) NewSqsInfo(queue string) (sInfo *SqsInfo, err error) {
+	sInfo = &SqsInfo{
+		Name:    queue,
+		session: s,
+		sqs:     sqs.New(s.AWS),
+	}
+
+	params := &sqs.GetQueueUrlInput{
+		QueueName: aws.String(queue),
+	}
+	resp, err := sInfo.sqs.GetQueueUrl(params)
+	if err != nil {
+		return nil, err
+	}
+	sInfo.qurl = *resp.QueueUrl
+	sInfo.URL = sInfo.qurl
+
+	sInfo.Refresh()
+	err = sInfo.LastError()
+
+	return
+}
+
+// Refresh updates the SqsInfo from the queue attributes, the dead-letter queue's attributes,
+// and CloudWatch. Any error getting the queue attributes is available from LastError. The
+// dead-letter queue and CloudWatch lookups are best-effort: their errors go to DebugOut.
+func (s *SqsInfo) Refresh() {
+	params := &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(s.qurl), // Required
+		AttributeNames: []*string{
+			aws.String(sqs.QueueAttributeNameAll),
+		},
+	}
+	resp, err := s.sqs.GetQueueAttributes(params)
+	if err != nil {
+		s.lasterr = err
+		return
+	}
+	s.lasterr = nil
+
+	s.Messages = cast.ToInt64(aws.StringValue(resp.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]))
+	s.MessagesDelayed = cast.ToInt64(aws.StringValue(resp.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed]))
+	s.MessagesInvisible = cast.ToInt64(aws.StringValue(resp.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible]))
+	s.ModifiedStamp = cast.ToInt64(aws.StringValue(resp.Attributes[sqs.QueueAttributeNameLastModifiedTimestamp]))
+	s.FifoQueue = cast.ToBool(aws.StringValue(resp.Attributes[sqs.QueueAttributeNameFifoQueue]))
+	s.ContentBasedDeduplication = cast.ToBool(aws.StringValue(resp.Attributes[sqs.QueueAttributeNameContentBasedDeduplication]))
+	s.VisibilityTimeout = time.Duration(cast.ToInt64(aws.StringValue(resp.Attributes[sqs.QueueAttributeNameVisibilityTimeout]))) * time.Second
+	s.Retention = time.Duration(cast.ToInt64(aws.StringValue(resp.Attributes[sqs.QueueAttributeNameMessageRetentionPeriod]))) * time.Second
+
+	s.RedrivePolicy = nil
+	s.DLQMessages = 0
+	if rp := aws.StringValue(resp.Attributes[sqs.QueueAttributeNameRedrivePolicy]); rp != "" {
+		s.RedrivePolicy, err = parseRedrivePolicy(rp)
+		if err != nil {
+			s.lasterr = err
+			return
+		}
+		if s.DLQMessages, err = s.dlqMessages(); err != nil {
+			DebugOut.Printf("SqsInfo %s: dead-letter queue: %s\n", s.Name, err)
+		}
+	}
+
+	s.OldestMessageAge = 0
+	if s.session != nil {
+		point, err := s.session.GetLastCloudWatchValue("QueueName", s.Name, "AWS/SQS", "ApproximateAgeOfOldestMessage", cloudwatch.StatisticMaximum, cloudwatch.StandardUnitSeconds)
+		if err != nil {
+			DebugOut.Printf("SqsInfo %s: ApproximateAgeOfOldestMessage: %s\n", s.Name, err)
+		} else if point != nil && point.Maximum != nil {
+			s.OldestMessageAge = time.Duration(*point.Maximum * float64(time.Second))
+		}
+	}
+}
+
+// dlqMessages returns the number of messages in the dead-letter queue
+func (s *SqsInfo) dlqMessages() (int64, error) {
+	dlq, err := arn.Parse(s.RedrivePolicy.DeadLetterTargetArn)
+	if err != nil {
+		return 0, err
+	}
+
+	uresp, err := s.sqs.GetQueueUrl(&sqs.GetQueueUrlInput{
+		QueueName:              aws.String(dlq.Resource),
+		QueueOwnerAWSAccountId: aws.String(dlq.AccountID),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	aresp, err := s.sqs.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl: uresp.QueueUrl,
+		AttributeNames: []*string{
+			aws.String(sqs.QueueAttributeNameApproximateNumberOfMessages),
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return cast.ToInt64(aws.StringValue(aresp.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages])), nil
+}
+
+// parseRedrivePolicy parses a RedrivePolicy queue attribute, where maxReceiveCount
+// may be a string or a number
+func parseRedrivePolicy(policy string) (*RedrivePolicy, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(policy), &raw); err != nil {
+		return nil, fmt.Errorf("bad RedrivePolicy: %w", err)
+	}
+	return &RedrivePolicy{
+		DeadLetterTargetArn: cast.ToString(raw["deadLetterTargetArn"]),
+		MaxReceiveCount:     cast.ToInt64(raw["maxReceiveCount"]),
+	}, nil
+}
+
+// Watch refreshes the SqsInfo every interval until the context is cancelled, delivering a
+// snapshot after each refresh on the returned channel, which is closed when Watch finishes.
+// Check each snapshot's LastError. The SqsInfo itself should not be read while being watched.
+func (s *SqsInfo) Watch(ctx context.Context, interval time.Duration) <-chan SqsInfo {
+	snapshots := make(chan SqsInfo)
+
+	go func() {
+		defer close(snapshots)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			s.Refresh()
+			select {
+			case snapshots <- *s:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return snapshots
+}
+
+// LastError returns the last polling error
+func (s *SqsInfo) LastError() error {
+	return s.lasterr
+}
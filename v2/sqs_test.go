@@ -0,0 +1,122 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sqsStandIn is a local stand-in for the SQS query API's GetQueueUrl and GetQueueAttributes,
+// for a queue with messages messages, and a dead-letter queue, "dlq", with dlq messages
+type sqsStandIn struct {
+	mu       sync.Mutex
+	url      string
+	messages int
+	dlq      int
+}
+
+func (q *sqsStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	switch r.PostForm.Get("Action") {
+	case "GetQueueUrl":
+		fmt.Fprintf(w, `<GetQueueUrlResponse><GetQueueUrlResult><QueueUrl>%s/123456789012/%s</QueueUrl></GetQueueUrlResult></GetQueueUrlResponse>`,
+			q.url, r.PostForm.Get("QueueName"))
+	case "GetQueueAttributes":
+		attr := func(name string, value interface{}) {
+			fmt.Fprintf(w, `<Attribute><Name>%s</Name><Value>%v</Value></Attribute>`, name, value)
+		}
+		fmt.Fprint(w, `<GetQueueAttributesResponse><GetQueueAttributesResult>`)
+		if r.PostForm.Get("QueueUrl") == q.url+"/123456789012/dlq" {
+			attr("ApproximateNumberOfMessages", q.dlq)
+		} else {
+			attr("ApproximateNumberOfMessages", q.messages)
+			attr("ApproximateNumberOfMessagesNotVisible", 2)
+			attr("VisibilityTimeout", 30)
+			attr("RedrivePolicy", `{"deadLetterTargetArn":"arn:aws:sqs:us-east-1:123456789012:dlq","maxReceiveCount":"5"}`)
+		}
+		fmt.Fprint(w, `</GetQueueAttributesResult></GetQueueAttributesResponse>`)
+	default:
+		// CloudWatch, which is best-effort
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `<ErrorResponse><Error><Code>InvalidAction</Code><Message>not here</Message></Error></ErrorResponse>`)
+	}
+}
+
+// set changes the number of messages in the queue and dead-letter queue
+func (q *sqsStandIn) set(messages, dlq int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.messages, q.dlq = messages, dlq
+}
+
+// newSQSStandIn starts an sqsStandIn, returning it and a Session using it
+func newSQSStandIn(t *testing.T) (*sqsStandIn, *Session) {
+	t.Helper()
+	q := &sqsStandIn{messages: 5, dlq: 1}
+	srv := httptest.NewServer(q)
+	t.Cleanup(srv.Close)
+	q.url = srv.URL
+	return q, newTestSession(t, WithEndpoint("*", srv.URL), WithMaxRetries(0))
+}
+
+func TestSQSAttributesRefresh(t *testing.T) {
+	q, s := newSQSStandIn(t)
+
+	info, err := s.SQS_Attributes("work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Messages != 5 || info.MessagesInvisible != 2 || info.DLQMessages != 1 || info.VisibilityTimeout != 30*time.Second {
+		t.Errorf("got %+v", *info)
+	}
+	if info.RedrivePolicy == nil || info.RedrivePolicy.MaxReceiveCount != 5 {
+		t.Errorf("got RedrivePolicy %+v", info.RedrivePolicy)
+	}
+
+	q.set(7, 3)
+	info.Refresh()
+	if err = info.LastError(); err != nil {
+		t.Fatal(err)
+	}
+	if info.Messages != 7 || info.DLQMessages != 3 {
+		t.Errorf("after Refresh got %d messages, %d dead, want 7, 3", info.Messages, info.DLQMessages)
+	}
+}
+
+func TestSQSAttributesWatch(t *testing.T) {
+	q, s := newSQSStandIn(t)
+
+	info, err := s.SQS_Attributes("work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.set(9, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	snapshots := info.Watch(ctx, 10*time.Millisecond)
+
+	select {
+	case snap := <-snapshots:
+		if err = snap.LastError(); err != nil {
+			t.Fatal(err)
+		}
+		if snap.Messages != 9 {
+			t.Errorf("got %d messages, want 9", snap.Messages)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no snapshot")
+	}
+
+	cancel()
+	for range snapshots {
+		// Drain until Watch finishes
+	}
+}